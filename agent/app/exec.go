@@ -0,0 +1,296 @@
+// Application-level metric gathering from external commands and log files.
+package app
+
+import (
+  "bufio"
+  "bytes"
+  "context"
+  "fmt"
+  "os/exec"
+  "reflect"
+  "strconv"
+  "strings"
+  "sync"
+  "syscall"
+  "time"
+  "../../util"
+)
+
+// PATH given to commands run by the ExecSampler, unless overridden by the
+// command's own environment.
+const execPath = "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// Default time a command may run for before it's killed.
+const defaultExecTimeout = 10 * time.Second
+
+// Configuration of an external command run by the ExecSampler.
+type ExecCommand struct {
+  // Name identifying this command in health samples and errors.
+  Name     string   `json:"name"`
+  // Program and arguments to run.
+  Command  []string `json:"command"`
+  // Seconds between runs; the command is run on every sample when zero.
+  Interval int      `json:"interval"`
+  // Seconds the command may run for before it's killed.
+  Timeout  int      `json:"timeout"`
+  // KEY=VALUE environment variables. Commands don't inherit the agent's
+  // environment; only PATH is set unless given here.
+  Env      []string `json:"env"`
+  // Working directory to run the command in.
+  Dir      string   `json:"dir"`
+}
+
+// Outcome of a single run of an external command.
+type execResult struct {
+  samples  [][]interface{}
+  exitCode int
+  duration time.Duration
+  invalid  int
+  stderr   string
+  err      error
+}
+
+// Schedule and latest outcome of a command run by the ExecSampler.
+type execJob struct {
+  cmd     ExecCommand
+  lastRun time.Time
+  running bool
+  // Outcome of the last run, until it's reported.
+  result  *execResult
+}
+
+// Sampler that runs external commands (e.g. existing shell checks) and
+// turns their output into samples. Commands write one sample per line to
+// stdout, as either "metric value" or "metric key=value,... value"; blank
+// lines and lines starting with # are ignored.
+//
+// Each command runs on a goroutine of its own whenever it's due, so that
+// slow commands don't hold up sampling; a command isn't started again
+// while it's still running. Its samples are written out by the first
+// Sample() after it finishes, followed by an "exec.status" sample reporting
+// its exit code (-1 if it was killed), run time in seconds and number of
+// unparseable output lines. Commands that fail make that Sample() return
+// an error carrying their stderr.
+type ExecSampler struct {
+  sink   util.SampleWriter
+  mu     sync.Mutex
+  jobs   []*execJob
+  ctx    context.Context
+  cancel context.CancelFunc
+  wg     sync.WaitGroup
+}
+
+// Create a new external command sampler.
+func NewExecSampler(commands []ExecCommand, s util.SampleWriter) *ExecSampler {
+  ex := &ExecSampler{sink: s, jobs: make([]*execJob, 0, len(commands))}
+  for _, cmd := range commands {
+    ex.jobs = append(ex.jobs, &execJob{cmd: cmd})
+  }
+  ex.ctx, ex.cancel = context.WithCancel(context.Background())
+  return ex
+}
+
+// Initialize this sampler.
+func (ex *ExecSampler) Init() (err error) {
+  ex.mu.Lock()
+  defer ex.mu.Unlock()
+  commands := make([]ExecCommand, 0, len(ex.jobs))
+  for _, job := range ex.jobs {
+    commands = append(commands, job.cmd)
+  }
+  return validateCommands(commands)
+}
+
+// Returns whether any commands are configured.
+func (ex *ExecSampler) Enabled() bool {
+  ex.mu.Lock()
+  defer ex.mu.Unlock()
+  return len(ex.jobs) > 0
+}
+
+// Switch to running the given commands. Commands whose configuration is
+// unchanged keep to their existing schedule.
+func (ex *ExecSampler) Reconfigure(commands []ExecCommand) (err error) {
+  if err = validateCommands(commands); err != nil {
+    return
+  }
+  ex.mu.Lock()
+  defer ex.mu.Unlock()
+  prev := ex.jobs
+  ex.jobs = make([]*execJob, 0, len(commands))
+  for _, cmd := range commands {
+    job := &execJob{cmd: cmd}
+    for i, p := range prev {
+      if p != nil && reflect.DeepEqual(cmd, p.cmd) {
+        job, prev[i] = p, nil
+        break
+      }
+    }
+    ex.jobs = append(ex.jobs, job)
+  }
+  return nil
+}
+
+// Kill any commands still running and wait for them to exit.
+func (ex *ExecSampler) Close() error {
+  ex.cancel()
+  ex.wg.Wait()
+  return nil
+}
+
+// Check that every command has a name and something to run.
+func validateCommands(commands []ExecCommand) error {
+  for _, cmd := range commands {
+    if cmd.Name == "" || len(cmd.Command) == 0 {
+      return fmt.Errorf("exec command needs a name and a command: %+v", cmd)
+    }
+  }
+  return nil
+}
+
+// Start every command that is due, and write out the samples of those that
+// have finished since the last sample.
+func (ex *ExecSampler) Sample() (err error) {
+  ex.start(time.Now())
+  return ex.report()
+}
+
+// Start every command that is due and not still running at the given time.
+func (ex *ExecSampler) start(now time.Time) {
+  ex.mu.Lock()
+  defer ex.mu.Unlock()
+  for _, job := range ex.jobs {
+    interval := time.Duration(job.cmd.Interval) * time.Second
+    if job.running ||
+       !job.lastRun.IsZero() && now.Sub(job.lastRun) < interval {
+      continue
+    }
+    job.lastRun, job.running = now, true
+    ex.wg.Add(1)
+    go func(job *execJob) {
+      defer ex.wg.Done()
+      res := runCommand(ex.ctx, job.cmd)
+      ex.mu.Lock()
+      job.running, job.result = false, res
+      ex.mu.Unlock()
+    }(job)
+  }
+}
+
+// Write out the outcome of every finished run not yet reported, in the
+// order the commands are configured.
+func (ex *ExecSampler) report() (err error) {
+  ex.mu.Lock()
+  names := make([]string, 0)
+  results := make([]*execResult, 0)
+  for _, job := range ex.jobs {
+    if job.result != nil {
+      names = append(names, job.cmd.Name)
+      results = append(results, job.result)
+      job.result = nil
+    }
+  }
+  ex.mu.Unlock()
+  failed := make([]string, 0)
+  for i, res := range results {
+    name := names[i]
+    for _, sample := range res.samples {
+      ex.sink.Write(sample...)
+    }
+    ex.sink.Write("exec.status",
+                  name,
+                  res.exitCode,
+                  res.duration.Seconds(),
+                  res.invalid)
+    if res.err != nil {
+      msg := fmt.Sprintf("%s: %s", name, res.err)
+      if res.stderr != "" {
+        msg += ": " + res.stderr
+      }
+      failed = append(failed, msg)
+    }
+  }
+  if len(failed) > 0 {
+    err = fmt.Errorf("exec: %s", strings.Join(failed, "; "))
+  }
+  return
+}
+
+// Run a command to completion, until it times out or until the given
+// context is done, and parse its output.
+func runCommand(parent context.Context, cmd ExecCommand) *execResult {
+  timeout := time.Duration(cmd.Timeout) * time.Second
+  if timeout <= 0 {
+    timeout = defaultExecTimeout
+  }
+  ctx, cancel := context.WithTimeout(parent, timeout)
+  defer cancel()
+  var stdout, stderr bytes.Buffer
+  c := exec.CommandContext(ctx, cmd.Command[0], cmd.Command[1:]...)
+  c.Env = append([]string{execPath}, cmd.Env...)
+  c.Dir = cmd.Dir
+  c.Stdout = &stdout
+  c.Stderr = &stderr
+  // Run in a process group of its own, so that on timeout any children a
+  // shell script spawned are killed along with it.
+  c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+  c.Cancel = func() error {
+    return syscall.Kill(-c.Process.Pid, syscall.SIGKILL)
+  }
+  c.WaitDelay = time.Second
+
+  start := time.Now()
+  err := c.Run()
+  res := &execResult{duration: time.Since(start), err: err}
+  if ctx.Err() == context.DeadlineExceeded {
+    res.err = fmt.Errorf("timed out after %s", timeout)
+  }
+  if c.ProcessState != nil {
+    res.exitCode = c.ProcessState.ExitCode()
+  } else {
+    res.exitCode = -1
+  }
+  res.stderr = strings.TrimSpace(stderr.String())
+  res.samples, res.invalid = parseExecOutput(&stdout)
+  return res
+}
+
+// Parse the samples written by a command to stdout, returning them along
+// with the number of lines that couldn't be parsed.
+func parseExecOutput(buf *bytes.Buffer) (samples [][]interface{}, invalid int) {
+  samples = make([][]interface{}, 0)
+  scanner := bufio.NewScanner(buf)
+  for scanner.Scan() {
+    line := strings.TrimSpace(scanner.Text())
+    if line == "" || strings.HasPrefix(line, "#") {
+      continue
+    }
+    sample, err := parseExecLine(line)
+    if err != nil {
+      invalid++
+      continue
+    }
+    samples = append(samples, sample)
+  }
+  return
+}
+
+// Parse a single "metric [tags] value" line of command output.
+func parseExecLine(line string) ([]interface{}, error) {
+  parts := strings.Fields(line)
+  if len(parts) < 2 || len(parts) > 3 {
+    return nil, fmt.Errorf("malformed sample: %q", line)
+  }
+  value, err := strconv.ParseFloat(parts[len(parts) - 1], 64)
+  if err != nil {
+    return nil, err
+  }
+  if len(parts) == 2 {
+    return []interface{}{parts[0], value}, nil
+  }
+  tags, err := util.ParseTags(parts[1])
+  if err != nil {
+    return nil, err
+  }
+  return []interface{}{parts[0], tags, value}, nil
+}
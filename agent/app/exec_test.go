@@ -0,0 +1,168 @@
+package app
+
+import (
+  "fmt"
+  "github.com/bmizerany/assert"
+  "os"
+  "strings"
+  "testing"
+  "time"
+)
+
+type BufferedSampleWriter struct {
+  Lines []string
+}
+
+func NewBufferedSampleWriter() *BufferedSampleWriter {
+  return &BufferedSampleWriter{Lines: make([]string, 0)}
+}
+
+func (b *BufferedSampleWriter) Write(v ...interface{}) {
+  b.Lines = append(b.Lines, fmt.Sprintln(v...))
+}
+
+func shell(name, script string) ExecCommand {
+  return ExecCommand{Name: name, Command: []string{"/bin/sh", "-c", script}}
+}
+
+// Run every command that is due to completion and report the outcome.
+func runDue(ex *ExecSampler) error {
+  ex.start(time.Now())
+  ex.wg.Wait()
+  return ex.report()
+}
+
+func Test_ExecSampler_should_parse_command_output(t *testing.T) {
+  wr := NewBufferedSampleWriter()
+  sampler := NewExecSampler([]ExecCommand{
+    shell("queues", `
+echo "# queue depths"
+echo "app.queue.depth queue=mail,env=prod 42"
+echo
+echo "app.workers 8"
+echo "not a sample"
+`),
+  }, wr)
+  if err := sampler.Init(); err != nil {
+    t.Fatalf("Init() failed: %s", err)
+  }
+  if err := runDue(sampler); err != nil {
+    t.Fatalf("Sample() failed: %s", err)
+  }
+  assert.Equal(t, 3, len(wr.Lines))
+  assert.Equal(t, "app.queue.depth env=prod,queue=mail 42\n", wr.Lines[0])
+  assert.Equal(t, "app.workers 8\n", wr.Lines[1])
+  assert.Equal(t, true, strings.HasPrefix(wr.Lines[2], "exec.status queues 0 "))
+  assert.Equal(t, true, strings.HasSuffix(wr.Lines[2], " 1\n"))
+}
+
+func Test_ExecSampler_should_report_failures_with_stderr(t *testing.T) {
+  wr := NewBufferedSampleWriter()
+  sampler := NewExecSampler([]ExecCommand{
+    shell("broken", "echo 'app.up 0'; echo 'disk full' >&2; exit 3"),
+  }, wr)
+  err := runDue(sampler)
+  if err == nil || !strings.Contains(err.Error(), "broken: exit status 3: disk full") {
+    t.Fatalf("expected failure with stderr, got %v", err)
+  }
+  assert.Equal(t, 2, len(wr.Lines))
+  assert.Equal(t, "app.up 0\n", wr.Lines[0])
+  assert.Equal(t, true, strings.HasPrefix(wr.Lines[1], "exec.status broken 3 "))
+}
+
+func Test_ExecSampler_should_kill_commands_that_time_out(t *testing.T) {
+  wr := NewBufferedSampleWriter()
+  cmd := shell("slow", "sleep 10 & sleep 10; echo 'app.never 1'")
+  cmd.Timeout = 1
+  sampler := NewExecSampler([]ExecCommand{cmd}, wr)
+  err := runDue(sampler)
+  if err == nil || !strings.Contains(err.Error(), "slow: timed out after 1s") {
+    t.Fatalf("expected timeout, got %v", err)
+  }
+  assert.Equal(t, 1, len(wr.Lines))
+  assert.Equal(t, true, strings.HasPrefix(wr.Lines[0], "exec.status slow -1 "))
+}
+
+func Test_ExecSampler_should_run_commands_on_their_own_interval(t *testing.T) {
+  wr := NewBufferedSampleWriter()
+  every := shell("every", "echo 'app.every 1'")
+  hourly := shell("hourly", "echo 'app.hourly 1'")
+  hourly.Interval = 3600
+  sampler := NewExecSampler([]ExecCommand{every, hourly}, wr)
+  for i := 0; i < 3; i++ {
+    if err := runDue(sampler); err != nil {
+      t.Fatalf("Sample() failed: %s", err)
+    }
+  }
+  assert.Equal(t, 8, len(wr.Lines))
+  assert.Equal(t, "app.hourly 1\n", wr.Lines[2])
+}
+
+func Test_ExecSampler_should_not_leak_agent_environment(t *testing.T) {
+  os.Setenv("MONITOR_SECRET", "hunter2")
+  defer os.Unsetenv("MONITOR_SECRET")
+  wr := NewBufferedSampleWriter()
+  cmd := shell("env", "echo \"app.env ${MONITOR_SECRET:-0}\"; echo \"app.given $GIVEN\"")
+  cmd.Env = []string{"GIVEN=7"}
+  sampler := NewExecSampler([]ExecCommand{cmd}, wr)
+  if err := runDue(sampler); err != nil {
+    t.Fatalf("Sample() failed: %s", err)
+  }
+  assert.Equal(t, "app.env 0\n", wr.Lines[0])
+  assert.Equal(t, "app.given 7\n", wr.Lines[1])
+}
+
+func Test_ExecSampler_should_keep_schedule_of_unchanged_commands_on_reconfigure(t *testing.T) {
+  wr := NewBufferedSampleWriter()
+  hourly := shell("hourly", "echo 'app.hourly 1'")
+  hourly.Interval = 3600
+  sampler := NewExecSampler([]ExecCommand{hourly}, wr)
+  if err := runDue(sampler); err != nil {
+    t.Fatalf("Sample() failed: %s", err)
+  }
+  added := shell("added", "echo 'app.added 1'")
+  if err := sampler.Reconfigure([]ExecCommand{added, hourly}); err != nil {
+    t.Fatalf("Reconfigure() failed: %s", err)
+  }
+  wr.Lines = wr.Lines[:0]
+  if err := runDue(sampler); err != nil {
+    t.Fatalf("Sample() failed: %s", err)
+  }
+  assert.Equal(t, 2, len(wr.Lines))
+  assert.Equal(t, "app.added 1\n", wr.Lines[0])
+
+  err := sampler.Reconfigure([]ExecCommand{{Name: "empty"}})
+  assert.NotEqual(t, nil, err)
+  assert.Equal(t, true, sampler.Enabled())
+}
+
+func Test_ExecSampler_should_not_wait_for_slow_commands(t *testing.T) {
+  wr := NewBufferedSampleWriter()
+  sampler := NewExecSampler([]ExecCommand{
+    shell("slow", "sleep 10; echo 'app.slow 1'"),
+    shell("fast", "echo 'app.fast 1'"),
+  }, wr)
+  start := time.Now()
+  for i := 0; i < 3; i++ {
+    if err := sampler.Sample(); err != nil {
+      t.Fatalf("Sample() failed: %s", err)
+    }
+    time.Sleep(100 * time.Millisecond)
+  }
+  if elapsed := time.Since(start); elapsed > 2 * time.Second {
+    t.Fatalf("Sample() waited %s for a slow command", elapsed)
+  }
+  for _, line := range wr.Lines {
+    assert.Equal(t, false, strings.Contains(line, "slow"))
+  }
+  assert.Equal(t, "app.fast 1\n", wr.Lines[0])
+
+  // The slow command is still on its first run, and is killed on close.
+  sampler.mu.Lock()
+  assert.Equal(t, true, sampler.jobs[0].running)
+  sampler.mu.Unlock()
+  sampler.Close()
+  wr.Lines = wr.Lines[:0]
+  assert.NotEqual(t, nil, sampler.report())
+  assert.Equal(t, true, strings.HasPrefix(wr.Lines[0], "exec.status slow -1 "))
+}
@@ -0,0 +1,353 @@
+package app
+
+import (
+  "bytes"
+  "fmt"
+  "io"
+  "os"
+  "reflect"
+  "regexp"
+  "sort"
+  "strconv"
+  "syscall"
+  "time"
+  "../../util"
+)
+
+// Maximum bytes read from a log file per sample, so that a runaway log
+// can't stall sampling.
+const maxTailRead = 64 * 1024 * 1024
+
+// Configuration of a rule turning matching log lines into a metric.
+type LogRule struct {
+  // Metric name.
+  Name    string    `json:"name"`
+  // Regular expression selecting the lines this rule applies to.
+  Pattern string    `json:"pattern"`
+  // Upper bounds of histogram buckets. When set, the value captured by the
+  // pattern's group named "value" (or else its first group) is observed in
+  // a histogram; otherwise matching lines are counted.
+  Buckets []float64 `json:"buckets"`
+}
+
+// Configuration of a log file followed by the TailSampler.
+type LogFile struct {
+  Path  string    `json:"path"`
+  Rules []LogRule `json:"rules"`
+}
+
+// Running totals for a single rule.
+type logMetric struct {
+  rule    LogRule
+  re      *regexp.Regexp
+  group   int
+  count   uint64
+  last    uint64
+  sum     float64
+  buckets []uint64
+}
+
+// Observe a single log line.
+func (m *logMetric) observe(line []byte) {
+  match := m.re.FindSubmatch(line)
+  if match == nil {
+    return
+  }
+  if m.buckets == nil {
+    m.count++
+    return
+  }
+  v, err := strconv.ParseFloat(string(match[m.group]), 64)
+  if err != nil {
+    return
+  }
+  m.count++
+  m.sum += v
+  for i, bound := range m.rule.Buckets {
+    if v <= bound {
+      m.buckets[i]++
+    }
+  }
+}
+
+// State of a single followed log file.
+type logTail struct {
+  cfg     LogFile
+  path    string
+  metrics []*logMetric
+  file    *os.File
+  ino     uint64
+  offset  int64
+  partial []byte
+}
+
+// Sampler that follows log files and turns lines matching configured
+// regular expressions into metrics. Files are followed across rotation
+// (by rename or by truncation), and lines written before the agent started
+// are ignored.
+//
+// Counting rules produce "log.count" samples of the total matches and
+// matches per second since the previous sample. Histogram rules produce a
+// "log.histogram" sample of the observation count and sum, and a
+// "log.bucket" sample of the cumulative count for each bucket bound.
+type TailSampler struct {
+  sink  util.SampleWriter
+  tails []*logTail
+  last  time.Time
+}
+
+// Create a new log file tail sampler.
+func NewTailSampler(files []LogFile, s util.SampleWriter) (*TailSampler, error) {
+  tails, err := newLogTails(files)
+  if err != nil {
+    return nil, err
+  }
+  return &TailSampler{sink: s, tails: tails}, nil
+}
+
+// Compile the rules for each of the given log files.
+func newLogTails(files []LogFile) ([]*logTail, error) {
+  tails := make([]*logTail, 0, len(files))
+  for _, file := range files {
+    t := &logTail{cfg: file, path: file.Path, metrics: make([]*logMetric, 0)}
+    for _, rule := range file.Rules {
+      m, err := newLogMetric(rule)
+      if err != nil {
+        return nil, fmt.Errorf("%s: %s", file.Path, err)
+      }
+      t.metrics = append(t.metrics, m)
+    }
+    tails = append(tails, t)
+  }
+  return tails, nil
+}
+
+// Compile a log rule.
+func newLogMetric(rule LogRule) (*logMetric, error) {
+  re, err := regexp.Compile(rule.Pattern)
+  if err != nil {
+    return nil, fmt.Errorf("rule %s: %s", rule.Name, err)
+  }
+  m := &logMetric{rule: rule, re: re}
+  if len(rule.Buckets) == 0 {
+    return m, nil
+  }
+  if re.NumSubexp() == 0 {
+    return nil, fmt.Errorf("rule %s: histogram pattern needs a capture group", rule.Name)
+  }
+  m.group = 1
+  if idx := re.SubexpIndex("value"); idx > 0 {
+    m.group = idx
+  }
+  m.rule.Buckets = append([]float64{}, rule.Buckets...)
+  sort.Float64s(m.rule.Buckets)
+  m.buckets = make([]uint64, len(rule.Buckets))
+  return m, nil
+}
+
+// Initialize this sampler. Opens every log file that exists and skips to
+// its end.
+func (tail *TailSampler) Init() (err error) {
+  for _, t := range tail.tails {
+    if err = t.open(true); err != nil && !os.IsNotExist(err) {
+      return
+    }
+  }
+  tail.last = time.Now()
+  return nil
+}
+
+// Returns whether any log files are being followed.
+func (tail *TailSampler) Enabled() bool {
+  return len(tail.tails) > 0
+}
+
+// Switch to following the given log files. Files whose configuration is
+// unchanged carry on from where they were, keeping their metrics; other
+// files are followed from their end, as in Init().
+func (tail *TailSampler) Reconfigure(files []LogFile) (err error) {
+  tails, err := newLogTails(files)
+  if err != nil {
+    return
+  }
+  old := make(map[string]*logTail)
+  for _, t := range tail.tails {
+    old[t.path] = t
+  }
+  for i, t := range tails {
+    if prev, ok := old[t.path]; ok && reflect.DeepEqual(prev.cfg, t.cfg) {
+      tails[i] = prev
+      delete(old, t.path)
+      continue
+    }
+    // Files that can't be opened yet are retried on every sample.
+    t.open(true)
+  }
+  for _, t := range old {
+    t.close()
+  }
+  tail.tails = tails
+  return nil
+}
+
+// Stop following every log file.
+func (tail *TailSampler) Close() error {
+  for _, t := range tail.tails {
+    t.close()
+  }
+  return nil
+}
+
+// Read every line appended to the followed log files since the previous
+// sample, and write out the resulting metrics.
+func (tail *TailSampler) Sample() (err error) {
+  now := time.Now()
+  elapsed := now.Sub(tail.last).Seconds()
+  tail.last = now
+  for _, t := range tail.tails {
+    if rerr := t.read(); rerr != nil && err == nil {
+      err = fmt.Errorf("%s: %s", t.path, rerr)
+    }
+    for _, m := range t.metrics {
+      tail.report(m, elapsed)
+    }
+  }
+  return
+}
+
+// Write out the metrics for a single rule.
+func (tail *TailSampler) report(m *logMetric, elapsed float64) {
+  if m.buckets == nil {
+    var rate float64
+    if elapsed > 0 {
+      rate = float64(m.count - m.last) / elapsed
+    }
+    m.last = m.count
+    tail.sink.Write("log.count", m.rule.Name, m.count, rate)
+    return
+  }
+  tail.sink.Write("log.histogram", m.rule.Name, m.count, m.sum)
+  for i, bound := range m.rule.Buckets {
+    tail.sink.Write("log.bucket", m.rule.Name, bound, m.buckets[i])
+  }
+}
+
+// Open the log file, optionally skipping to its end.
+func (t *logTail) open(atEnd bool) (err error) {
+  f, err := os.Open(t.path)
+  if err != nil {
+    return
+  }
+  fi, err := f.Stat()
+  if err != nil {
+    f.Close()
+    return
+  }
+  t.file, t.ino, t.offset, t.partial = f, inode(fi), 0, nil
+  if atEnd {
+    t.offset, err = f.Seek(0, io.SeekEnd)
+  }
+  return
+}
+
+// Close the log file.
+func (t *logTail) close() {
+  if t.file != nil {
+    t.file.Close()
+    t.file = nil
+  }
+}
+
+// Process every line appended since the last read, following the log file
+// if it has been rotated or truncated.
+func (t *logTail) read() (err error) {
+  if t.file == nil {
+    // The file didn't exist before; anything in it now is new.
+    if err = t.open(false); os.IsNotExist(err) {
+      return nil
+    } else if err != nil {
+      return
+    }
+  }
+  fi, err := t.file.Stat()
+  if err != nil {
+    return
+  }
+  if fi.Size() < t.offset {
+    // Truncated in place (e.g. logrotate's copytruncate).
+    if t.offset, err = t.file.Seek(0, io.SeekStart); err != nil {
+      return
+    }
+    t.partial = nil
+  }
+  if err = t.drain(); err != nil {
+    return
+  }
+  cur, err := os.Stat(t.path)
+  if os.IsNotExist(err) {
+    // Rotated away with no replacement yet; keep the old file until one
+    // appears.
+    return nil
+  } else if err != nil {
+    return
+  }
+  if inode(cur) != t.ino {
+    // Rotated by rename; the old file has been drained, so start on the
+    // new one from its beginning.
+    t.close()
+    if err = t.open(false); err != nil {
+      return
+    }
+    return t.drain()
+  }
+  return nil
+}
+
+// Read and process complete lines up to the end of the open file. A line
+// without its trailing newline yet is held back until it's finished.
+func (t *logTail) drain() (err error) {
+  buf := make([]byte, 64 * 1024)
+  var read int64
+  for read < maxTailRead {
+    n, rerr := t.file.Read(buf)
+    if n > 0 {
+      read += int64(n)
+      t.offset += int64(n)
+      t.process(buf[:n])
+    }
+    if rerr == io.EOF {
+      break
+    } else if rerr != nil {
+      return rerr
+    }
+  }
+  return nil
+}
+
+// Split newly read data into lines and observe them.
+func (t *logTail) process(data []byte) {
+  for {
+    idx := bytes.IndexByte(data, '\n')
+    if idx < 0 {
+      t.partial = append(t.partial, data...)
+      return
+    }
+    line := data[:idx]
+    if len(t.partial) > 0 {
+      line = append(t.partial, line...)
+      t.partial = nil
+    }
+    for _, m := range t.metrics {
+      m.observe(line)
+    }
+    data = data[idx + 1:]
+  }
+}
+
+// Returns the inode number of the given file.
+func inode(fi os.FileInfo) uint64 {
+  if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+    return st.Ino
+  }
+  return 0
+}
@@ -0,0 +1,146 @@
+package app
+
+import (
+  "github.com/bmizerany/assert"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+)
+
+func appendLog(t *testing.T, path, data string) {
+  f, err := os.OpenFile(path, os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0644)
+  if err != nil {
+    t.Fatalf("could not open log: %s", err)
+  }
+  defer f.Close()
+  if _, err = f.WriteString(data); err != nil {
+    t.Fatalf("could not write log: %s", err)
+  }
+}
+
+func newTestTailSampler(t *testing.T, path string, rules ...LogRule) (*TailSampler, *BufferedSampleWriter) {
+  wr := NewBufferedSampleWriter()
+  sampler, err := NewTailSampler([]LogFile{{Path: path, Rules: rules}}, wr)
+  if err != nil {
+    t.Fatalf("NewTailSampler() failed: %s", err)
+  }
+  if err = sampler.Init(); err != nil {
+    t.Fatalf("Init() failed: %s", err)
+  }
+  return sampler, wr
+}
+
+func sampleCounts(t *testing.T, sampler *TailSampler, wr *BufferedSampleWriter) []string {
+  wr.Lines = wr.Lines[:0]
+  if err := sampler.Sample(); err != nil {
+    t.Fatalf("Sample() failed: %s", err)
+  }
+  counts := make([]string, len(wr.Lines))
+  for i, line := range wr.Lines {
+    // Drop the rate, which depends on timing.
+    fields := strings.Fields(line)
+    counts[i] = strings.Join(fields[:len(fields) - 1], " ")
+  }
+  return counts
+}
+
+func Test_TailSampler_should_count_only_new_matching_lines(t *testing.T) {
+  path := filepath.Join(t.TempDir(), "app.log")
+  appendLog(t, path, "ERROR before start\n")
+  sampler, wr := newTestTailSampler(t, path, LogRule{Name: "app.errors", Pattern: "ERROR"})
+  appendLog(t, path, "INFO ok\nERROR one\nERROR two\nERROR partial")
+  assert.Equal(t, []string{"log.count app.errors 2"}, sampleCounts(t, sampler, wr))
+  appendLog(t, path, " line\n")
+  assert.Equal(t, []string{"log.count app.errors 3"}, sampleCounts(t, sampler, wr))
+}
+
+func Test_TailSampler_should_follow_renamed_logs(t *testing.T) {
+  dir := t.TempDir()
+  path := filepath.Join(dir, "app.log")
+  appendLog(t, path, "")
+  sampler, wr := newTestTailSampler(t, path, LogRule{Name: "app.errors", Pattern: "ERROR"})
+  appendLog(t, path, "ERROR one\n")
+  if err := os.Rename(path, path + ".1"); err != nil {
+    t.Fatal(err)
+  }
+  appendLog(t, path + ".1", "ERROR late write to old file\n")
+  assert.Equal(t, []string{"log.count app.errors 2"}, sampleCounts(t, sampler, wr))
+  appendLog(t, path, "ERROR new file\n")
+  appendLog(t, path + ".1", "ERROR drained before switching\n")
+  assert.Equal(t, []string{"log.count app.errors 4"}, sampleCounts(t, sampler, wr))
+  appendLog(t, path + ".1", "ERROR after switching\n")
+  assert.Equal(t, []string{"log.count app.errors 4"}, sampleCounts(t, sampler, wr))
+}
+
+func Test_TailSampler_should_follow_truncated_logs(t *testing.T) {
+  path := filepath.Join(t.TempDir(), "app.log")
+  sampler, wr := newTestTailSampler(t, path, LogRule{Name: "app.errors", Pattern: "ERROR"})
+  appendLog(t, path, "ERROR created after start\nINFO padding padding padding\n")
+  assert.Equal(t, []string{"log.count app.errors 1"}, sampleCounts(t, sampler, wr))
+  if err := os.Truncate(path, 0); err != nil {
+    t.Fatal(err)
+  }
+  appendLog(t, path, "ERROR x\n")
+  assert.Equal(t, []string{"log.count app.errors 2"}, sampleCounts(t, sampler, wr))
+}
+
+func Test_TailSampler_should_observe_captured_values_in_histograms(t *testing.T) {
+  path := filepath.Join(t.TempDir(), "access.log")
+  appendLog(t, path, "")
+  sampler, wr := newTestTailSampler(t, path, LogRule{
+    Name: "http.latency",
+    Pattern: `status=(\d+) time=(?P<value>[0-9.]+)`,
+    Buckets: []float64{0.5, 0.1},
+  })
+  appendLog(t, path, "GET / status=200 time=0.05\nGET /a status=200 time=0.3\nGET /b status=500 time=2\n")
+  if err := sampler.Sample(); err != nil {
+    t.Fatalf("Sample() failed: %s", err)
+  }
+  assert.Equal(t, []string{
+    "log.histogram http.latency 3 2.35\n",
+    "log.bucket http.latency 0.1 1\n",
+    "log.bucket http.latency 0.5 2\n",
+  }, wr.Lines)
+}
+
+func Test_TailSampler_should_reject_histograms_without_a_capture_group(t *testing.T) {
+  _, err := NewTailSampler([]LogFile{{Path: "x.log", Rules: []LogRule{
+    {Name: "bad", Pattern: "time=", Buckets: []float64{1}},
+  }}}, NewBufferedSampleWriter())
+  if err == nil || !strings.Contains(err.Error(), "needs a capture group") {
+    t.Fatalf("expected error, got %v", err)
+  }
+}
+
+func Test_TailSampler_should_keep_state_of_unchanged_files_on_reconfigure(t *testing.T) {
+  dir := t.TempDir()
+  app := filepath.Join(dir, "app.log")
+  db := filepath.Join(dir, "db.log")
+  appendLog(t, db, "ERROR before reconfigure\n")
+  errors := LogRule{Name: "app.errors", Pattern: "ERROR"}
+  sampler, wr := newTestTailSampler(t, app, errors)
+  appendLog(t, app, "ERROR one\nERROR partial")
+  assert.Equal(t, []string{"log.count app.errors 1"}, sampleCounts(t, sampler, wr))
+
+  err := sampler.Reconfigure([]LogFile{
+    {Path: app, Rules: []LogRule{errors}},
+    {Path: db, Rules: []LogRule{{Name: "db.errors", Pattern: "ERROR"}}},
+  })
+  if err != nil {
+    t.Fatalf("Reconfigure() failed: %s", err)
+  }
+  appendLog(t, app, " line\n")
+  appendLog(t, db, "ERROR after reconfigure\n")
+  assert.Equal(t, []string{
+    "log.count app.errors 2",
+    "log.count db.errors 1",
+  }, sampleCounts(t, sampler, wr))
+
+  err = sampler.Reconfigure([]LogFile{{Path: db, Rules: []LogRule{
+    {Name: "db.slow", Pattern: "time=(", Buckets: []float64{1}},
+  }}})
+  assert.NotEqual(t, nil, err)
+  assert.Equal(t, 2, len(sampleCounts(t, sampler, wr)))
+  sampler.Close()
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+  "encoding/json"
+  "os"
+  "./app"
+  "../util"
+)
+
+// Agent configuration, read from the JSON file given with -f.
+type Config struct {
+  // External commands to run as samplers.
+  Exec []app.ExecCommand `json:"exec"`
+  // Log files to follow, and the metrics to derive from their lines.
+  Tail []app.LogFile     `json:"tail"`
+  // Tags merged into every sample, e.g. the host's environment and role.
+  // These override tags of the same name discovered from the host.
+  Tags util.Tags         `json:"tags"`
+  // File of KEY=VALUE lines giving further tags, e.g. as written out by
+  // provisioning. These override discovered tags, but not those above.
+  TagsFile string        `json:"tags_file"`
+  // Tags merged into the samples of particular samplers, by sampler name
+  // (e.g. "exec", "cgroup"), overriding the tags above.
+  SamplerTags map[string]util.Tags `json:"sampler_tags"`
+}
+
+// Load the agent configuration from the given file.
+func loadConfig(path string) (*Config, error) {
+  f, err := os.Open(path)
+  if err != nil {
+    return nil, err
+  }
+  defer f.Close()
+  cfg := &Config{}
+  dec := json.NewDecoder(f)
+  dec.DisallowUnknownFields()
+  if err = dec.Decode(cfg); err != nil {
+    return nil, err
+  }
+  return cfg, nil
+}
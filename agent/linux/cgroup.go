@@ -0,0 +1,225 @@
+package linux
+
+import (
+  "bufio"
+  "io"
+  "os"
+  "path"
+  "strconv"
+  "strings"
+  "../../util"
+)
+
+// Sampler for per-cgroup resource usage on hosts using the cgroup v2
+// unified hierarchy. Each sample is tagged with the path of its cgroup
+// relative to the hierarchy root (e.g. "/system.slice/sshd.service").
+type CgroupSampler struct {
+  opener   util.DirOpener
+  sink     util.SampleWriter
+  root     string
+  enabled  bool
+  // Number of levels below the root cgroup to descend; negative for no
+  // limit.
+  MaxDepth int
+  // Glob patterns (as understood by path.Match) selecting which cgroups
+  // to report on; all cgroups are reported when empty.
+  Paths    []string
+}
+
+// Create a new cgroup v2 sampler.
+func NewCgroupSampler(o util.DirOpener, s util.SampleWriter) *CgroupSampler {
+  return &CgroupSampler{opener: o, sink: s, MaxDepth: -1}
+}
+
+// Initialize this sampler. Locates the unified hierarchy, either mounted at
+// /sys/fs/cgroup or, on hybrid hosts, at /sys/fs/cgroup/unified. If no
+// unified hierarchy is found, this sampler is disabled rather than failing.
+func (cg *CgroupSampler) Init() (err error) {
+  cg.enabled = false
+  for _, root := range []string{"/sys/fs/cgroup", "/sys/fs/cgroup/unified"} {
+    f, err := cg.opener.Open(root + "/cgroup.controllers")
+    if err != nil {
+      continue
+    }
+    f.Close()
+    cg.root = root
+    cg.enabled = true
+    break
+  }
+  return nil
+}
+
+// Whether a cgroup v2 hierarchy was found on this host by Init().
+func (cg *CgroupSampler) Enabled() bool {
+  return cg.enabled
+}
+
+// Gather current resource usage for every selected cgroup.
+func (cg *CgroupSampler) Sample() (err error) {
+  if !cg.enabled {
+    return
+  }
+  return cg.walk("/", 0)
+}
+
+// Report on the given cgroup, then descend into its children.
+func (cg *CgroupSampler) walk(group string, depth int) (err error) {
+  dir := cg.root + strings.TrimSuffix(group, "/")
+  if cg.selected(group) {
+    if err = cg.sampleGroup(dir, group); err != nil {
+      return
+    }
+  }
+  if cg.MaxDepth >= 0 && depth >= cg.MaxDepth {
+    return
+  }
+  entries, err := cg.opener.ReadDir(dir)
+  if os.IsNotExist(err) {
+    // cgroup was removed while walking the hierarchy.
+    return nil
+  } else if err != nil {
+    return
+  }
+  for _, entry := range entries {
+    if !entry.IsDir() {
+      continue
+    }
+    if err = cg.walk(path.Join(group, entry.Name()), depth + 1); err != nil {
+      return
+    }
+  }
+  return
+}
+
+// Whether the given cgroup is selected by this sampler's path filters.
+func (cg *CgroupSampler) selected(group string) bool {
+  if len(cg.Paths) == 0 {
+    return true
+  }
+  for _, pattern := range cg.Paths {
+    if ok, _ := path.Match(pattern, group); ok {
+      return true
+    }
+  }
+  return false
+}
+
+// Gather resource usage for a single cgroup. Controller files that don't
+// exist (e.g. memory.current in the root cgroup, or controllers not enabled
+// in the parent's cgroup.subtree_control) are skipped.
+func (cg *CgroupSampler) sampleGroup(dir, group string) (err error) {
+  cpu, err := readKeyValues(cg.opener, dir + "/cpu.stat")
+  if err == nil {
+    cg.sink.Write("cgroup.cpu",
+                  group,
+                  cpu["usage_usec"],
+                  cpu["user_usec"],
+                  cpu["system_usec"],
+                  cpu["nr_periods"],
+                  cpu["nr_throttled"],
+                  cpu["throttled_usec"])
+  } else if !os.IsNotExist(err) {
+    return
+  }
+
+  current, err := readUint(cg.opener, dir + "/memory.current")
+  if err == nil {
+    var limit uint64
+    var events map[string]uint64
+    if limit, err = cg.readLimit(dir + "/memory.max"); err != nil {
+      return
+    }
+    events, err = readKeyValues(cg.opener, dir + "/memory.events")
+    if err != nil && !os.IsNotExist(err) {
+      return
+    }
+    cg.sink.Write("cgroup.memory",
+                  group,
+                  current,
+                  limit,
+                  events["high"],
+                  events["max"],
+                  events["oom"],
+                  events["oom_kill"])
+  } else if !os.IsNotExist(err) {
+    return
+  }
+
+  if err = cg.sampleIO(dir, group); err != nil && !os.IsNotExist(err) {
+    return
+  }
+
+  pids, err := readUint(cg.opener, dir + "/pids.current")
+  if err == nil {
+    cg.sink.Write("cgroup.pids", group, pids)
+  } else if !os.IsNotExist(err) {
+    return
+  }
+  return nil
+}
+
+// Read a cgroup limit file such as memory.max, where "max" means no limit.
+// No limit is reported as zero.
+func (cg *CgroupSampler) readLimit(file string) (uint64, error) {
+  raw, err := readValue(cg.opener, file)
+  if os.IsNotExist(err) || raw == "max" {
+    return 0, nil
+  } else if err != nil {
+    return 0, err
+  }
+  return strconv.ParseUint(raw, 10, 64)
+}
+
+// Gather per-device I/O statistics from a cgroup's io.stat.
+func (cg *CgroupSampler) sampleIO(dir, group string) (err error) {
+  f, err := cg.opener.Open(dir + "/io.stat")
+  if err != nil {
+    return
+  }
+  defer f.Close()
+  rd := bufio.NewReader(f)
+  for {
+    var line string
+
+    line, err = rd.ReadString('\n')
+    if err == io.EOF {
+      err = nil
+      break
+    } else if err != nil {
+      return
+    }
+    if err = cg.parseIOLine(group, line); err != nil {
+      return
+    }
+  }
+  return
+}
+
+// Parse an individual line from a cgroup's io.stat, which looks like:
+// 8:0 rbytes=90430464 wbytes=299008000 rios=8950 wios=12252 dbytes=0 dios=0
+func (cg *CgroupSampler) parseIOLine(group, line string) (err error) {
+  parts := strings.Fields(line)
+  if len(parts) < 2 {
+    return
+  }
+  stats := make(map[string]uint64)
+  for _, part := range parts[1:] {
+    kv := strings.SplitN(part, "=", 2)
+    if len(kv) != 2 {
+      continue
+    }
+    if stats[kv[0]], err = strconv.ParseUint(kv[1], 10, 64); err != nil {
+      return
+    }
+  }
+  cg.sink.Write("cgroup.io",
+                group,
+                parts[0],
+                stats["rbytes"],
+                stats["wbytes"],
+                stats["rios"],
+                stats["wios"],
+                stats["dbytes"],
+                stats["dios"])
+  return
+}
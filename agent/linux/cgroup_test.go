@@ -0,0 +1,115 @@
+package linux
+
+import (
+  "github.com/bmizerany/assert"
+  "testing"
+  "../../util"
+)
+
+func newCgroupTestOpener() *util.FakeFS {
+  return util.NewFakeFS(map[string]string{
+    "/sys/fs/cgroup/cgroup.controllers": "cpuset cpu io memory pids\n",
+    "/sys/fs/cgroup/cpu.stat":
+`usage_usec 932871233
+user_usec 611503926
+system_usec 321367307
+`,
+    "/sys/fs/cgroup/io.stat":
+`8:0 rbytes=90430464 wbytes=299008000 rios=8950 wios=12252 dbytes=0 dios=0
+`,
+    "/sys/fs/cgroup/system.slice/cpu.stat":
+`usage_usec 50231
+user_usec 30100
+system_usec 20131
+nr_periods 0
+nr_throttled 0
+throttled_usec 0
+`,
+    "/sys/fs/cgroup/system.slice/memory.current": "734003200\n",
+    "/sys/fs/cgroup/system.slice/memory.max": "max\n",
+    "/sys/fs/cgroup/system.slice/pids.current": "211\n",
+    "/sys/fs/cgroup/system.slice/nginx.service/cpu.stat":
+`usage_usec 8812
+user_usec 5100
+system_usec 3712
+nr_periods 1200
+nr_throttled 37
+throttled_usec 912000
+`,
+    "/sys/fs/cgroup/system.slice/nginx.service/memory.current": "104857600\n",
+    "/sys/fs/cgroup/system.slice/nginx.service/memory.max": "268435456\n",
+    "/sys/fs/cgroup/system.slice/nginx.service/memory.events":
+`low 0
+high 0
+max 12
+oom 2
+oom_kill 1
+`,
+    "/sys/fs/cgroup/system.slice/nginx.service/io.stat":
+`8:0 rbytes=4096 wbytes=81920 rios=1 wios=20 dbytes=0 dios=0
+`,
+    "/sys/fs/cgroup/system.slice/nginx.service/pids.current": "5\n",
+  })
+}
+
+func Test_CgroupSampler_should_be_disabled_without_unified_hierarchy(t *testing.T) {
+  wr := NewBufferedSampleWriter()
+  sampler := NewCgroupSampler(util.NewFakeFS(map[string]string{}), wr)
+  if err := sampler.Init(); err != nil {
+    t.Fatalf("Init() failed: %s", err)
+  }
+  assert.Equal(t, false, sampler.Enabled())
+}
+
+func Test_CgroupSampler_should_walk_hierarchy_and_tag_with_path(t *testing.T) {
+  wr := NewBufferedSampleWriter()
+  sampler := NewCgroupSampler(newCgroupTestOpener(), wr)
+  if err := sampler.Init(); err != nil {
+    t.Fatalf("Init() failed: %s", err)
+  }
+  if err := sampler.Sample(); err != nil {
+    t.Fatalf("Sample() failed: %s", err)
+  }
+  assert.Equal(t, 9, len(wr.Lines))
+  assert.Equal(t, "cgroup.cpu / 932871233 611503926 321367307 0 0 0\n", wr.Lines[0])
+  assert.Equal(t, "cgroup.io / 8:0 90430464 299008000 8950 12252 0 0\n", wr.Lines[1])
+  assert.Equal(t, "cgroup.memory /system.slice 734003200 0 0 0 0 0\n", wr.Lines[3])
+  assert.Equal(t, "cgroup.pids /system.slice 211\n", wr.Lines[4])
+  assert.Equal(
+    t,
+    "cgroup.cpu /system.slice/nginx.service 8812 5100 3712 1200 37 912000\n",
+    wr.Lines[5])
+  assert.Equal(
+    t,
+    "cgroup.memory /system.slice/nginx.service 104857600 268435456 0 12 2 1\n",
+    wr.Lines[6])
+  assert.Equal(
+    t,
+    "cgroup.io /system.slice/nginx.service 8:0 4096 81920 1 20 0 0\n",
+    wr.Lines[7])
+}
+
+func Test_CgroupSampler_should_apply_depth_and_path_filters(t *testing.T) {
+  wr := NewBufferedSampleWriter()
+  sampler := NewCgroupSampler(newCgroupTestOpener(), wr)
+  sampler.MaxDepth = 1
+  if err := sampler.Init(); err != nil {
+    t.Fatalf("Init() failed: %s", err)
+  }
+  if err := sampler.Sample(); err != nil {
+    t.Fatalf("Sample() failed: %s", err)
+  }
+  assert.Equal(t, 5, len(wr.Lines))
+
+  wr = NewBufferedSampleWriter()
+  sampler = NewCgroupSampler(newCgroupTestOpener(), wr)
+  sampler.Paths = []string{"/system.slice/*"}
+  if err := sampler.Init(); err != nil {
+    t.Fatalf("Init() failed: %s", err)
+  }
+  if err := sampler.Sample(); err != nil {
+    t.Fatalf("Sample() failed: %s", err)
+  }
+  assert.Equal(t, 4, len(wr.Lines))
+  assert.Equal(t, "cgroup.pids /system.slice/nginx.service 5\n", wr.Lines[3])
+}
@@ -0,0 +1,149 @@
+package linux
+
+import (
+  "os"
+  "strconv"
+  "strings"
+  "../../util"
+)
+
+// Placement of a logical CPU within the machine: the physical package
+// (socket) it sits in, its core within that package and its hardware thread
+// within that core.
+type CPUTopology struct {
+  Package int64
+  Core    int64
+  Thread  int64
+}
+
+// Sampler for per-CPU frequency scaling and thermal throttling statistics
+// from /sys/devices/system/cpu. Each sample is tagged with the CPU's index
+// and its package, core and thread. Frequencies are reported in MHz.
+type CPUFreqSampler struct {
+  opener util.DirOpener
+  sink   util.SampleWriter
+}
+
+// Create a new CPU frequency sampler.
+func NewCPUFreqSampler(o util.DirOpener, s util.SampleWriter) *CPUFreqSampler {
+  return &CPUFreqSampler{opener: o, sink: s}
+}
+
+// Initialize this sampler.
+func (freq *CPUFreqSampler) Init() (err error) {
+  return
+}
+
+// Gather current frequency and throttling statistics for every online CPU.
+func (freq *CPUFreqSampler) Sample() (err error) {
+  cpus, err := freq.opener.ReadDir("/sys/devices/system/cpu")
+  if os.IsNotExist(err) {
+    return nil
+  } else if err != nil {
+    return
+  }
+  for _, cpu := range cpus {
+    name := cpu.Name()
+    if !strings.HasPrefix(name, "cpu") {
+      continue
+    }
+    idx := name[3:]
+    if _, err := strconv.ParseUint(idx, 10, 32); err != nil {
+      continue
+    }
+    dir := "/sys/devices/system/cpu/" + name
+    topo, err := readCPUTopology(freq.opener, idx)
+    if err != nil {
+      // Offline CPUs have no topology directory.
+      continue
+    }
+    freq.sampleFreq(dir, idx, topo)
+    freq.sampleThrottle(dir, idx, topo)
+  }
+  return nil
+}
+
+// Read the topology of the CPU with the given index from sysfs. Fails for
+// offline CPUs, which have no topology directory.
+func readCPUTopology(o util.Opener, idx string) (topo CPUTopology, err error) {
+  dir := "/sys/devices/system/cpu/cpu" + idx + "/topology"
+  if topo.Package, err = readInt(o, dir + "/physical_package_id"); err != nil {
+    return
+  }
+  if topo.Core, err = readInt(o, dir + "/core_id"); err != nil {
+    return
+  }
+  // The thread index is this CPU's position among its core's siblings.
+  siblings, err := readValue(o, dir + "/thread_siblings_list")
+  if err != nil {
+    return topo, nil
+  }
+  cpu, _ := strconv.ParseInt(idx, 10, 64)
+  for i, sibling := range parseCPUList(siblings) {
+    if sibling == cpu {
+      topo.Thread = int64(i)
+      break
+    }
+  }
+  return topo, nil
+}
+
+// Report the current, minimum and maximum scaling frequencies of a CPU.
+// CPUs without a cpufreq driver are skipped.
+func (freq *CPUFreqSampler) sampleFreq(dir, idx string, topo CPUTopology) {
+  cur, err := readUint(freq.opener, dir + "/cpufreq/scaling_cur_freq")
+  if err != nil {
+    if cur, err = readUint(freq.opener, dir + "/cpufreq/cpuinfo_cur_freq"); err != nil {
+      return
+    }
+  }
+  lo, _ := readUint(freq.opener, dir + "/cpufreq/scaling_min_freq")
+  hi, _ := readUint(freq.opener, dir + "/cpufreq/scaling_max_freq")
+  freq.sink.Write("cpu.freq",
+                  idx,
+                  topo.Package,
+                  topo.Core,
+                  topo.Thread,
+                  float64(cur) / 1000,
+                  float64(lo) / 1000,
+                  float64(hi) / 1000)
+}
+
+// Report the core and package thermal throttle event counts of a CPU.
+// Only available on x86 CPUs with thermal monitoring support.
+func (freq *CPUFreqSampler) sampleThrottle(dir, idx string, topo CPUTopology) {
+  core, err := readUint(freq.opener, dir + "/thermal_throttle/core_throttle_count")
+  if err != nil {
+    return
+  }
+  pkg, _ := readUint(freq.opener, dir + "/thermal_throttle/package_throttle_count")
+  freq.sink.Write("cpu.throttle",
+                  idx,
+                  topo.Package,
+                  topo.Core,
+                  topo.Thread,
+                  core,
+                  pkg)
+}
+
+// Parse a kernel CPU list such as "0-3,8,10-11" into CPU indexes.
+func parseCPUList(list string) []int64 {
+  rv := make([]int64, 0)
+  for _, part := range strings.Split(list, ",") {
+    bounds := strings.SplitN(strings.TrimSpace(part), "-", 2)
+    lo, err := strconv.ParseInt(bounds[0], 10, 64)
+    if err != nil {
+      continue
+    }
+    hi := lo
+    if len(bounds) == 2 {
+      if hi, err = strconv.ParseInt(bounds[1], 10, 64); err != nil {
+        continue
+      }
+    }
+    for i := lo; i <= hi; i++ {
+      rv = append(rv, i)
+    }
+  }
+  return rv
+}
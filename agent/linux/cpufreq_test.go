@@ -0,0 +1,42 @@
+package linux
+
+import (
+  "github.com/bmizerany/assert"
+  "testing"
+  "../../util"
+)
+
+func Test_CPUFreqSampler_should_report_frequency_and_throttling_with_topology(t *testing.T) {
+  wr := NewBufferedSampleWriter()
+  opener := util.NewFakeFS(map[string]string{
+    "/sys/devices/system/cpu/online": "0-1\n",
+    "/sys/devices/system/cpu/cpufreq/boost": "1\n",
+    "/sys/devices/system/cpu/cpu0/topology/physical_package_id": "0\n",
+    "/sys/devices/system/cpu/cpu0/topology/core_id": "0\n",
+    "/sys/devices/system/cpu/cpu0/topology/thread_siblings_list": "0-1\n",
+    "/sys/devices/system/cpu/cpu0/cpufreq/scaling_cur_freq": "2394512\n",
+    "/sys/devices/system/cpu/cpu0/cpufreq/scaling_min_freq": "800000\n",
+    "/sys/devices/system/cpu/cpu0/cpufreq/scaling_max_freq": "3600000\n",
+    "/sys/devices/system/cpu/cpu0/thermal_throttle/core_throttle_count": "12\n",
+    "/sys/devices/system/cpu/cpu0/thermal_throttle/package_throttle_count": "40\n",
+    "/sys/devices/system/cpu/cpu1/topology/physical_package_id": "0\n",
+    "/sys/devices/system/cpu/cpu1/topology/core_id": "0\n",
+    "/sys/devices/system/cpu/cpu1/topology/thread_siblings_list": "0-1\n",
+    "/sys/devices/system/cpu/cpu1/cpufreq/scaling_cur_freq": "800000\n",
+    "/sys/devices/system/cpu/cpu1/cpufreq/scaling_min_freq": "800000\n",
+    "/sys/devices/system/cpu/cpu1/cpufreq/scaling_max_freq": "3600000\n",
+    "/sys/devices/system/cpu/cpu2/online": "0\n",
+  })
+  sampler := NewCPUFreqSampler(opener, wr)
+  if err := sampler.Sample(); err != nil {
+    t.Fatalf("Sample() failed: %s", err)
+  }
+  assert.Equal(t, 3, len(wr.Lines))
+  assert.Equal(t, "cpu.freq 0 0 0 0 2394.512 800 3600\n", wr.Lines[0])
+  assert.Equal(t, "cpu.throttle 0 0 0 0 12 40\n", wr.Lines[1])
+  assert.Equal(t, "cpu.freq 1 0 0 1 800 800 3600\n", wr.Lines[2])
+}
+
+func Test_parseCPUList_should_expand_ranges(t *testing.T) {
+  assert.Equal(t, []int64{0, 1, 2, 3, 8, 10, 11}, parseCPUList("0-3,8,10-11"))
+}
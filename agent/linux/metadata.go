@@ -1,29 +1,68 @@
 package linux
 
 import (
-//  "fmt"
-//  "os"
+  "encoding/json"
+  "io/ioutil"
   "net"
+  "os"
   "strings"
-//  "../../util"
+  "../../util"
 )
 
-// func Metadata() ([]*util.Metadata, error) {
-//   host, err := os.Hostname()
-//   if err != nil {
-//     return nil, err
-//   }
-//   ips, err := ipv4ForInterfaces()
-//   if err != nil {
-//     return nil, err
-//   }
-//   m := make([]*util.Metadata, 0)
-//   m = append(m, util.NewMetadata("host", host))
-//   for ifname, ip := range ips {
-//     m = append(m, util.NewMetadata(fmt.Sprintf("nic.%s", ifname), ip.String()))
-//   }
-//   return m, nil
-// }
+// Location of the instance metadata cloud-init writes out at boot.
+const cloudInitData = "/run/cloud-init/instance-data.json"
+
+// Instance metadata keys written by cloud-init, and the tags they're
+// reported as.
+var cloudInitTags = map[string]string{
+  "cloud_name": "cloud",
+  "region": "region",
+  "availability_zone": "zone",
+  "instance_id": "instance_id",
+}
+
+// Returns the name of the host, from /etc/hostname where possible so that
+// a containerized agent reports the name of the host it's monitoring.
+func Hostname(o util.Opener) (string, error) {
+  if name, err := readValue(o, "/etc/hostname"); err == nil && name != "" {
+    return name, nil
+  }
+  return os.Hostname()
+}
+
+// Discover tags describing the host: its hostname, and where cloud-init
+// has left instance metadata on disk, the cloud, region, zone and
+// instance it's running in.
+func HostTags(o util.Opener) (util.Tags, error) {
+  host, err := Hostname(o)
+  if err != nil {
+    return nil, err
+  }
+  tags := util.Tags{"hostname": host}
+  r, err := o.Open(cloudInitData)
+  if os.IsNotExist(err) {
+    return tags, nil
+  } else if err != nil {
+    return nil, err
+  }
+  defer r.Close()
+  raw, err := ioutil.ReadAll(r)
+  if err != nil {
+    return nil, err
+  }
+  var data struct {
+    V1 map[string]interface{} `json:"v1"`
+  }
+  if err = json.Unmarshal(raw, &data); err != nil {
+    return nil, err
+  }
+  for key, tag := range cloudInitTags {
+    if v, ok := data.V1[key].(string); ok && v != "" {
+      tags[tag] = v
+    }
+  }
+  return tags, nil
+}
 
 func ipv4ForInterfaces() (map[string]net.IP, error) {
   rv := make(map[string]net.IP)
@@ -0,0 +1,42 @@
+package linux
+
+import (
+  "github.com/bmizerany/assert"
+  "testing"
+  "../../util"
+)
+
+func Test_HostTags_should_include_cloud_init_metadata(t *testing.T) {
+  fs := util.NewFakeFS(map[string]string{
+    "/etc/hostname": "web1.example.com\n",
+    "/run/cloud-init/instance-data.json": `{
+  "v1": {
+    "cloud_name": "aws",
+    "region": "us-east-1",
+    "availability_zone": "us-east-1a",
+    "instance_id": "i-0123456789",
+    "local_hostname": "ip-10-0-0-1"
+  }
+}`,
+  })
+  tags, err := HostTags(fs)
+  if err != nil {
+    t.Fatalf("HostTags() failed: %s", err)
+  }
+  assert.Equal(t, util.Tags{
+    "hostname": "web1.example.com",
+    "cloud": "aws",
+    "region": "us-east-1",
+    "zone": "us-east-1a",
+    "instance_id": "i-0123456789",
+  }, tags)
+}
+
+func Test_HostTags_should_cope_without_cloud_init(t *testing.T) {
+  fs := util.NewFakeFS(map[string]string{"/etc/hostname": "db1\n"})
+  tags, err := HostTags(fs)
+  if err != nil {
+    t.Fatalf("HostTags() failed: %s", err)
+  }
+  assert.Equal(t, util.Tags{"hostname": "db1"}, tags)
+}
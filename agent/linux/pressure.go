@@ -0,0 +1,119 @@
+package linux
+
+import (
+  "bufio"
+  "fmt"
+  "io"
+  "time"
+  "../../util"
+)
+
+// Resources for which the kernel reports pressure stall information.
+var pressureResources = []string{"cpu", "memory", "io"}
+
+// Sampler for pressure stall information (PSI), available on kernels 4.20
+// and later built with CONFIG_PSI and not booted with psi=0.
+type PressureSampler struct {
+  opener  util.Opener
+  sink    util.SampleWriter
+  enabled bool
+  last    time.Time
+  totals  map[string]uint64
+}
+
+// Create a new pressure stall information sampler.
+func NewPressureSampler(o util.Opener, s util.SampleWriter) *PressureSampler {
+  return &PressureSampler{
+    opener: o,
+    sink: s,
+    totals: make(map[string]uint64),
+  }
+}
+
+// Initialize this sampler. Detects whether PSI is available on this host;
+// if it isn't, this sampler is disabled rather than failing.
+func (psi *PressureSampler) Init() (err error) {
+  f, err := psi.opener.Open("/proc/pressure/cpu")
+  if err != nil {
+    psi.enabled = false
+    return nil
+  }
+  defer f.Close()
+  // With psi=0 the files exist but reading them fails with EOPNOTSUPP.
+  var buf [1]byte
+  _, err = f.Read(buf[:])
+  psi.enabled = err == nil || err == io.EOF
+  return nil
+}
+
+// Whether pressure stall information was found on this host by Init().
+func (psi *PressureSampler) Enabled() bool {
+  return psi.enabled
+}
+
+// Gather current pressure stall information. The stall-time rate is the
+// percentage of wall-clock time stalled since the previous sample and is
+// zero on the first sample. Time is measured by the opener if it's a
+// util.Clock.
+func (psi *PressureSampler) Sample() (err error) {
+  if !psi.enabled {
+    return
+  }
+  now := util.Now(psi.opener)
+  elapsed := now.Sub(psi.last)
+  for _, resource := range pressureResources {
+    if err = psi.readFile(resource, elapsed); err != nil {
+      return
+    }
+  }
+  psi.last = now
+  return
+}
+
+// Read the pressure file for the given resource.
+func (psi *PressureSampler) readFile(resource string, elapsed time.Duration) (err error) {
+  f, err := psi.opener.Open("/proc/pressure/" + resource)
+  if err != nil {
+    return
+  }
+  defer f.Close()
+  rd := bufio.NewReader(f)
+  for {
+    var line string
+
+    line, err = rd.ReadString('\n')
+    if err == io.EOF {
+      err = nil
+      break
+    } else if err != nil {
+      return
+    }
+    if err = psi.parseLine(resource, line, elapsed); err != nil {
+      return
+    }
+  }
+  return
+}
+
+// Parse an individual line from Linux's /proc/pressure/{cpu,memory,io}.
+func (psi *PressureSampler) parseLine(resource, line string, elapsed time.Duration) (err error) {
+  var kind string
+  var avg10, avg60, avg300 float64
+  var total uint64
+
+  _, err = fmt.Sscanf(line,
+                      "%s avg10=%f avg60=%f avg300=%f total=%d",
+                      &kind, &avg10, &avg60, &avg300, &total)
+  if err != nil {
+    return
+  }
+  key := resource + "." + kind
+  var rate float64
+  if prev, ok := psi.totals[key]; ok && elapsed > 0 && total >= prev {
+    stalled := time.Duration(total - prev) * time.Microsecond
+    rate = 100 * stalled.Seconds() / elapsed.Seconds()
+  }
+  psi.totals[key] = total
+  psi.sink.Write("pressure", resource, kind, avg10, avg60, avg300, rate)
+  return
+}
@@ -0,0 +1,71 @@
+package linux
+
+import (
+  "github.com/bmizerany/assert"
+  "testing"
+  "time"
+  "../../util"
+)
+
+var (
+  procPressureCPUOutput =
+`some avg10=1.53 avg60=0.87 avg300=0.32 total=4816143
+full avg10=0.00 avg60=0.00 avg300=0.00 total=0
+`
+  procPressureMemoryOutput =
+`some avg10=0.00 avg60=0.12 avg300=0.05 total=220115
+full avg10=0.00 avg60=0.04 avg300=0.01 total=96037
+`
+  procPressureIOOutput =
+`some avg10=4.20 avg60=2.10 avg300=1.01 total=91234467
+full avg10=3.80 avg60=1.95 avg300=0.93 total=80011204
+`
+)
+
+func Test_PressureSampler_should_be_disabled_without_psi(t *testing.T) {
+  wr := NewBufferedSampleWriter()
+  sampler := NewPressureSampler(util.NewFakeFS(map[string]string{}), wr)
+  if err := sampler.Init(); err != nil {
+    t.Fatalf("Init() failed: %s", err)
+  }
+  assert.Equal(t, false, sampler.Enabled())
+  if err := sampler.Sample(); err != nil {
+    t.Fatalf("Sample() failed: %s", err)
+  }
+  assert.Equal(t, 0, len(wr.Lines))
+}
+
+func Test_PressureSampler_should_report_averages_and_stall_rates(t *testing.T) {
+  wr := NewBufferedSampleWriter()
+  opener := util.NewFakeFS(map[string]string{
+    "/proc/pressure/cpu": procPressureCPUOutput,
+    "/proc/pressure/memory": procPressureMemoryOutput,
+    "/proc/pressure/io": procPressureIOOutput,
+  })
+  sampler := NewPressureSampler(opener, wr)
+  opener.SetNow(time.Unix(1355344417, 0))
+  if err := sampler.Init(); err != nil {
+    t.Fatalf("Init() failed: %s", err)
+  }
+  assert.Equal(t, true, sampler.Enabled())
+  if err := sampler.Sample(); err != nil {
+    t.Fatalf("Sample() failed: %s", err)
+  }
+  assert.Equal(t, 6, len(wr.Lines))
+  assert.Equal(t, "pressure cpu some 1.53 0.87 0.32 0\n", wr.Lines[0])
+  assert.Equal(t, "pressure io full 3.8 1.95 0.93 0\n", wr.Lines[5])
+
+  // 2.5s of io stall in a 10s interval is a 25% stall rate.
+  opener.SetNow(time.Unix(1355344427, 0))
+  opener.SetFile("/proc/pressure/io",
+`some avg10=4.20 avg60=2.10 avg300=1.01 total=93734467
+full avg10=3.80 avg60=1.95 avg300=0.93 total=81011204
+`)
+  if err := sampler.Sample(); err != nil {
+    t.Fatalf("Sample() failed: %s", err)
+  }
+  assert.Equal(t, 12, len(wr.Lines))
+  assert.Equal(t, "pressure cpu some 1.53 0.87 0.32 0\n", wr.Lines[6])
+  assert.Equal(t, "pressure io some 4.2 2.1 1.01 25\n", wr.Lines[10])
+  assert.Equal(t, "pressure io full 3.8 1.95 0.93 10\n", wr.Lines[11])
+}
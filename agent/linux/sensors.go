@@ -0,0 +1,157 @@
+package linux
+
+import (
+  "os"
+  "strconv"
+  "strings"
+  "../../util"
+)
+
+// Kinds of hwmon sensor reported by the SensorSampler, along with the scale
+// that converts their raw sysfs values into base units.
+var hwmonSensors = []struct {
+  prefix string
+  metric string
+  scale  float64
+  limits []string
+}{
+  {"temp", "sensor.temp", 1000, []string{"max", "crit"}},
+  {"fan", "sensor.fan", 1, []string{"min", "max"}},
+  {"in", "sensor.voltage", 1000, []string{"min", "max"}},
+}
+
+// Sampler for hardware temperature, fan and voltage sensors exposed via
+// /sys/class/hwmon, and for thermal zones exposed via /sys/class/thermal.
+// Temperatures are reported in degrees Celsius, fan speeds in RPM and
+// voltages in volts. Thresholds the kernel doesn't provide are reported as
+// zero.
+type SensorSampler struct {
+  opener util.DirOpener
+  sink   util.SampleWriter
+}
+
+// Create a new hardware sensor sampler.
+func NewSensorSampler(o util.DirOpener, s util.SampleWriter) *SensorSampler {
+  return &SensorSampler{opener: o, sink: s}
+}
+
+// Initialize this sampler.
+func (sensors *SensorSampler) Init() (err error) {
+  return
+}
+
+// Gather current hardware sensor readings.
+func (sensors *SensorSampler) Sample() (err error) {
+  if err = sensors.sampleHwmon(); err != nil {
+    return
+  }
+  return sensors.sampleThermal()
+}
+
+// Gather readings from every hwmon chip.
+func (sensors *SensorSampler) sampleHwmon() (err error) {
+  chips, err := sensors.opener.ReadDir("/sys/class/hwmon")
+  if os.IsNotExist(err) {
+    return nil
+  } else if err != nil {
+    return
+  }
+  for _, chip := range chips {
+    dir := "/sys/class/hwmon/" + chip.Name()
+    name, err := readValue(sensors.opener, dir + "/name")
+    if err != nil {
+      name = chip.Name()
+    }
+    entries, err := sensors.opener.ReadDir(dir)
+    if err != nil {
+      continue
+    }
+    for _, entry := range entries {
+      sensors.sampleInput(dir, chip.Name(), name, entry.Name())
+    }
+  }
+  return nil
+}
+
+// Report a single hwmon sensor if the given file is one of its inputs
+// (e.g. temp1_input). Inputs that can't be read, such as disconnected fan
+// headers, are skipped.
+func (sensors *SensorSampler) sampleInput(dir, chip, name, file string) {
+  if !strings.HasSuffix(file, "_input") {
+    return
+  }
+  base := strings.TrimSuffix(file, "_input")
+  for _, kind := range hwmonSensors {
+    if !strings.HasPrefix(base, kind.prefix) ||
+       strings.Trim(base[len(kind.prefix):], "0123456789") != "" {
+      continue
+    }
+    raw, err := readInt(sensors.opener, dir + "/" + file)
+    if err != nil {
+      return
+    }
+    label, err := readValue(sensors.opener, dir + "/" + base + "_label")
+    if err != nil {
+      label = base
+    }
+    args := []interface{}{kind.metric, chip, name, label,
+                          float64(raw) / kind.scale}
+    for _, limit := range kind.limits {
+      v, err := readInt(sensors.opener, dir + "/" + base + "_" + limit)
+      if err != nil {
+        v = 0
+      }
+      args = append(args, float64(v) / kind.scale)
+    }
+    sensors.sink.Write(args...)
+    return
+  }
+}
+
+// Gather readings from every thermal zone. The max threshold is the zone's
+// "hot" trip point and the critical threshold its "critical" trip point.
+func (sensors *SensorSampler) sampleThermal() (err error) {
+  zones, err := sensors.opener.ReadDir("/sys/class/thermal")
+  if os.IsNotExist(err) {
+    return nil
+  } else if err != nil {
+    return
+  }
+  for _, zone := range zones {
+    if !strings.HasPrefix(zone.Name(), "thermal_zone") {
+      continue
+    }
+    dir := "/sys/class/thermal/" + zone.Name()
+    temp, err := readInt(sensors.opener, dir + "/temp")
+    if err != nil {
+      continue
+    }
+    kind, err := readValue(sensors.opener, dir + "/type")
+    if err != nil {
+      kind = zone.Name()
+    }
+    var hot, crit int64
+    for i := 0; ; i++ {
+      prefix := dir + "/trip_point_" + strconv.Itoa(i)
+      tripType, err := readValue(sensors.opener, prefix + "_type")
+      if err != nil {
+        break
+      }
+      tripTemp, err := readInt(sensors.opener, prefix + "_temp")
+      if err != nil {
+        continue
+      }
+      switch tripType {
+      case "hot": hot = tripTemp
+      case "critical": crit = tripTemp
+      }
+    }
+    sensors.sink.Write("thermal",
+                       zone.Name(),
+                       kind,
+                       float64(temp) / 1000,
+                       float64(hot) / 1000,
+                       float64(crit) / 1000)
+  }
+  return nil
+}
@@ -0,0 +1,62 @@
+package linux
+
+import (
+  "github.com/bmizerany/assert"
+  "testing"
+  "../../util"
+)
+
+func Test_SensorSampler_should_report_hwmon_sensors_with_labels_and_limits(t *testing.T) {
+  wr := NewBufferedSampleWriter()
+  opener := util.NewFakeFS(map[string]string{
+    "/sys/class/hwmon/hwmon0/name": "acpitz\n",
+    "/sys/class/hwmon/hwmon0/temp1_input": "27800\n",
+    "/sys/class/hwmon/hwmon0/temp1_crit": "105000\n",
+    "/sys/class/hwmon/hwmon1/name": "coretemp\n",
+    "/sys/class/hwmon/hwmon1/temp1_input": "52000\n",
+    "/sys/class/hwmon/hwmon1/temp1_label": "Package id 0\n",
+    "/sys/class/hwmon/hwmon1/temp1_max": "84000\n",
+    "/sys/class/hwmon/hwmon1/temp1_crit": "100000\n",
+    "/sys/class/hwmon/hwmon1/temp1_crit_alarm": "0\n",
+    "/sys/class/hwmon/hwmon2/name": "nct6775\n",
+    "/sys/class/hwmon/hwmon2/fan1_input": "1215\n",
+    "/sys/class/hwmon/hwmon2/fan1_min": "300\n",
+    "/sys/class/hwmon/hwmon2/in0_input": "1128\n",
+    "/sys/class/hwmon/hwmon2/in0_label": "Vcore\n",
+    "/sys/class/hwmon/hwmon2/in0_min": "0\n",
+    "/sys/class/hwmon/hwmon2/in0_max": "1744\n",
+  })
+  sampler := NewSensorSampler(opener, wr)
+  if err := sampler.Sample(); err != nil {
+    t.Fatalf("Sample() failed: %s", err)
+  }
+  assert.Equal(t, 4, len(wr.Lines))
+  assert.Equal(t, "sensor.temp hwmon0 acpitz temp1 27.8 0 105\n", wr.Lines[0])
+  assert.Equal(
+    t,
+    "sensor.temp hwmon1 coretemp Package id 0 52 84 100\n",
+    wr.Lines[1])
+  assert.Equal(t, "sensor.fan hwmon2 nct6775 fan1 1215 300 0\n", wr.Lines[2])
+  assert.Equal(t, "sensor.voltage hwmon2 nct6775 Vcore 1.128 0 1.744\n", wr.Lines[3])
+}
+
+func Test_SensorSampler_should_report_thermal_zones_with_trip_points(t *testing.T) {
+  wr := NewBufferedSampleWriter()
+  opener := util.NewFakeFS(map[string]string{
+    "/sys/class/thermal/cooling_device0/type": "Processor\n",
+    "/sys/class/thermal/thermal_zone0/type": "x86_pkg_temp\n",
+    "/sys/class/thermal/thermal_zone0/temp": "48000\n",
+    "/sys/class/thermal/thermal_zone0/trip_point_0_type": "passive\n",
+    "/sys/class/thermal/thermal_zone0/trip_point_0_temp": "95000\n",
+    "/sys/class/thermal/thermal_zone0/trip_point_1_type": "hot\n",
+    "/sys/class/thermal/thermal_zone0/trip_point_1_temp": "98000\n",
+    "/sys/class/thermal/thermal_zone0/trip_point_2_type": "critical\n",
+    "/sys/class/thermal/thermal_zone0/trip_point_2_temp": "103000\n",
+  })
+  sampler := NewSensorSampler(opener, wr)
+  if err := sampler.Sample(); err != nil {
+    t.Fatalf("Sample() failed: %s", err)
+  }
+  assert.Equal(t, 1, len(wr.Lines))
+  assert.Equal(t, "thermal thermal_zone0 x86_pkg_temp 48 98 103\n", wr.Lines[0])
+}
@@ -0,0 +1,220 @@
+package linux
+
+import (
+  "bufio"
+  "fmt"
+  "io"
+  "os"
+  "sort"
+  "strconv"
+  "strings"
+  "../../util"
+)
+
+// Names of the TCP connection states, indexed by their kernel value as
+// found in the st column of /proc/net/tcp.
+var tcpStates = []string{
+  "",
+  "ESTABLISHED",
+  "SYN_SENT",
+  "SYN_RECV",
+  "FIN_WAIT1",
+  "FIN_WAIT2",
+  "TIME_WAIT",
+  "CLOSE",
+  "CLOSE_WAIT",
+  "LAST_ACK",
+  "LISTEN",
+  "CLOSING",
+  "NEW_SYN_RECV",
+}
+
+// States reported for UDP sockets. UDP sockets are either connected to a
+// single peer or not.
+var udpStates = []string{"ESTABLISHED", "CLOSE"}
+
+const (
+  tcpEstablished = 0x01
+  tcpClose       = 0x07
+  tcpListen      = 0x0a
+)
+
+// Per-port socket queue depths, summed over every socket bound to a port.
+type socketQueue struct {
+  rx uint64
+  tx uint64
+}
+
+// Socket census for one protocol family (e.g. tcp and tcp6 together).
+type socketCensus struct {
+  states map[string]uint64
+  listen map[uint64]*socketQueue
+  remote map[uint64]uint64
+}
+
+func newSocketCensus() *socketCensus {
+  return &socketCensus{
+    states: make(map[string]uint64),
+    listen: make(map[uint64]*socketQueue),
+    remote: make(map[uint64]uint64),
+  }
+}
+
+// Sampler for socket state counts and listening port queue depths.
+type SocketSampler struct {
+  opener       util.Opener
+  sink         util.SampleWriter
+  ByRemotePort bool
+}
+
+// Create a new socket sampler.
+func NewSocketSampler(o util.Opener, s util.SampleWriter) *SocketSampler {
+  return &SocketSampler{opener: o, sink: s}
+}
+
+// Initialize this sampler.
+func (sock *SocketSampler) Init() (err error) {
+  return
+}
+
+// Gather current socket statistics.
+func (sock *SocketSampler) Sample() (err error) {
+  tcp := newSocketCensus()
+  udp := newSocketCensus()
+  if err = sock.readFile("/proc/net/tcp", tcp); err != nil { return }
+  if err = sock.readFile("/proc/net/tcp6", tcp); err != nil { return }
+  if err = sock.readFile("/proc/net/udp", udp); err != nil { return }
+  if err = sock.readFile("/proc/net/udp6", udp); err != nil { return }
+  sock.report("tcp", tcpStates[1:], tcp)
+  sock.report("udp", udpStates, udp)
+  return
+}
+
+// Read one of Linux's /proc/net socket tables into the given census.
+// Missing tables (e.g. tcp6 on hosts with IPv6 disabled) are skipped.
+func (sock *SocketSampler) readFile(path string, census *socketCensus) (err error) {
+  f, err := sock.opener.Open(path)
+  if os.IsNotExist(err) {
+    return nil
+  } else if err != nil {
+    return
+  }
+  defer f.Close()
+  rd := bufio.NewReader(f)
+  for {
+    var line string
+
+    line, err = rd.ReadString('\n')
+    if err == io.EOF {
+      err = nil
+      break
+    } else if err != nil {
+      return
+    }
+    if err = sock.parseLine(line, census); err != nil {
+      return
+    }
+  }
+  return
+}
+
+// Parse an individual line from Linux's /proc/net/{tcp,tcp6,udp,udp6}.
+func (sock *SocketSampler) parseLine(line string, census *socketCensus) (err error) {
+  parts := strings.Fields(line)
+  if len(parts) < 5 || parts[0] == "sl" {
+    return
+  }
+  _, lport, err := splitSocketAddr(parts[1])
+  if err != nil {
+    return
+  }
+  raddr, rport, err := splitSocketAddr(parts[2])
+  if err != nil {
+    return
+  }
+  state, err := strconv.ParseUint(parts[3], 16, 8)
+  if err != nil {
+    return
+  }
+  queues := strings.SplitN(parts[4], ":", 2)
+  if len(queues) != 2 {
+    return fmt.Errorf("malformed socket queue field: %s", parts[4])
+  }
+  tx, err := strconv.ParseUint(queues[0], 16, 64)
+  if err != nil {
+    return
+  }
+  rx, err := strconv.ParseUint(queues[1], 16, 64)
+  if err != nil {
+    return
+  }
+  if state < uint64(len(tcpStates)) {
+    census.states[tcpStates[state]]++
+  }
+  // TCP sockets in LISTEN and unconnected UDP sockets both accept traffic
+  // on their local port; their receive queue is the backlog.
+  unbound := strings.Trim(raddr, "0") == ""
+  if state == tcpListen || (state == tcpClose && unbound && lport != 0) {
+    q, ok := census.listen[lport]
+    if !ok {
+      q = &socketQueue{}
+      census.listen[lport] = q
+    }
+    q.rx += rx
+    q.tx += tx
+  } else if !unbound {
+    census.remote[rport]++
+  }
+  return
+}
+
+// Write out the gathered census for the given protocol.
+func (sock *SocketSampler) report(proto string, states []string, census *socketCensus) {
+  for _, state := range states {
+    sock.sink.Write("sockets", proto, state, census.states[state])
+  }
+  for _, port := range sortedPorts(census.listen) {
+    q := census.listen[port]
+    sock.sink.Write("sockets.listen", proto, port, q.rx, q.tx)
+  }
+  if !sock.ByRemotePort {
+    return
+  }
+  ports := make([]uint64, 0, len(census.remote))
+  for port := range census.remote {
+    ports = append(ports, port)
+  }
+  sort.Sort(uint64Slice(ports))
+  for _, port := range ports {
+    sock.sink.Write("sockets.remote", proto, port, census.remote[port])
+  }
+}
+
+// Split a hex-encoded ADDR:PORT pair from /proc/net/tcp into its address
+// and port number.
+func splitSocketAddr(raw string) (addr string, port uint64, err error) {
+  idx := strings.LastIndex(raw, ":")
+  if idx < 0 {
+    err = fmt.Errorf("malformed socket address: %s", raw)
+    return
+  }
+  addr = raw[:idx]
+  port, err = strconv.ParseUint(raw[idx+1:], 16, 16)
+  return
+}
+
+// Return the ports of the given queue map in ascending order.
+func sortedPorts(m map[uint64]*socketQueue) []uint64 {
+  ports := make([]uint64, 0, len(m))
+  for port := range m {
+    ports = append(ports, port)
+  }
+  sort.Sort(uint64Slice(ports))
+  return ports
+}
+
+type uint64Slice []uint64
+
+func (p uint64Slice) Len() int           { return len(p) }
+func (p uint64Slice) Less(i, j int) bool { return p[i] < p[j] }
+func (p uint64Slice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
@@ -0,0 +1,73 @@
+package linux
+
+import (
+  "github.com/bmizerany/assert"
+  "testing"
+  "../../util"
+)
+
+var (
+  procNetTCPOutput =
+`  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000:0016 00000000:0000 0A 00000000:00000003 00:00000000 00000000     0        0 15013 1 ffff88003d3af3c0 100 0 0 10 0
+   1: 0100007F:0CEA 00000000:0000 0A 00000000:00000000 00:00000000 00000000   112        0 17604 1 ffff88003d3af740 100 0 0 10 0
+   2: 0A000002:0016 0A000001:C35A 01 00000024:00000000 01:00000018 00000000     0        0 99012 4 ffff88003d3b0b80 20 4 31 10 -1
+   3: 0A000002:D2F0 5DB8D822:01BB 06 00000000:00000000 03:000012A8 00000000     0        0 0 3 ffff88003c8a1d40
+   4: 0A000002:D2F2 5DB8D822:01BB 06 00000000:00000000 03:000012B0 00000000     0        0 0 3 ffff88003c8a1e00
+`
+  procNetTCP6Output =
+`  sl  local_address                         remote_address                        st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000000000000000000000000000:0016 00000000000000000000000000000000:0000 0A 00000000:00000001 00:00000000 00000000     0        0 15015 1 ffff88003b6d0000 100 0 0 10 0
+`
+  procNetUDPOutput =
+`  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode ref pointer drops
+  123: 00000000:0044 00000000:0000 07 00000000:00000200 00:00000000 00000000     0        0 14420 2 ffff88003c5e2d00 0
+  456: 0A000002:9C40 08080808:0035 01 00000000:00000000 00:00000000 00000000     0        0 99201 2 ffff88003c5e3100 0
+`
+)
+
+func newSocketTestOpener() *util.FakeFS {
+  return util.NewFakeFS(map[string]string{
+    "/proc/net/tcp": procNetTCPOutput,
+    "/proc/net/tcp6": procNetTCP6Output,
+    "/proc/net/udp": procNetUDPOutput,
+  })
+}
+
+func Test_SocketSampler_should_count_sockets_by_state(t *testing.T) {
+  wr := NewBufferedSampleWriter()
+  sampler := NewSocketSampler(newSocketTestOpener(), wr)
+  if err := sampler.Sample(); err != nil {
+    t.Fatalf("Sample() failed: %s", err)
+  }
+  assert.Equal(t, 17, len(wr.Lines))
+  assert.Equal(t, "sockets tcp ESTABLISHED 1\n", wr.Lines[0])
+  assert.Equal(t, "sockets tcp TIME_WAIT 2\n", wr.Lines[5])
+  assert.Equal(t, "sockets tcp LISTEN 3\n", wr.Lines[9])
+  assert.Equal(t, "sockets udp ESTABLISHED 1\n", wr.Lines[14])
+  assert.Equal(t, "sockets udp CLOSE 1\n", wr.Lines[15])
+}
+
+func Test_SocketSampler_should_report_listening_port_queue_depths(t *testing.T) {
+  wr := NewBufferedSampleWriter()
+  sampler := NewSocketSampler(newSocketTestOpener(), wr)
+  if err := sampler.Sample(); err != nil {
+    t.Fatalf("Sample() failed: %s", err)
+  }
+  assert.Equal(t, "sockets.listen tcp 22 4 0\n", wr.Lines[12])
+  assert.Equal(t, "sockets.listen tcp 3306 0 0\n", wr.Lines[13])
+  assert.Equal(t, "sockets.listen udp 68 512 0\n", wr.Lines[16])
+}
+
+func Test_SocketSampler_should_group_connections_by_remote_port(t *testing.T) {
+  wr := NewBufferedSampleWriter()
+  sampler := NewSocketSampler(newSocketTestOpener(), wr)
+  sampler.ByRemotePort = true
+  if err := sampler.Sample(); err != nil {
+    t.Fatalf("Sample() failed: %s", err)
+  }
+  assert.Equal(t, 20, len(wr.Lines))
+  assert.Equal(t, "sockets.remote tcp 443 2\n", wr.Lines[14])
+  assert.Equal(t, "sockets.remote tcp 50010 1\n", wr.Lines[15])
+  assert.Equal(t, "sockets.remote udp 53 1\n", wr.Lines[19])
+}
@@ -3,25 +3,66 @@ package linux
 
 import (
   "bufio"
+  "encoding/binary"
   "fmt"
   "io"
+  "io/ioutil"
   "strconv"
   "strings"
-  "syscall"
   "../../util"
 )
 
-// #include <unistd.h>
-// #include <errno.h>
-import "C"
+// Auxiliary vector entry types (see getauxval(3)).
+const (
+  atNull   = 0
+  atClkTck = 17
+)
+
+// Clock ticks per second assumed when the kernel doesn't report it. This is
+// USER_HZ on every mainstream architecture.
+const defaultHZ = 100
 
-// Retrieve the clock ticks per second on this kernel.
-func getHZ() (uint64, error) {
-  ticks, err := C.sysconf(C._SC_CLK_TCK)
+// Retrieve the clock ticks per second on this kernel from the AT_CLKTCK
+// entry of the ELF auxiliary vector the kernel passed to this process,
+// falling back to defaultHZ if it can't be read.
+func getHZ(o util.Opener) (uint64, error) {
+  f, err := o.Open("/proc/self/auxv")
+  if err != nil {
+    return defaultHZ, nil
+  }
+  defer f.Close()
+  auxv, err := ioutil.ReadAll(f)
   if err != nil {
-    return 0, err
+    return defaultHZ, nil
+  }
+  if hz := parseAuxv(auxv, atClkTck); hz > 0 {
+    return hz, nil
   }
-  return uint64(ticks), nil
+  return defaultHZ, nil
+}
+
+// Find the value of the given entry type in a raw auxiliary vector, which
+// is a list of (type, value) pairs of native machine words terminated by
+// an AT_NULL entry. Returns zero if the entry isn't present.
+func parseAuxv(auxv []byte, tag uint64) uint64 {
+  word := strconv.IntSize / 8
+  for i := 0; i + 2 * word <= len(auxv); i += 2 * word {
+    var key, value uint64
+    if word == 8 {
+      key = binary.NativeEndian.Uint64(auxv[i:])
+      value = binary.NativeEndian.Uint64(auxv[i + word:])
+    } else {
+      key = uint64(binary.NativeEndian.Uint32(auxv[i:]))
+      value = uint64(binary.NativeEndian.Uint32(auxv[i + word:]))
+    }
+    if key == atNull {
+      break
+    }
+    if key == tag {
+      return value
+    }
+  }
+  return 0
 }
 
 // Sampler for standard OS- and machine-level metrics. This sampler is an
@@ -38,7 +79,7 @@ type StandardSampler struct {
 }
 
 // Create a new standard sampler.
-func NewStandardSampler(o util.Opener, s util.SampleWriter) *StandardSampler {
+func NewStandardSampler(o util.FileSystem, s util.SampleWriter) *StandardSampler {
   return &StandardSampler{
     uptime: NewUptimeSampler(o, s),
     cpu: NewCPUSampler(o, s),
@@ -121,26 +162,40 @@ func (uptime *UptimeSampler) parseLine(line string) (err error) {
   return
 }
 
-// Sampler for CPU utilization metrics.
+// Sampler for CPU utilization metrics. Each per-CPU sample is tagged with
+// the CPU's index and, where sysfs reports it, its package and core.
 type CPUSampler struct {
-  opener util.Opener
-  sink   util.SampleWriter
-  HZ     uint64
+  opener   util.Opener
+  sink     util.SampleWriter
+  HZ       uint64
+  // Topology of each CPU, read while the set of online CPUs is unchanged.
+  topology map[string]CPUTopology
+  online   string
 }
 
 // Create a new CPU utilization sampler.
 func NewCPUSampler(o util.Opener, s util.SampleWriter) *CPUSampler {
-  return &CPUSampler{opener: o, sink: s}
+  return &CPUSampler{
+    opener: o,
+    sink: s,
+    topology: make(map[string]CPUTopology),
+  }
 }
 
 // Initialize this sampler.
 func (stats *CPUSampler) Init() (err error) {
-  stats.HZ, err = getHZ()
+  stats.HZ, err = getHZ(stats.opener)
   return
 }
 
 // Gather current CPU utilization sample.
 func (stats *CPUSampler) Sample() (err error) {
+  // CPUs brought online may have been placed differently.
+  online, _ := readValue(stats.opener, "/sys/devices/system/cpu/online")
+  if online != stats.online {
+    stats.topology = make(map[string]CPUTopology)
+    stats.online = online
+  }
   f, err := stats.opener.Open("/proc/stat")
   if err != nil {
     return
@@ -164,40 +219,72 @@ func (stats *CPUSampler) Sample() (err error) {
   return
 }
 
-// Parse an individual line from Linux's /proc/stat.
+// Parse an individual line from Linux's /proc/stat. The number of time
+// columns has grown over the years (iowait, irq and softirq in 2.6, steal in
+// 2.6.11, guest in 2.6.24, guest_nice in 2.6.33), so any columns missing on
+// older kernels are taken to be zero.
 func (stats *CPUSampler) parseLine(line string) (err error) {
   if !strings.HasPrefix(line, "cpu") {
     return
   }
 
-  var dev string
-  var user, nice, sys, idle, iowait, hardirq uint64
-  var softirq, steal, guest, guest_nice uint64
-
-  _, err = fmt.Sscanf(line,
-                      "%s %d %d %d %d %d %d %d %d %d %d",
-                      &dev,
-                      &user, &nice, &sys, &idle, &iowait, &hardirq,
-                      &softirq, &steal, &guest, &guest_nice)
-  if err != nil {
-    return
+  parts := strings.Fields(line)
+  if len(parts) < 5 {
+    return fmt.Errorf("too few fields in /proc/stat line: %q", line)
   }
+  dev := parts[0]
   if dev == "cpu" {
     return
   }
+  // user, nice, system, idle, iowait, irq, softirq, steal, guest, guest_nice
+  var cols [10]uint64
+  for i, raw := range parts[1:] {
+    if i >= len(cols) {
+      break
+    }
+    if cols[i], err = strconv.ParseUint(raw, 10, 64); err != nil {
+      return
+    }
+  }
+  user, nice, sys, idle, iowait, steal :=
+    cols[0], cols[1], cols[2], cols[3], cols[4], cols[7]
   // Individual CPU usage line; calculate per-CPU metrics with this.
   idx := strings.Replace(dev, "cpu", "", 1)
-  stats.sink.Write("cpu",
-                   idx,
-                   user / stats.HZ,
-                   sys / stats.HZ,
-                   nice / stats.HZ,
-                   iowait / stats.HZ,
-                   steal / stats.HZ,
-                   idle / stats.HZ)
+  values := []interface{}{
+    "cpu",
+    idx,
+    user / stats.HZ,
+    sys / stats.HZ,
+    nice / stats.HZ,
+    iowait / stats.HZ,
+    steal / stats.HZ,
+    idle / stats.HZ,
+  }
+  if topo, ok := stats.readTopology(idx); ok {
+    values = append(values, util.Tags{
+      "package": strconv.FormatInt(topo.Package, 10),
+      "core": strconv.FormatInt(topo.Core, 10),
+    })
+  }
+  stats.sink.Write(values...)
   return
 }
 
+// Look up the topology of the CPU with the given index. A CPU's placement
+// doesn't change while it's online, so it's only read from sysfs once for
+// each set of online CPUs.
+func (stats *CPUSampler) readTopology(idx string) (CPUTopology, bool) {
+  if topo, ok := stats.topology[idx]; ok {
+    return topo, true
+  }
+  topo, err := readCPUTopology(stats.opener, idx)
+  if err != nil {
+    return topo, false
+  }
+  stats.topology[idx] = topo
+  return topo, true
+}
+
 // Sampler for system load statistics.
 type LoadSampler struct {
   opener util.Opener
@@ -350,39 +437,57 @@ func (disk *DiskIOSampler) Sample() (err error) {
   return
 }
 
-// Parse an individual line from Linux's /proc/diskstats.
+// Parse an individual line from Linux's /proc/diskstats. Lines have 14
+// fields on 2.6 and later kernels, 18 from 4.18 (adding discards) and 20
+// from 5.5 (adding flushes). Partitions on kernels before 2.6.25 have only
+// 7 fields. Discard and flush statistics are reported when present.
 func (disk *DiskIOSampler) parseLine(line string) (err error) {
-  var major, minor uint
-  var dev string
-  var rd_ios, rd_merges, rd_sec, rd_ticks uint64
-  var wr_ios, wr_merges, wr_sec, wr_ticks uint64
-  var ios_in_progress, total_ticks, rq_ticks uint64
-
-  _, err = fmt.Sscanf(line,
-                      "%d %d %s %d %d %d %d %d %d %d %d %d %d %d",
-                      &major, &minor, &dev,
-                      &rd_ios, &rd_merges, &rd_sec, &rd_ticks,
-                      &wr_ios, &wr_merges, &wr_sec, &wr_ticks,
-                      &ios_in_progress, &total_ticks, &rq_ticks)
-  if err != nil {
+  parts := strings.Fields(line)
+  if len(parts) == 0 {
     return
   }
+  if len(parts) != 7 && len(parts) < 14 {
+    return fmt.Errorf("unexpected number of fields in /proc/diskstats line: %q", line)
+  }
+  dev := parts[2]
   // skip garbage devices
   if strings.HasPrefix(dev, "ram") || strings.HasPrefix(dev, "loop") {
     return
   }
-  disk.sink.Write("disk", dev, rd_ios, rd_sec / 2, wr_ios, wr_sec / 2)
+  stats := make([]uint64, len(parts) - 3)
+  for i, raw := range parts[3:] {
+    if stats[i], err = strconv.ParseUint(raw, 10, 64); err != nil {
+      return
+    }
+  }
+  if len(stats) == 4 {
+    // rd_ios, rd_sec, wr_ios, wr_sec
+    disk.sink.Write("disk", dev, stats[0], stats[1] / 2, stats[2], stats[3] / 2)
+    return
+  }
+  // rd_ios, rd_merges, rd_sec, rd_ticks, wr_ios, wr_merges, wr_sec, wr_ticks,
+  // ios_in_progress, total_ticks, rq_ticks
+  disk.sink.Write("disk", dev, stats[0], stats[2] / 2, stats[4], stats[6] / 2)
+  if len(stats) >= 15 {
+    // dc_ios, dc_merges, dc_sec, dc_ticks
+    disk.sink.Write("disk.discard",
+                    dev, stats[11], stats[12], stats[13] / 2, stats[14])
+  }
+  if len(stats) >= 17 {
+    // fl_ios, fl_ticks
+    disk.sink.Write("disk.flush", dev, stats[15], stats[16])
+  }
   return
 }
 
 // Sampler for filesystem usage statistics.
 type FSUsageSampler struct {
-  opener util.Opener
+  opener util.FileSystem
   sink   util.SampleWriter
 }
 
 // Create a new filesystem usage sampler.
-func NewFSUsageSampler(o util.Opener, s util.SampleWriter) *FSUsageSampler {
+func NewFSUsageSampler(o util.FileSystem, s util.SampleWriter) *FSUsageSampler {
   return &FSUsageSampler{opener: o, sink: s}
 }
 
@@ -420,7 +525,7 @@ func (fs *FSUsageSampler) Sample() (err error) {
 func (fs *FSUsageSampler) parseLine(line string) (err error) {
   var dev, mount, fstype, options string
   var dump, fsck_order uint64
-  var buf syscall.Statfs_t
+  var buf *util.FSStats
 
   _, err = fmt.Sscanf(line,
                       "%s %s %s %s %d %d",
@@ -433,21 +538,21 @@ func (fs *FSUsageSampler) parseLine(line string) (err error) {
   if !strings.HasPrefix(fstype, "ext") {
     return
   }
-  if err = syscall.Statfs(mount, &buf); err != nil {
+  if buf, err = fs.opener.Statfs(mount); err != nil {
     return
   }
   if buf.Blocks == 0 {
     return
   }
-  to1K := uint64(buf.Bsize) / 1024
+  to1K := buf.BlockSize / 1024
   fs.sink.Write("fs",
                 dev,
                 mount,
                 buf.Blocks * to1K,
-                buf.Bfree * to1K,
-                buf.Bavail * to1K,
+                buf.BlocksFree * to1K,
+                buf.BlocksAvail * to1K,
                 buf.Files,
-                buf.Ffree)
+                buf.FilesFree)
   return
 }
 
@@ -1,11 +1,15 @@
 package linux
 
 import (
+  "encoding/binary"
   "fmt"
   "github.com/bmizerany/assert"
   "io"
+  "strconv"
   "strings"
+  "syscall"
   "testing"
+  "../../util"
 )
 
 var (
@@ -24,6 +28,7 @@ procs_running 1
 procs_blocked 0
 softirq 37177398 6 8570721 477 1028639 715899 6 16037399 4556202 71761 6196288
 `
+  procUptimeOutput = "350735.47 234388.90\n"
   procLoadavgOutput = "0.00 0.02 0.05 1/406 16439"
   procMeminfoOutput =
 `MemTotal:        3353936 kB
@@ -165,6 +170,40 @@ func (b *BufferedSampleWriter) Write(v ...interface{}) {
   b.Lines = append(b.Lines, fmt.Sprintln(v...))
 }
 
+func buildAuxv(pairs ...uint64) string {
+  word := strconv.IntSize / 8
+  buf := make([]byte, len(pairs) * word)
+  for i, v := range pairs {
+    if word == 8 {
+      binary.NativeEndian.PutUint64(buf[i * word:], v)
+    } else {
+      binary.NativeEndian.PutUint32(buf[i * word:], uint32(v))
+    }
+  }
+  return string(buf)
+}
+
+func Test_getHZ_should_read_clock_ticks_from_auxv(t *testing.T) {
+  auxv := buildAuxv(6, 4096, 17, 250, 3, 0x400040, 0, 0)
+  hz, err := getHZ(NewStringOpener(auxv))
+  if err != nil {
+    t.Fatalf("getHZ() failed: %s", err)
+  }
+  assert.Equal(t, uint64(250), hz)
+}
+
+func Test_getHZ_should_fall_back_without_auxv(t *testing.T) {
+  hz, err := getHZ(util.NewFakeFS(map[string]string{}))
+  if err != nil {
+    t.Fatalf("getHZ() failed: %s", err)
+  }
+  assert.Equal(t, uint64(defaultHZ), hz)
+
+  // AT_CLKTCK after the AT_NULL terminator must be ignored.
+  hz, _ = getHZ(NewStringOpener(buildAuxv(6, 4096, 0, 0, 17, 250)))
+  assert.Equal(t, uint64(defaultHZ), hz)
+}
+
 func Test_CPUSampler_should_parse_valid_proc_stats_file_properly(t *testing.T) {
   wr := NewBufferedSampleWriter()
   sampler := NewCPUSampler(NewStringOpener(procStatsOutput), wr)
@@ -178,6 +217,58 @@ func Test_CPUSampler_should_parse_valid_proc_stats_file_properly(t *testing.T) {
   assert.Equal(t, "cpu 3 2325 561 9 169 0 233913\n", wr.Lines[3])
 }
 
+func Test_CPUSampler_should_parse_proc_stats_from_older_kernels(t *testing.T) {
+  wr := NewBufferedSampleWriter()
+  // 2.6.9 (7 columns) and 2.4 (4 columns) kernels.
+  sampler := NewCPUSampler(NewStringOpener(
+`cpu  1377723 12309 425558 92572282 176914 102 11966
+cpu0 445076 5965 184472 22802862 67989 101 11569
+cpu1 253806 742 57397 23372889
+`), wr)
+  sampler.HZ = testHZ
+  if err := sampler.Sample(); err != nil {
+    t.Fatalf("Sample() failed: %s", err)
+  }
+  assert.Equal(t, 2, len(wr.Lines))
+  assert.Equal(t, "cpu 0 4450 1844 59 679 0 228028\n", wr.Lines[0])
+  assert.Equal(t, "cpu 1 2538 573 7 0 0 233728\n", wr.Lines[1])
+}
+
+func Test_CPUSampler_should_tag_samples_with_topology(t *testing.T) {
+  wr := NewBufferedSampleWriter()
+  opener := util.NewFakeFS(map[string]string{
+    "/proc/stat": procStatsOutput,
+    "/sys/devices/system/cpu/online": "0-1\n",
+    "/sys/devices/system/cpu/cpu0/topology/physical_package_id": "0\n",
+    "/sys/devices/system/cpu/cpu0/topology/core_id": "0\n",
+    "/sys/devices/system/cpu/cpu1/topology/physical_package_id": "0\n",
+    "/sys/devices/system/cpu/cpu1/topology/core_id": "1\n",
+  })
+  sampler := NewCPUSampler(opener, wr)
+  sampler.HZ = testHZ
+  if err := sampler.Sample(); err != nil {
+    t.Fatalf("Sample() failed: %s", err)
+  }
+  assert.Equal(t, "cpu 0 4450 1844 59 679 0 228028 core=0,package=0\n", wr.Lines[0])
+  assert.Equal(t, "cpu 1 2538 573 7 109 0 233728 core=1,package=0\n", wr.Lines[1])
+  // No topology in sysfs, so no package or core.
+  assert.Equal(t, "cpu 3 2325 561 9 169 0 233913\n", wr.Lines[3])
+
+  // Topology is read again whenever the set of online CPUs changes, e.g.
+  // when CPU 1 is taken offline and brought back in another package.
+  opener.SetFile("/sys/devices/system/cpu/online", "0\n")
+  opener.SetFile("/sys/devices/system/cpu/cpu0/topology/core_id", "7\n")
+  sampler.Sample()
+  assert.Equal(t, "cpu 0 4450 1844 59 679 0 228028 core=7,package=0\n", wr.Lines[4])
+  opener.SetFile("/sys/devices/system/cpu/online", "0-1\n")
+  opener.SetFile("/sys/devices/system/cpu/cpu1/topology/physical_package_id", "1\n")
+  sampler.Sample()
+  assert.Equal(t, "cpu 1 2538 573 7 109 0 233728 core=1,package=1\n", wr.Lines[9])
+  opener.SetFile("/sys/devices/system/cpu/cpu0/topology/core_id", "9\n")
+  sampler.Sample()
+  assert.Equal(t, "cpu 0 4450 1844 59 679 0 228028 core=7,package=0\n", wr.Lines[12])
+}
+
 func Test_LoadSampler_should_parse_valid_proc_loadavg_file_properly(t *testing.T) {
   wr := NewBufferedSampleWriter()
   sampler := NewLoadSampler(NewStringOpener(procLoadavgOutput), wr)
@@ -211,6 +302,58 @@ func Test_DiskIOSampler_should_parse_valid_proc_diskstats_file_properly(t *testi
   assert.Equal(t, "disk sda5 161 768 0 0\n", wr.Lines[3])
 }
 
+func Test_DiskIOSampler_should_report_discards_and_flushes_when_present(t *testing.T) {
+  wr := NewBufferedSampleWriter()
+  sampler := NewDiskIOSampler(NewStringOpener(
+`   7       0 loop0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0
+ 259       0 nvme0n1 183512 50331 9916846 37510 476202 341220 21312738 310772 0 268528 379232 4114 0 58127352 812 20731 30136
+ 259       1 nvme0n1p1 171 1150 9672 31 2 0 2 0 0 56 31 0 0 0 0
+   8       0 sda 50762 6347 1674054 67360 23942 20742 563152 25820 0 14200 93132
+   8       1 sda1 50432 1671178 23118 563152
+`), wr)
+  if err := sampler.Sample(); err != nil {
+    t.Fatalf("Sample() failed: %s", err)
+  }
+  assert.Equal(t, 7, len(wr.Lines))
+  assert.Equal(t, "disk nvme0n1 183512 4958423 476202 10656369\n", wr.Lines[0])
+  assert.Equal(t, "disk.discard nvme0n1 4114 0 29063676 812\n", wr.Lines[1])
+  assert.Equal(t, "disk.flush nvme0n1 20731 30136\n", wr.Lines[2])
+  assert.Equal(t, "disk nvme0n1p1 171 4836 2 1\n", wr.Lines[3])
+  assert.Equal(t, "disk.discard nvme0n1p1 0 0 0 0\n", wr.Lines[4])
+  assert.Equal(t, "disk sda 50762 837027 23942 281576\n", wr.Lines[5])
+  assert.Equal(t, "disk sda1 50432 835589 23118 281576\n", wr.Lines[6])
+}
+
+func Test_DiskIOSampler_should_reject_malformed_lines(t *testing.T) {
+  wr := NewBufferedSampleWriter()
+  sampler := NewDiskIOSampler(NewStringOpener("   8       0 sda 50762 6347 1674054\n"), wr)
+  if err := sampler.Sample(); err == nil {
+    t.Fatalf("expected Sample() to fail")
+  }
+}
+
+func Test_FSUsageSampler_should_parse_valid_etc_mtab_file_properly(t *testing.T) {
+  wr := NewBufferedSampleWriter()
+  opener := util.NewFakeFS(map[string]string{"/etc/mtab": etcMtabOutput})
+  opener.SetStatfs("/", &util.FSStats{
+    BlockSize: 4096,
+    Blocks: 2563580,
+    BlocksFree: 1456722,
+    BlocksAvail: 1326514,
+    Files: 655360,
+    FilesFree: 471832,
+  })
+  sampler := NewFSUsageSampler(opener, wr)
+  if err := sampler.Sample(); err != nil {
+    t.Fatalf("Sample() failed: %s", err)
+  }
+  assert.Equal(t, 1, len(wr.Lines))
+  assert.Equal(
+    t,
+    "fs /dev/sda1 / 10254320 5826888 5306056 655360 471832\n",
+    wr.Lines[0])
+}
+
 func Test_NICSampler_should_parse_valid_proc_net_dev_file_properly(t *testing.T) {
   wr := NewBufferedSampleWriter()
   sampler := NewNICSampler(NewStringOpener(procNetDevOutput), wr)
@@ -223,3 +366,51 @@ func Test_NICSampler_should_parse_valid_proc_net_dev_file_properly(t *testing.T)
     wr.Lines[0])
 }
 
+func Test_StandardSampler_should_sample_every_underlying_sampler(t *testing.T) {
+  wr := NewBufferedSampleWriter()
+  opener := util.NewFakeFS(map[string]string{
+    "/proc/uptime": procUptimeOutput,
+    "/proc/stat": procStatsOutput,
+    "/proc/loadavg": procLoadavgOutput,
+    "/proc/meminfo": procMeminfoOutput,
+    "/proc/diskstats": procDiskstatsOutput,
+    "/etc/mtab": etcMtabOutput,
+    "/proc/net/dev": procNetDevOutput,
+  })
+  opener.SetStatfs("/", &util.FSStats{BlockSize: 4096, Blocks: 2563580})
+  sampler := NewStandardSampler(opener, wr)
+  if err := sampler.Init(); err != nil {
+    t.Fatalf("Init() failed: %s", err)
+  }
+  if err := sampler.Sample(); err != nil {
+    t.Fatalf("Sample() failed: %s", err)
+  }
+  assert.Equal(t, 13, len(wr.Lines))
+  assert.Equal(t, "uptime 350735\n", wr.Lines[0])
+  assert.Equal(t, "cpu 0 4450 1844 59 679 0 228028\n", wr.Lines[1])
+  assert.Equal(t, "load 0 0.02 0.05 406\n", wr.Lines[5])
+  assert.Equal(t, "fs /dev/sda1 / 10254320 0 0 0 0\n", wr.Lines[11])
+  assert.Equal(
+    t,
+    "net eth0 16651766 30158 0 0 4036294 22014 0 0\n",
+    wr.Lines[12])
+}
+
+func Test_StandardSampler_should_stop_at_first_failing_sampler(t *testing.T) {
+  wr := NewBufferedSampleWriter()
+  opener := util.NewFakeFS(map[string]string{
+    "/proc/uptime": procUptimeOutput,
+    "/proc/stat": procStatsOutput,
+    "/proc/loadavg": procLoadavgOutput,
+  })
+  opener.SetError("/proc/loadavg", syscall.EACCES)
+  sampler := NewStandardSampler(opener, wr)
+  if err := sampler.Init(); err != nil {
+    t.Fatalf("Init() failed: %s", err)
+  }
+  err := sampler.Sample()
+  if err == nil || !strings.Contains(err.Error(), "/proc/loadavg") {
+    t.Fatalf("expected error opening /proc/loadavg, got %v", err)
+  }
+  assert.Equal(t, 5, len(wr.Lines))
+}
@@ -0,0 +1,73 @@
+package linux
+
+import (
+  "bufio"
+  "io"
+  "io/ioutil"
+  "strconv"
+  "strings"
+  "../../util"
+)
+
+// Read the contents of a single-value file (as found throughout /sys and
+// cgroupfs), with surrounding whitespace removed.
+func readValue(o util.Opener, path string) (string, error) {
+  f, err := o.Open(path)
+  if err != nil {
+    return "", err
+  }
+  defer f.Close()
+  raw, err := ioutil.ReadAll(f)
+  if err != nil {
+    return "", err
+  }
+  return strings.TrimSpace(string(raw)), nil
+}
+
+// Read a single unsigned integer value from the given file.
+func readUint(o util.Opener, path string) (uint64, error) {
+  raw, err := readValue(o, path)
+  if err != nil {
+    return 0, err
+  }
+  return strconv.ParseUint(raw, 10, 64)
+}
+
+// Read a single signed integer value from the given file.
+func readInt(o util.Opener, path string) (int64, error) {
+  raw, err := readValue(o, path)
+  if err != nil {
+    return 0, err
+  }
+  return strconv.ParseInt(raw, 10, 64)
+}
+
+// Read a flat-keyed file of "key value" lines (e.g. cgroup cpu.stat or
+// memory.events) into a map.
+func readKeyValues(o util.Opener, path string) (map[string]uint64, error) {
+  f, err := o.Open(path)
+  if err != nil {
+    return nil, err
+  }
+  defer f.Close()
+  rv := make(map[string]uint64)
+  rd := bufio.NewReader(f)
+  for {
+    line, err := rd.ReadString('\n')
+    if err != nil && err != io.EOF {
+      return nil, err
+    }
+    parts := strings.Fields(line)
+    if len(parts) == 2 {
+      v, perr := strconv.ParseUint(parts[1], 10, 64)
+      if perr != nil {
+        return nil, perr
+      }
+      rv[parts[0]] = v
+    }
+    if err == io.EOF {
+      break
+    }
+  }
+  return rv, nil
+}
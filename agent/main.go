@@ -2,11 +2,17 @@
 package main
 
 import (
+  "errors"
   "flag"
+  "io"
   "log"
   "os"
   "os/signal"
+  "path/filepath"
+  "strings"
+  "syscall"
   "time"
+  "./app"
   "./linux"
   "../util"
 )
@@ -14,35 +20,451 @@ import (
 // Number of seconds between samples.
 var sampleInterval int
 
-// Network address of collector to which to submit gathered samples.
+// Maximum number of seconds by which to delay sampling after each interval
+// boundary.
+var sampleJitter int
+
+// Comma-separated network addresses of collectors to which to submit
+// gathered samples.
 var collectorAddr string
 
+// How samples are spread across the collectors: "failover" sends them all
+// to the first that's healthy, "shard" does the same but with the order
+// rotated by host so that the fleet is spread across the collectors, and
+// "fanout" sends them to every collector.
+var collectorMode string
+
+// InfluxDB write URL, udp://host:port or file to which to write samples as
+// line protocol.
+var influxDest string
+
+// OTLP/HTTP metrics endpoint to which to export samples.
+var otlpEndpoint string
+
+// Whether to export counters to OTLP as deltas rather than cumulative sums.
+var otlpDelta bool
+
+// Certificate, key and CA files for mutual TLS with the collector.
+var tlsFiles util.TLSFiles
+
+// Whether to report socket counts grouped by remote port.
+var socketsByRemotePort bool
+
+// Maximum depth below the root cgroup to report on; negative for no limit.
+var cgroupDepth int
+
+// Comma-separated glob patterns selecting the cgroups to report on.
+var cgroupPaths string
+
+// Directory at which the monitored host's root filesystem is found.
+var hostRoot string
+
+// Directories at which the monitored host's /proc, /sys and /etc are found,
+// if not below hostRoot.
+var hostProc, hostSys, hostEtc string
+
+// Path of the agent configuration file.
+var configPath string
+
+// Directory into which to record everything read from the host each tick.
+var recordDir string
+
+// Directory of recorded snapshots to replay instead of reading the host.
+var replayDir string
+
+// Number of seconds to wait for queued samples to be sent when shutting
+// down.
+var drainTimeout int
+
+// Most samples sent to the collector in a single batch.
+var batchSize int
+
+// Milliseconds a sample may wait for its batch to fill before being sent.
+var flushWindow int
+
+// Whether to compress batches sent to the collector, if it supports it.
+var compress bool
+
 func init() {
   flag.IntVar(&sampleInterval, "t", 10, "sampling interval in seconds")
-  flag.StringVar(&collectorAddr, "c", "", "address of collector service")
+  flag.IntVar(&sampleJitter, "jitter", 0,
+              "maximum seconds to delay sampling after each interval boundary")
+  flag.StringVar(&configPath, "f", "", "path of agent configuration file")
+  flag.StringVar(&collectorAddr, "c", "",
+                 "comma-separated addresses of collector services")
+  flag.StringVar(&collectorMode, "collector-mode", "failover",
+                 "how to use several collectors: failover, shard or fanout")
+  flag.StringVar(&influxDest, "influx", "",
+                 "InfluxDB write URL, udp://host:port or file for line protocol")
+  flag.StringVar(&otlpEndpoint, "otlp", "",
+                 "OTLP/HTTP metrics endpoint to export samples to")
+  flag.BoolVar(&otlpDelta, "otlp-delta", false,
+               "export counters to OTLP as deltas rather than cumulative sums")
+  flag.IntVar(&batchSize, "batch-size", 1000,
+              "most samples sent to the collector, InfluxDB or OTLP in one batch")
+  flag.IntVar(&flushWindow, "flush-window", 1000,
+              "milliseconds a sample may wait for its batch to fill")
+  flag.BoolVar(&compress, "compress", true,
+               "compress batches sent to the collector")
+  flag.StringVar(&tlsFiles.Cert, "tls-cert", "",
+                 "PEM certificate file for TLS with the collector")
+  flag.StringVar(&tlsFiles.Key, "tls-key", "",
+                 "PEM key file for TLS with the collector")
+  flag.StringVar(&tlsFiles.CA, "tls-ca", "",
+                 "PEM file of CA certificates the collector must be signed by")
+  flag.BoolVar(&socketsByRemotePort, "remote-ports", false,
+               "report socket counts grouped by remote port")
+  flag.IntVar(&cgroupDepth, "cgroup-depth", -1,
+              "maximum cgroup depth to report on (negative for no limit)")
+  flag.StringVar(&cgroupPaths, "cgroup-paths", "",
+                 "comma-separated glob patterns of cgroups to report on")
+  flag.StringVar(&hostRoot, "root", "/",
+                 "directory at which the host's root filesystem is mounted")
+  flag.StringVar(&hostProc, "proc", "",
+                 "directory at which the host's /proc is mounted")
+  flag.StringVar(&hostSys, "sys", "",
+                 "directory at which the host's /sys is mounted (needs -root or -proc)")
+  flag.StringVar(&hostEtc, "etc", "",
+                 "directory at which the host's /etc is mounted (needs -root or -proc)")
+  flag.StringVar(&recordDir, "record", "",
+                 "record everything read from the host into this directory")
+  flag.StringVar(&replayDir, "replay", "",
+                 "replay snapshots recorded in this directory")
+  flag.IntVar(&drainTimeout, "drain-timeout", 10,
+              "seconds to wait for queued samples to be sent on shutdown")
+}
+
+// Build the filesystem through which the host is monitored, given the
+// directories at which the host's root, /proc, /sys and /etc are found.
+// When the host isn't our own root filesystem, /etc/mtab and /proc/net are
+// taken from the host's init process, since they would otherwise describe
+// the mount and network namespaces of this process. Without the host's
+// root filesystem, its mount points are reached through its init process's
+// root as well. Either way the host's /proc must be given, or else these
+// would describe this process's own namespaces.
+func hostFileSystem(rootDir, procDir, sysDir, etcDir string) (util.FileSystem, error) {
+  if rootDir == "/" && procDir == "" && sysDir == "" && etcDir == "" {
+    return util.NewFileOpener(), nil
+  }
+  if rootDir == "/" && procDir == "" {
+    return nil, errors.New("-sys and -etc need -root or -proc to find the host's /proc")
+  }
+  root := util.NewRootFS(rootDir)
+  if procDir != "" {
+    root.Mount("/proc", procDir)
+  } else {
+    procDir = filepath.Join(rootDir, "proc")
+  }
+  if rootDir == "/" {
+    root.MountRoot = filepath.Join(procDir, "1/root")
+  }
+  root.Mount("/proc/net", filepath.Join(procDir, "1/net"))
+  root.Mount("/etc/mtab", filepath.Join(procDir, "1/mounts"))
+  if sysDir != "" {
+    root.Mount("/sys", sysDir)
+  }
+  if etcDir != "" {
+    root.Mount("/etc", etcDir)
+  }
+  return root, nil
+}
+
+// Create and initialize every sampler, reading the host through the given
+// filesystem and writing samples to the given sink along with their tags.
+func newSamplers(opener util.FileSystem, sink util.SampleWriter, tags *tagSet, cfg *Config) []util.Sampler {
+  tagged := func(name string) util.SampleWriter {
+    return &taggingWriter{sink: sink, tags: tags, name: name}
+  }
+  sockets := linux.NewSocketSampler(opener, tagged("socket"))
+  sockets.ByRemotePort = socketsByRemotePort
+  pressure := linux.NewPressureSampler(opener, tagged("pressure"))
+  cgroups := linux.NewCgroupSampler(opener, tagged("cgroup"))
+  cgroups.MaxDepth = cgroupDepth
+  if cgroupPaths != "" {
+    cgroups.Paths = strings.Split(cgroupPaths, ",")
+  }
+  tail, err := app.NewTailSampler(cfg.Tail, tagged("tail"))
+  if err != nil {
+    log.Fatalf("could not create log tail sampler: %s\n", err)
+  }
+  samplers := []util.Sampler{
+    linux.NewStandardSampler(opener, tagged("standard")),
+    sockets,
+    pressure,
+    cgroups,
+    linux.NewSensorSampler(opener, tagged("sensor")),
+    linux.NewCPUFreqSampler(opener, tagged("cpufreq")),
+    app.NewExecSampler(cfg.Exec, tagged("exec")),
+    tail,
+  }
+  for _, sampler := range samplers {
+    if err := sampler.Init(); err != nil {
+      log.Fatalf("could not initialize sampler: %s\n", err)
+    }
+  }
+  if !pressure.Enabled() {
+    log.Printf("pressure stall information not available on this host\n")
+  }
+  if !cgroups.Enabled() {
+    log.Printf("cgroup v2 hierarchy not available on this host\n")
+  }
+  return samplers
+}
+
+// Apply a reloaded configuration to the samplers it drives. Samplers keep
+// their state (e.g. for calculating rates) wherever their configuration is
+// unchanged.
+func reconfigure(samplers []util.Sampler, cfg *Config) (err error) {
+  for _, sampler := range samplers {
+    switch s := sampler.(type) {
+    case *app.TailSampler:
+      err = s.Reconfigure(cfg.Tail)
+    case *app.ExecSampler:
+      err = s.Reconfigure(cfg.Exec)
+    }
+    if err != nil {
+      return
+    }
+  }
+  return nil
+}
+
+// Release everything held by the samplers, then flush the sink, giving up
+// on samples that can't be sent within the drain timeout.
+func shutdown(samplers []util.Sampler, sink util.SampleWriter) {
+  for _, sampler := range samplers {
+    if c, ok := sampler.(io.Closer); ok {
+      c.Close()
+    }
+  }
+  if c, ok := sink.(util.ClosingSampleWriter); ok {
+    if err := c.Close(time.Duration(drainTimeout) * time.Second); err != nil {
+      log.Printf("could not flush samples: %s\n", err)
+    }
+  }
+}
+
+// Gather samples from every sampler.
+func sampleAll(samplers []util.Sampler) {
+  for _, sampler := range samplers {
+    if err := sampler.Sample(); err != nil {
+      log.Printf("error during sampling: %s\n", err)
+    }
+  }
+}
+
+// Run every host sampler over each tick recorded in the given replay
+// filesystem, as fast as possible. The hostname and tags are taken from the
+// first tick, as they were when it was recorded.
+func replayAll(replay *util.ReplayFS, cfg *Config) {
+  ok, err := replay.Next()
+  if !ok || err != nil {
+    log.Fatalf("could not load recorded snapshot: %v\n", err)
+  }
+  sink := newSink(replay, replay)
+  defer shutdown(nil, sink)
+  tags := newTagSet()
+  if global, err := globalTags(replay, cfg); err != nil {
+    log.Fatalf("could not determine tags: %s\n", err)
+  } else {
+    tags.Set(global, cfg.SamplerTags)
+  }
+  samplers := newSamplers(replay, sink, tags, &Config{})
+  for ok {
+    sampleAll(samplers)
+    if ok, err = replay.Next(); err != nil {
+      log.Fatalf("could not load recorded snapshot: %s\n", err)
+    }
+  }
+}
+
+// Create the sink to which samples are written, stamping them with their
+// measurement time by the given clock: the console, unless they're sent to
+// any of collectors, InfluxDB and OTLP.
+func newSink(clock util.Clock, opener util.Opener) util.SampleWriter {
+  if collectorAddr == "" && influxDest == "" && otlpEndpoint == "" {
+    return &util.ConsoleSampleWriter{Clock: clock}
+  }
+  host, err := linux.Hostname(opener)
+  if err != nil {
+    log.Fatalf("could not determine hostname: %s\n", err)
+  }
+  sinks := make(util.FanoutSampleWriter, 0, 3)
+  if collectorAddr != "" {
+    sinks = append(sinks, newCollectorSink(clock, host))
+  }
+  if influxDest != "" {
+    w, err := util.NewInfluxSampleWriter(influxDest, host)
+    if err != nil {
+      log.Fatalf("could not open InfluxDB destination: %s\n", err)
+    }
+    w.Clock = clock
+    w.BatchSize = batchSize
+    w.FlushWindow = time.Duration(flushWindow) * time.Millisecond
+    sinks = append(sinks, w)
+  }
+  if otlpEndpoint != "" {
+    w := util.NewOTLPSampleWriter(otlpEndpoint, host)
+    w.Clock = clock
+    w.BatchSize = batchSize
+    w.FlushWindow = time.Duration(flushWindow) * time.Millisecond
+    w.Delta = otlpDelta
+    sinks = append(sinks, w)
+  }
+  if len(sinks) == 1 {
+    return sinks[0]
+  }
+  return sinks
+}
+
+// Create the sink sending samples for the given host to the collectors.
+func newCollectorSink(clock util.Clock, host string) util.SampleWriter {
+  var reloader *util.TLSReloader
+  if tlsFiles != (util.TLSFiles{}) {
+    var err error
+    if reloader, err = util.NewTLSReloader(tlsFiles); err != nil {
+      log.Fatalf("could not load TLS files: %s\n", err)
+    }
+  }
+  addrs := make([]string, 0)
+  for _, addr := range strings.Split(collectorAddr, ",") {
+    if addr = strings.TrimSpace(addr); addr != "" {
+      addrs = append(addrs, addr)
+    }
+  }
+  if len(addrs) == 0 {
+    log.Fatalf("no collector addresses given\n")
+  }
+  newWriter := func(addr string) *util.NetSampleWriter {
+    w := util.NewNetSampleWriter(addr, host)
+    w.Clock = clock
+    w.TLS = reloader
+    w.Interval = time.Duration(sampleInterval) * time.Second
+    w.BatchSize = batchSize
+    w.FlushWindow = time.Duration(flushWindow) * time.Millisecond
+    if !compress {
+      w.Compression = nil
+    }
+    return w
+  }
+  switch collectorMode {
+  case "fanout":
+    fanout := make(util.FanoutSampleWriter, 0, len(addrs))
+    for _, addr := range addrs {
+      fanout = append(fanout, newWriter(addr))
+    }
+    return fanout
+  case "shard":
+    addrs = util.ShardCollectors(addrs, host)
+  case "failover":
+  default:
+    log.Fatalf("unknown collector mode: %s\n", collectorMode)
+  }
+  w := newWriter(addrs[0])
+  w.Failover = addrs[1:]
+  return w
+}
+
+// Reload the configuration file and apply it to the given samplers and
+// tags. The current configuration is kept if the file can't be loaded.
+func reload(samplers []util.Sampler, tags *tagSet, opener util.Opener) {
+  if configPath == "" {
+    log.Printf("no configuration file to reload\n")
+    return
+  }
+  cfg, err := loadConfig(configPath)
+  var global util.Tags
+  if err == nil {
+    global, err = globalTags(opener, cfg)
+  }
+  if err == nil {
+    err = reconfigure(samplers, cfg)
+  }
+  if err == nil {
+    tags.Set(global, cfg.SamplerTags)
+  }
+  if err != nil {
+    log.Printf("could not reload configuration: %s\n", err)
+    return
+  }
+  log.Printf("reloaded configuration from %s\n", configPath)
 }
 
 func main() {
   flag.Parse()
+  cfg := &Config{}
+  if configPath != "" {
+    var err error
+    if cfg, err = loadConfig(configPath); err != nil {
+      log.Fatalf("could not load configuration: %s\n", err)
+    }
+  }
+  if replayDir != "" {
+    replay, err := util.NewReplayFS(replayDir)
+    if err != nil {
+      log.Fatalf("could not open recording: %s\n", err)
+    }
+    log.Printf("agent started: replaying snapshots from %s\n", replayDir)
+    replayAll(replay, cfg)
+    return
+  }
+  opener, err := hostFileSystem(hostRoot, hostProc, hostSys, hostEtc)
+  if err != nil {
+    log.Fatalf("could not find host: %s\n", err)
+  }
+  // Record from the start, so that the hostname and tags are replayed too.
+  var recorder *util.RecordingFS
+  if recordDir != "" {
+    if err := os.MkdirAll(recordDir, 0755); err != nil {
+      log.Fatalf("could not create recording directory: %s\n", err)
+    }
+    log.Printf("recording snapshots to %s\n", recordDir)
+    recorder = util.NewRecordingFS(opener, recordDir)
+    recorder.Tick(time.Now())
+    opener = recorder
+  }
+  clock := util.NewTickClock(time.Now())
+  sink := newSink(clock, opener)
   signalChan := make(chan os.Signal, 1)
-  signal.Notify(signalChan, os.Interrupt, os.Kill)
+  signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
   log.Printf("agent started: sampling every %d seconds\n", sampleInterval)
-  ticker := time.NewTicker(time.Duration(sampleInterval) * time.Second)
-  sampler := linux.NewStandardSampler(util.NewFileOpener(),
-                                      util.NewConsoleSampleWriter())
-  if err := sampler.Init(); err != nil {
-    log.Fatalf("could not initialize sampler: %s\n", err)
+  ticker := util.NewTicker(time.Duration(sampleInterval) * time.Second,
+                           time.Duration(sampleJitter) * time.Second)
+  tags := newTagSet()
+  if global, err := globalTags(opener, cfg); err != nil {
+    log.Fatalf("could not determine tags: %s\n", err)
+  } else {
+    tags.Set(global, cfg.SamplerTags)
   }
+  counter := newCountingWriter(sink)
+  base := newSamplers(opener, counter, tags, cfg)
+  samplers, telemetry := withTelemetry(base, counter, tags)
   for {
     select {
-    case <-ticker.C:
-      if err := sampler.Sample(); err != nil {
-        log.Printf("error during sampling: %s\n", err)
+    case tick := <-ticker.C:
+      if tick.Missed > 0 {
+        log.Printf("missed %d ticks before %s\n", tick.Missed, tick.Time)
+      }
+      telemetry.Tick(tick)
+      clock.Set(tick.Time)
+      if recorder != nil {
+        recorder.Tick(tick.Time)
+      }
+      sampleAll(samplers)
+      if recorder != nil {
+        if err := recorder.Flush(); err != nil {
+          log.Printf("error recording snapshot: %s\n", err)
+        }
       }
     case s := <-signalChan:
+      if s == syscall.SIGHUP {
+        reload(base, tags, opener)
+        continue
+      }
       log.Printf("caught signal %s: shutting down\n", s)
+      ticker.Stop()
+      shutdown(base, sink)
       return
     }
   }
 }
-
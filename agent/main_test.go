@@ -0,0 +1,35 @@
+package main
+
+import (
+  "github.com/bmizerany/assert"
+  "testing"
+  "../util"
+)
+
+func Test_hostFileSystem_should_take_namespaces_from_host_proc(t *testing.T) {
+  fs, err := hostFileSystem("/", "", "", "")
+  assert.Equal(t, nil, err)
+  _, ok := fs.(*util.FileOpener)
+  assert.Equal(t, true, ok)
+
+  fs, _ = hostFileSystem("/host", "", "/host-sys", "")
+  root := fs.(*util.RootFS)
+  assert.Equal(t, "/host/proc/1/net/tcp", root.Resolve("/proc/net/tcp"))
+  assert.Equal(t, "/host/proc/1/mounts", root.Resolve("/etc/mtab"))
+  assert.Equal(t, "/host-sys/class/hwmon", root.Resolve("/sys/class/hwmon"))
+  assert.Equal(t, "/host/data", root.ResolveMount("/data"))
+
+  fs, _ = hostFileSystem("/", "/host/proc", "/host/sys", "/host/etc")
+  root = fs.(*util.RootFS)
+  assert.Equal(t, "/host/proc/stat", root.Resolve("/proc/stat"))
+  assert.Equal(t, "/host/proc/1/net/tcp", root.Resolve("/proc/net/tcp"))
+  assert.Equal(t, "/host/proc/1/mounts", root.Resolve("/etc/mtab"))
+  assert.Equal(t, "/host/etc/hostname", root.Resolve("/etc/hostname"))
+  assert.Equal(t, "/host/proc/1/root/data", root.ResolveMount("/data"))
+
+  // Without the host's /proc, namespaces would be taken from our own.
+  for _, dirs := range [][]string{{"/host/sys", ""}, {"", "/host/etc"}} {
+    _, err = hostFileSystem("/", "", dirs[0], dirs[1])
+    assert.NotEqual(t, nil, err)
+  }
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+  "os"
+  "sync"
+  "./linux"
+  "../util"
+)
+
+// Tags merged into the samples of every sampler, which can be replaced
+// when the configuration is reloaded.
+type tagSet struct {
+  mu       sync.RWMutex
+  global   util.Tags
+  samplers map[string]util.Tags
+  merged   map[string]util.Tags
+}
+
+// Create a new, empty set of tags.
+func newTagSet() *tagSet {
+  return &tagSet{global: make(util.Tags), merged: make(map[string]util.Tags)}
+}
+
+// Replace the tags given to every sampler, and those given to particular
+// samplers by name.
+func (ts *tagSet) Set(global util.Tags, samplers map[string]util.Tags) {
+  ts.mu.Lock()
+  defer ts.mu.Unlock()
+  ts.global, ts.samplers = global, samplers
+  ts.merged = make(map[string]util.Tags)
+  for name, tags := range samplers {
+    ts.merged[name] = global.Merge(tags)
+  }
+}
+
+// Returns the tags for the named sampler. The result mustn't be modified.
+func (ts *tagSet) For(name string) util.Tags {
+  ts.mu.RLock()
+  defer ts.mu.RUnlock()
+  if tags, ok := ts.merged[name]; ok {
+    return tags
+  }
+  return ts.global
+}
+
+// Writes the samples of a single sampler on to another sink, along with
+// its tags.
+type taggingWriter struct {
+  sink util.SampleWriter
+  tags *tagSet
+  name string
+}
+
+// Write the given sample on to the sink with the sampler's tags.
+func (w *taggingWriter) Write(v ...interface{}) {
+  if tags := w.tags.For(w.name); len(tags) > 0 {
+    v = append(v, tags)
+  }
+  w.sink.Write(v...)
+}
+
+// Work out the tags given to every sampler: those discovered from the
+// host, overridden by those in the configured tags file, overridden in turn
+// by those in the configuration itself.
+func globalTags(opener util.Opener, cfg *Config) (util.Tags, error) {
+  tags, err := linux.HostTags(opener)
+  if err != nil {
+    return nil, err
+  }
+  if cfg.TagsFile != "" {
+    f, err := os.Open(cfg.TagsFile)
+    if err != nil {
+      return nil, err
+    }
+    defer f.Close()
+    fileTags, err := util.ReadTags(f)
+    if err != nil {
+      return nil, err
+    }
+    tags = tags.Merge(fileTags)
+  }
+  return tags.Merge(cfg.Tags), nil
+}
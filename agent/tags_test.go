@@ -0,0 +1,23 @@
+package main
+
+import (
+  "github.com/bmizerany/assert"
+  "testing"
+  "../util"
+)
+
+func Test_taggingWriter_should_apply_per_sampler_overrides(t *testing.T) {
+  wr := &BufferedSampleWriter{}
+  tags := newTagSet()
+  tags.Set(util.Tags{"env": "prod", "team": "infra"},
+           map[string]util.Tags{"exec": {"team": "payments"}})
+  (&taggingWriter{sink: wr, tags: tags, name: "standard"}).Write("uptime", 10)
+  (&taggingWriter{sink: wr, tags: tags, name: "exec"}).Write("app.up", 1)
+  tags.Set(util.Tags{}, nil)
+  (&taggingWriter{sink: wr, tags: tags, name: "exec"}).Write("app.up", 1)
+  assert.Equal(t, []string{
+    "uptime 10 env=prod,team=infra\n",
+    "app.up 1 env=prod,team=payments\n",
+    "app.up 1\n",
+  }, wr.Lines)
+}
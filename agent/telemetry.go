@@ -0,0 +1,154 @@
+package main
+
+import (
+  "fmt"
+  "runtime"
+  "strings"
+  "sync/atomic"
+  "syscall"
+  "time"
+  "../util"
+)
+
+// Writes samples on to another sink, counting them along the way.
+type countingWriter struct {
+  sink  util.SampleWriter
+  count uint64
+}
+
+// Create a new counting writer in front of the given sink.
+func newCountingWriter(s util.SampleWriter) *countingWriter {
+  return &countingWriter{sink: s}
+}
+
+// Write the given sample on to the sink.
+func (c *countingWriter) Write(v ...interface{}) {
+  atomic.AddUint64(&c.count, 1)
+  c.sink.Write(v...)
+}
+
+// Returns the number of samples written so far.
+func (c *countingWriter) Count() uint64 {
+  return atomic.LoadUint64(&c.count)
+}
+
+// Sampler wrapper recording how long each sample takes, how many samples
+// are written and how often sampling fails.
+type timedSampler struct {
+  util.Sampler
+  name     string
+  counter  *countingWriter
+  duration time.Duration
+  samples  uint64
+  errors   uint64
+}
+
+// Gather samples from the wrapped sampler.
+func (ts *timedSampler) Sample() (err error) {
+  start, count := time.Now(), ts.counter.Count()
+  err = ts.Sampler.Sample()
+  ts.duration = time.Since(start)
+  ts.samples = ts.counter.Count() - count
+  if err != nil {
+    ts.errors++
+  }
+  return
+}
+
+// Interface for samplers that may have nothing to sample, e.g. because the
+// host lacks a feature or nothing was configured.
+type enabler interface {
+  Enabled() bool
+}
+
+// Returns a short name for a sampler, e.g. "socket" for a SocketSampler.
+func samplerName(s util.Sampler) string {
+  name := fmt.Sprintf("%T", s)
+  name = name[strings.LastIndex(name, ".") + 1:]
+  return strings.ToLower(strings.TrimSuffix(name, "Sampler"))
+}
+
+// Sampler for metrics about the agent itself: the cost and outcome of
+// running every other sampler, the state of the sink, and the agent's Go
+// runtime and process resource usage.
+type TelemetrySampler struct {
+  sink     util.SampleWriter
+  stats    util.StatsSampleWriter
+  samplers []*timedSampler
+  missed   uint64
+}
+
+// Wrap the given samplers, all writing to the given counting writer, so
+// that their cost can be reported. Returns the wrapped samplers followed by
+// a sampler reporting on them with the given tags, along with that sampler.
+// The stats of the sink are reported too when it provides any.
+func withTelemetry(samplers []util.Sampler, counter *countingWriter, tags *tagSet) ([]util.Sampler, *TelemetrySampler) {
+  telemetry := &TelemetrySampler{
+    sink: &taggingWriter{sink: counter, tags: tags, name: "telemetry"},
+  }
+  telemetry.stats, _ = counter.sink.(util.StatsSampleWriter)
+  rv := make([]util.Sampler, 0, len(samplers) + 1)
+  for _, sampler := range samplers {
+    ts := &timedSampler{Sampler: sampler, name: samplerName(sampler), counter: counter}
+    telemetry.samplers = append(telemetry.samplers, ts)
+    rv = append(rv, ts)
+  }
+  return append(rv, telemetry), telemetry
+}
+
+// Record a sampling tick, counting any ticks missed before it.
+func (tel *TelemetrySampler) Tick(tick util.Tick) {
+  tel.missed += uint64(tick.Missed)
+}
+
+// Initialize this sampler.
+func (tel *TelemetrySampler) Init() (err error) {
+  return
+}
+
+// Report on the agent's most recent round of sampling, and its resource
+// usage so far.
+func (tel *TelemetrySampler) Sample() (err error) {
+  for _, ts := range tel.samplers {
+    if e, ok := ts.Sampler.(enabler); ok && !e.Enabled() {
+      continue
+    }
+    tel.sink.Write("agent.sampler",
+                   ts.name,
+                   ts.duration.Seconds(),
+                   ts.samples,
+                   ts.errors)
+  }
+  if tel.stats != nil {
+    stats := tel.stats.Stats()
+    tel.sink.Write("agent.sink",
+                   stats.Queued,
+                   stats.Sent,
+                   stats.Dropped,
+                   stats.Failed,
+                   stats.Batches,
+                   stats.RawBytes,
+                   stats.WireBytes)
+  }
+  tel.sink.Write("agent.ticks", tel.missed)
+  var mem runtime.MemStats
+  runtime.ReadMemStats(&mem)
+  var usage syscall.Rusage
+  if err = syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+    return
+  }
+  tel.sink.Write("agent.runtime",
+                 runtime.NumGoroutine(),
+                 mem.HeapAlloc,
+                 mem.HeapSys,
+                 mem.NumGC,
+                 timevalSeconds(usage.Utime),
+                 timevalSeconds(usage.Stime),
+                 usage.Maxrss)
+  return
+}
+
+// Convert a timeval into seconds.
+func timevalSeconds(tv syscall.Timeval) float64 {
+  return float64(tv.Sec) + float64(tv.Usec) / 1e6
+}
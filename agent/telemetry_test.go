@@ -0,0 +1,69 @@
+package main
+
+import (
+  "errors"
+  "fmt"
+  "github.com/bmizerany/assert"
+  "strings"
+  "testing"
+  "../util"
+)
+
+type BufferedSampleWriter struct {
+  Lines []string
+}
+
+func (b *BufferedSampleWriter) Write(v ...interface{}) {
+  b.Lines = append(b.Lines, fmt.Sprintln(v...))
+}
+
+type FakeSampler struct {
+  sink    util.SampleWriter
+  samples int
+  err     error
+}
+
+func (f *FakeSampler) Init() error {
+  return nil
+}
+
+func (f *FakeSampler) Sample() error {
+  for i := 0; i < f.samples; i++ {
+    f.sink.Write("fake", i)
+  }
+  return f.err
+}
+
+func Test_TelemetrySampler_should_report_on_each_sampler(t *testing.T) {
+  wr := &BufferedSampleWriter{}
+  counter := newCountingWriter(wr)
+  samplers, telemetry := withTelemetry([]util.Sampler{
+    &FakeSampler{sink: counter, samples: 2},
+    &FakeSampler{sink: counter, err: errors.New("broken")},
+  }, counter, newTagSet())
+  assert.Equal(t, 3, len(samplers))
+  telemetry.Tick(util.Tick{Missed: 2})
+  for i := 0; i < 2; i++ {
+    for _, sampler := range samplers {
+      sampler.Sample()
+    }
+  }
+  reports := make([]string, 0)
+  for _, line := range wr.Lines {
+    if strings.HasPrefix(line, "agent.sampler ") {
+      fields := strings.Fields(line)
+      reports = append(reports, fields[1] + " " + fields[3] + " " + fields[4])
+    }
+  }
+  assert.Equal(t, []string{
+    "fake 2 0", "fake 0 1",
+    "fake 2 0", "fake 0 2",
+  }, reports)
+  assert.Equal(t, "agent.ticks 2\n", wr.Lines[len(wr.Lines) - 2])
+  assert.Equal(t, true, strings.HasPrefix(wr.Lines[len(wr.Lines) - 1], "agent.runtime "))
+}
+
+func Test_samplerName_should_strip_package_and_suffix(t *testing.T) {
+  assert.Equal(t, "fake", samplerName(&FakeSampler{}))
+  assert.Equal(t, "telemetry", samplerName(&TelemetrySampler{}))
+}
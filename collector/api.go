@@ -0,0 +1,150 @@
+package main
+
+import (
+  "encoding/json"
+  "fmt"
+  "log"
+  "net/http"
+  "sort"
+  "strconv"
+  "time"
+  "../util"
+)
+
+// Serves the collector's query API and the dashboard built on it over HTTP:
+//
+//   GET /api/hosts                  every host, with its status and when it
+//                                   last reported
+//   GET /api/events                 recent changes in the status of hosts,
+//                                   optionally filtered with since=T
+//   GET /api/series?name=N          series named N, optionally filtered with
+//                                   host=H, since=T (a duration before now or
+//                                   Unix time) and rate=1 (counters as
+//                                   per-second rates)
+//   GET /                           the dashboard
+type API struct {
+  store    *Store
+  liveness *Liveness
+  mux      *http.ServeMux
+}
+
+// Create a new API serving from the given store and liveness tracker.
+func NewAPI(store *Store, liveness *Liveness) *API {
+  api := &API{store: store, liveness: liveness, mux: http.NewServeMux()}
+  api.mux.HandleFunc("/api/hosts", api.hosts)
+  api.mux.HandleFunc("/api/events", api.events)
+  api.mux.HandleFunc("/api/series", api.series)
+  api.mux.HandleFunc("/", api.dashboard)
+  return api
+}
+
+// Handle an HTTP request.
+func (api *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+  if r.Method != "GET" && r.Method != "HEAD" {
+    http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+    return
+  }
+  api.mux.ServeHTTP(w, r)
+}
+
+// List every host that has reported, by name.
+func (api *API) hosts(w http.ResponseWriter, r *http.Request) {
+  writeJSON(w, api.liveness.Hosts())
+}
+
+// List recent changes in the status of hosts.
+func (api *API) events(w http.ResponseWriter, r *http.Request) {
+  since, err := parseSince(r.URL.Query().Get("since"), time.Now())
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  }
+  writeJSON(w, api.liveness.Events(since))
+}
+
+// Return the series matching the query.
+func (api *API) series(w http.ResponseWriter, r *http.Request) {
+  q := r.URL.Query()
+  name := q.Get("name")
+  if name == "" {
+    http.Error(w, "name is required", http.StatusBadRequest)
+    return
+  }
+  since, err := parseSince(q.Get("since"), time.Now())
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  }
+  rv := api.store.Find(q.Get("host"), name, since)
+  if q.Get("rate") == "1" {
+    for _, series := range rv {
+      series.Points = rates(series.Name, series.Points)
+    }
+  }
+  sort.Slice(rv, func(i, j int) bool {
+    if rv[i].Host != rv[j].Host {
+      return rv[i].Host < rv[j].Host
+    }
+    return rv[i].Tags.String() < rv[j].Tags.String()
+  })
+  writeJSON(w, rv)
+}
+
+// Serve the dashboard page.
+func (api *API) dashboard(w http.ResponseWriter, r *http.Request) {
+  if r.URL.Path != "/" {
+    http.NotFound(w, r)
+    return
+  }
+  w.Header().Set("Content-Type", "text/html; charset=utf-8")
+  fmt.Fprint(w, dashboardHTML)
+}
+
+// Parse the start of a query's time range: empty for all time, a duration
+// before now, or a Unix time in seconds.
+func parseSince(raw string, now time.Time) (time.Time, error) {
+  if raw == "" {
+    return time.Time{}, nil
+  }
+  if d, err := time.ParseDuration(raw); err == nil {
+    return now.Add(-d), nil
+  }
+  secs, err := strconv.ParseInt(raw, 10, 64)
+  if err != nil {
+    return time.Time{}, fmt.Errorf("bad since: %q", raw)
+  }
+  return time.Unix(secs, 0), nil
+}
+
+// Convert the counter fields of a series' points to per-second rates over
+// the interval before each point, leaving gauges as they are. The first
+// point has no rate and is dropped, as are rates across counter resets.
+func rates(name string, points []Point) []Point {
+  schema := util.Schemas[name]
+  rv := make([]Point, 0, len(points))
+  for i := 1; i < len(points); i++ {
+    prev, cur := points[i - 1], points[i]
+    secs := cur.Time.Sub(prev.Time).Seconds()
+    if secs <= 0 {
+      continue
+    }
+    fields := make(map[string]float64, len(cur.Fields))
+    for field, value := range cur.Fields {
+      if !schema.IsCounter(field) {
+        fields[field] = value
+      } else if last, ok := prev.Fields[field]; ok && value >= last {
+        fields[field] = (value - last) / secs
+      }
+    }
+    rv = append(rv, Point{Time: cur.Time, Fields: fields})
+  }
+  return rv
+}
+
+// Write the given value as a JSON response.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+  w.Header().Set("Content-Type", "application/json")
+  if err := json.NewEncoder(w).Encode(v); err != nil {
+    log.Printf("could not write response: %s\n", err)
+  }
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+  "encoding/json"
+  "github.com/bmizerany/assert"
+  "io/ioutil"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "testing"
+  "time"
+  "../util"
+)
+
+func getJSON(t *testing.T, url string, v interface{}) int {
+  resp, err := http.Get(url)
+  if err != nil {
+    t.Fatalf("GET %s failed: %s", url, err)
+  }
+  defer resp.Body.Close()
+  if resp.StatusCode == http.StatusOK {
+    if err = json.NewDecoder(resp.Body).Decode(v); err != nil {
+      t.Fatalf("GET %s: bad response: %s", url, err)
+    }
+  }
+  return resp.StatusCode
+}
+
+func Test_API_should_list_hosts_with_status(t *testing.T) {
+  now := time.Now()
+  liveness := NewLiveness()
+  liveness.Seen("web2", time.Minute, now.Add(-10 * time.Minute))
+  liveness.Seen("web1", 0, now.Add(-10 * time.Second))
+  liveness.Check(now)
+  server := httptest.NewServer(NewAPI(NewStore(time.Hour), liveness))
+  defer server.Close()
+
+  var hosts []HostStatus
+  assert.Equal(t, http.StatusOK, getJSON(t, server.URL + "/api/hosts", &hosts))
+  assert.Equal(t, 2, len(hosts))
+  assert.Equal(t, "web1", hosts[0].Host)
+  assert.Equal(t, "up", hosts[0].Status)
+  assert.Equal(t, 10.0, hosts[0].Interval)
+  assert.Equal(t, "web2", hosts[1].Host)
+  assert.Equal(t, "down", hosts[1].Status)
+  assert.Equal(t, 10, hosts[1].Missed)
+
+  var events []HostEvent
+  url := server.URL + "/api/events"
+  assert.Equal(t, http.StatusOK, getJSON(t, url, &events))
+  assert.Equal(t, 3, len(events))
+  assert.Equal(t, "web2", events[2].Host)
+  assert.Equal(t, "up", events[2].From)
+  assert.Equal(t, "down", events[2].To)
+  assert.Equal(t, http.StatusOK, getJSON(t, url + "?since=1s", &events))
+  assert.Equal(t, 1, len(events))
+}
+
+func Test_API_should_return_series_with_counters_as_rates(t *testing.T) {
+  now := time.Now().Truncate(time.Second)
+  store := NewStore(time.Hour)
+  for i, rx := range []float64{1000, 3000, 500} {
+    store.Add(&util.Sample{
+      Host: "web1",
+      Name: "net",
+      Tags: util.Tags{"interface": "eth0"},
+      Fields: map[string]float64{"rx_bytes": rx},
+    }, now.Add(time.Duration(i * 10 - 30) * time.Second))
+  }
+  server := httptest.NewServer(NewAPI(store, NewLiveness()))
+  defer server.Close()
+
+  var series []*Series
+  url := server.URL + "/api/series?name=net&host=web1"
+  assert.Equal(t, http.StatusOK, getJSON(t, url, &series))
+  assert.Equal(t, 1, len(series))
+  assert.Equal(t, 3, len(series[0].Points))
+
+  assert.Equal(t, http.StatusOK, getJSON(t, url + "&since=25s", &series))
+  assert.Equal(t, 2, len(series[0].Points))
+
+  series = nil
+  assert.Equal(t, http.StatusOK, getJSON(t, url + "&rate=1", &series))
+  assert.Equal(t, 2, len(series[0].Points))
+  assert.Equal(t, 200.0, series[0].Points[0].Fields["rx_bytes"])
+  _, ok := series[0].Points[1].Fields["rx_bytes"]
+  assert.Equal(t, false, ok)
+
+  assert.Equal(t, http.StatusBadRequest, getJSON(t, url + "&since=soon", &series))
+  assert.Equal(t, http.StatusBadRequest, getJSON(t, server.URL + "/api/series", &series))
+}
+
+func Test_API_should_serve_dashboard(t *testing.T) {
+  server := httptest.NewServer(NewAPI(NewStore(time.Hour), NewLiveness()))
+  defer server.Close()
+  resp, err := http.Get(server.URL + "/")
+  if err != nil {
+    t.Fatalf("GET / failed: %s", err)
+  }
+  body, _ := ioutil.ReadAll(resp.Body)
+  resp.Body.Close()
+  assert.Equal(t, http.StatusOK, resp.StatusCode)
+  assert.Equal(t, true, strings.Contains(string(body), "/api/hosts"))
+
+  resp, _ = http.Get(server.URL + "/missing")
+  resp.Body.Close()
+  assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+  "bufio"
+  "crypto/tls"
+  "io"
+  "log"
+  "net"
+  "sync"
+  "time"
+  "../util"
+)
+
+// Receives samples from agents, storing them along with the rollups
+// computed from them.
+type Collector struct {
+  // Forwarders to which received samples are passed on.
+  Forwarders       []*Forwarder
+  // When each host last reported.
+  Liveness         *Liveness
+  // Longest an agent may take to connect and introduce itself.
+  HandshakeTimeout time.Duration
+  mu               sync.Mutex
+  store            *Store
+  rollups          []*Rollup
+}
+
+// Create a new collector storing samples in the given store.
+func NewCollector(store *Store, rollups []*Rollup) *Collector {
+  return &Collector{
+    Liveness: NewLiveness(),
+    HandshakeTimeout: 10 * time.Second,
+    store: store,
+    rollups: rollups,
+  }
+}
+
+// Store a sample received at the given time, and feed it to the rollups
+// and forwarders.
+// Samples are stored at the time they were measured, if the agent stamped
+// them, or else the time they were received.
+func (c *Collector) Ingest(s *util.Sample, t time.Time) {
+  if s.Time.IsZero() {
+    s.Time = t
+  }
+  c.store.Add(s, s.Time)
+  for _, f := range c.Forwarders {
+    f.Forward(s)
+  }
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  for _, rollup := range c.rollups {
+    rollup.Observe(s, t)
+  }
+}
+
+// Compute every rollup that's due and store the results, along with the
+// changes in the status of hosts, then expire old points.
+func (c *Collector) Tick(now time.Time) {
+  c.mu.Lock()
+  results := make([]*util.Sample, 0)
+  for _, rollup := range c.rollups {
+    if rollup.Due(now) {
+      results = append(results, rollup.Compute(now)...)
+    }
+  }
+  c.mu.Unlock()
+  for _, sample := range results {
+    c.store.Add(sample, now)
+  }
+  for _, event := range c.Liveness.Check(now) {
+    if event.To == hostMoved {
+      log.Printf("host %s has left: its agent disconnected cleanly\n", event.Host)
+    } else if event.From != "" || event.To != hostUp {
+      log.Printf("host %s is %s: last seen %s ago\n", event.Host, event.To,
+                 now.Sub(event.LastSeen).Round(time.Second))
+    }
+    sample := event.Sample()
+    c.store.Add(sample, now)
+    for _, f := range c.Forwarders {
+      f.Forward(sample)
+    }
+  }
+  c.store.Expire(now)
+}
+
+// Accept agent connections on the given listener until it's closed.
+func (c *Collector) Serve(l net.Listener) error {
+  for {
+    conn, err := l.Accept()
+    if err != nil {
+      return err
+    }
+    go c.handle(conn)
+  }
+}
+
+// Receive samples from a single agent connection. Agents connecting over
+// TLS are identified by their certificate's common name, whatever host
+// they claim to be.
+func (c *Collector) handle(conn net.Conn) {
+  defer conn.Close()
+  var identity string
+  if tc, ok := conn.(*tls.Conn); ok {
+    var err error
+    if identity, err = util.PeerName(tc, c.HandshakeTimeout); err != nil {
+      log.Printf("%s: TLS handshake failed: %s\n", conn.RemoteAddr(), err)
+      return
+    }
+  }
+  // Don't let clients that never introduce themselves hold on to the
+  // connection.
+  conn.SetDeadline(time.Now().Add(c.HandshakeTimeout))
+  r := bufio.NewReader(conn)
+  var hello util.Hello
+  if err := util.ReadMessage(r, &hello); err != nil || hello.Host == "" {
+    log.Printf("%s: bad hello: %v\n", conn.RemoteAddr(), err)
+    return
+  }
+  if hello.Version != util.ProtocolVersion {
+    log.Printf("%s: unsupported protocol version %d\n", conn.RemoteAddr(),
+               hello.Version)
+    return
+  }
+  if identity != "" && identity != hello.Host {
+    log.Printf("%s: agent for %s identified as %s\n", conn.RemoteAddr(),
+               hello.Host, identity)
+    hello.Host = identity
+  }
+  welcome := &util.Welcome{
+    Compression: util.NegotiateCompression(hello.Compression),
+  }
+  if err := util.WriteMessage(conn, welcome); err != nil {
+    log.Printf("%s: %s\n", conn.RemoteAddr(), err)
+    return
+  }
+  conn.SetDeadline(time.Time{})
+  log.Printf("%s: agent connected for %s\n", conn.RemoteAddr(), hello.Host)
+  interval := time.Duration(hello.Interval * float64(time.Second))
+  c.Liveness.Seen(hello.Host, interval, time.Now())
+  c.Liveness.Connected(hello.Host)
+  for {
+    samples, err := util.ReadBatch(r, welcome.Compression)
+    if err == util.ErrGoodbye {
+      log.Printf("%s: agent for %s left\n", conn.RemoteAddr(), hello.Host)
+      c.Liveness.Disconnected(hello.Host, true, time.Now())
+      return
+    } else if err == io.EOF {
+      // Without a goodbye, the agent may have crashed or been killed.
+      log.Printf("%s: agent for %s disconnected\n", conn.RemoteAddr(), hello.Host)
+      c.Liveness.Disconnected(hello.Host, false, time.Now())
+      return
+    } else if err != nil {
+      log.Printf("%s: %s\n", conn.RemoteAddr(), err)
+      c.Liveness.Disconnected(hello.Host, false, time.Now())
+      return
+    }
+    now := time.Now()
+    c.Liveness.Seen(hello.Host, interval, now)
+    for _, sample := range samples {
+      // Agents may only report for the host they introduced themselves as.
+      sample.Host = hello.Host
+      c.Ingest(sample, now)
+    }
+  }
+}
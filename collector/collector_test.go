@@ -0,0 +1,203 @@
+package main
+
+import (
+  "crypto/tls"
+  "github.com/bmizerany/assert"
+  "io"
+  "net"
+  "testing"
+  "time"
+  "../util"
+  "../util/testpki"
+)
+
+func Test_Collector_should_store_samples_and_rollups_from_agents(t *testing.T) {
+  rollup, _ := NewRollup(RollupConfig{
+    Name: "all.load",
+    Metric: "load",
+    Fields: []string{"load1"},
+    Aggregates: []string{"sum"},
+  })
+  store := NewStore(time.Hour)
+  collector := NewCollector(store, []*Rollup{rollup})
+  l, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatalf("could not listen: %s", err)
+  }
+  defer l.Close()
+  go collector.Serve(l)
+
+  for _, host := range []string{"web1", "web2"} {
+    w := util.NewNetSampleWriter(l.Addr().String(), host)
+    if host == "web2" {
+      w.Compression = nil
+    }
+    w.Write("load", 1.5, 1.0, 0.5, uint64(120))
+    w.Close(5 * time.Second)
+    stats := w.Stats()
+    assert.Equal(t, uint64(1), stats.Sent)
+    assert.Equal(t, uint64(1), stats.Batches)
+  }
+  deadline := time.Now().Add(5 * time.Second)
+  for len(store.Find("", "load", time.Time{})) < 2 {
+    if time.Now().After(deadline) {
+      t.Fatalf("samples never arrived")
+    }
+    time.Sleep(10 * time.Millisecond)
+  }
+  series := store.Find("web2", "load", time.Time{})
+  assert.Equal(t, 1, len(series))
+  assert.Equal(t, 120.0, series[0].Points[0].Fields["procs"])
+
+  collector.Tick(time.Now())
+  series = store.Find("", "all.load", time.Time{})
+  assert.Equal(t, 1, len(series))
+  assert.Equal(t, "", series[0].Host)
+  assert.Equal(t, 3.0, series[0].Points[0].Fields["load1.sum"])
+}
+
+func Test_Store_should_expire_old_points(t *testing.T) {
+  store := NewStore(time.Minute)
+  t0 := time.Unix(1000, 0)
+  sample := &util.Sample{Host: "web1", Name: "uptime",
+                         Fields: map[string]float64{"seconds": 1}}
+  store.Add(sample, t0)
+  store.Add(sample, t0.Add(30 * time.Second))
+  assert.Equal(t, 2, len(store.Find("web1", "uptime", time.Time{})[0].Points))
+  store.Expire(t0.Add(75 * time.Second))
+  assert.Equal(t, 1, len(store.Find("web1", "uptime", time.Time{})[0].Points))
+  store.Expire(t0.Add(time.Hour))
+  assert.Equal(t, 0, len(store.Find("web1", "uptime", time.Time{})))
+}
+
+func Test_Collector_should_take_over_from_unreachable_primary(t *testing.T) {
+  stores := make([]*Store, 0)
+  serve := func(addr string) net.Listener {
+    l, err := net.Listen("tcp", addr)
+    if err != nil {
+      t.Fatalf("could not listen: %s", err)
+    }
+    store := NewStore(time.Hour)
+    stores = append(stores, store)
+    go NewCollector(store, nil).Serve(l)
+    return l
+  }
+  secondary := serve("127.0.0.1:0")
+  defer secondary.Close()
+  l, _ := net.Listen("tcp", "127.0.0.1:0")
+  primaryAddr := l.Addr().String()
+  l.Close()
+
+  w := util.NewNetSampleWriter(primaryAddr, "web1")
+  w.Failover = []string{secondary.Addr().String()}
+  w.FlushWindow = 10 * time.Millisecond
+  w.FailbackInterval = 50 * time.Millisecond
+  waitFor := func(store *Store, n int) {
+    deadline := time.Now().Add(5 * time.Second)
+    for len(store.Find("web1", "uptime", time.Time{})) == 0 ||
+        len(store.Find("web1", "uptime", time.Time{})[0].Points) < n {
+      if time.Now().After(deadline) {
+        t.Fatalf("samples never arrived")
+      }
+      time.Sleep(10 * time.Millisecond)
+    }
+  }
+  w.Write("uptime", 10)
+  waitFor(stores[0], 1)
+
+  // Batches carry on to the secondary until a probe finds the primary
+  // healthy again.
+  primary := serve(primaryAddr)
+  defer primary.Close()
+  deadline := time.Now().Add(5 * time.Second)
+  for len(stores[1].Find("web1", "uptime", time.Time{})) == 0 {
+    if time.Now().After(deadline) {
+      t.Fatalf("never failed back to the primary")
+    }
+    w.Write("uptime", 20)
+    time.Sleep(60 * time.Millisecond)
+  }
+  w.Write("uptime", 30)
+  if err := w.Close(5 * time.Second); err != nil {
+    t.Fatalf("Close() failed: %s", err)
+  }
+  waitFor(stores[1], 2)
+  points := stores[1].Find("web1", "uptime", time.Time{})[0].Points
+  assert.Equal(t, 30.0, points[len(points) - 1].Fields["seconds"])
+  for _, point := range stores[0].Find("web1", "uptime", time.Time{})[0].Points {
+    assert.NotEqual(t, 30.0, point.Fields["seconds"])
+  }
+}
+
+func Test_Collector_should_identify_TLS_agents_by_certificate(t *testing.T) {
+  pki, err := testpki.Write(t.TempDir(), "collector", "web1")
+  if err != nil {
+    t.Fatalf("could not write test PKI: %s", err)
+  }
+  server, err := util.NewTLSReloader(util.TLSFiles(pki["collector"]))
+  if err != nil {
+    t.Fatalf("NewTLSReloader() failed: %s", err)
+  }
+  store := NewStore(time.Hour)
+  collector := NewCollector(store, nil)
+  l, _ := net.Listen("tcp", "127.0.0.1:0")
+  l = tls.NewListener(l, server.ServerConfig())
+  defer l.Close()
+  go collector.Serve(l)
+
+  w := util.NewNetSampleWriter(l.Addr().String(), "db1")
+  if w.TLS, err = util.NewTLSReloader(util.TLSFiles(pki["web1"])); err != nil {
+    t.Fatalf("NewTLSReloader() failed: %s", err)
+  }
+  w.Write("uptime", 10)
+  if err = w.Close(5 * time.Second); err != nil {
+    t.Fatalf("Close() failed: %s", err)
+  }
+  deadline := time.Now().Add(5 * time.Second)
+  for len(store.Find("", "uptime", time.Time{})) == 0 {
+    if time.Now().After(deadline) {
+      t.Fatalf("sample never arrived")
+    }
+    time.Sleep(10 * time.Millisecond)
+  }
+  assert.Equal(t, 1, len(store.Find("web1", "uptime", time.Time{})))
+  assert.Equal(t, 0, len(store.Find("db1", "uptime", time.Time{})))
+}
+
+func Test_Collector_should_refuse_agents_without_a_protocol_version(t *testing.T) {
+  store := NewStore(time.Hour)
+  l, _ := net.Listen("tcp", "127.0.0.1:0")
+  defer l.Close()
+  go NewCollector(store, nil).Serve(l)
+
+  conn, err := net.Dial("tcp", l.Addr().String())
+  if err != nil {
+    t.Fatalf("could not connect: %s", err)
+  }
+  defer conn.Close()
+  io.WriteString(conn, `{"host":"web1"}` + "\n")
+  io.WriteString(conn, `{"name":"uptime","fields":{"seconds":10}}` + "\n")
+  // Dropped without a welcome.
+  conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+  n, err := conn.Read(make([]byte, 1))
+  assert.Equal(t, 0, n)
+  assert.Equal(t, io.EOF, err)
+  assert.Equal(t, 0, len(store.Find("web1", "uptime", time.Time{})))
+}
+
+func Test_Collector_should_drop_clients_that_never_say_hello(t *testing.T) {
+  collector := NewCollector(NewStore(time.Hour), nil)
+  collector.HandshakeTimeout = 50 * time.Millisecond
+  l, _ := net.Listen("tcp", "127.0.0.1:0")
+  defer l.Close()
+  go collector.Serve(l)
+
+  conn, err := net.Dial("tcp", l.Addr().String())
+  if err != nil {
+    t.Fatalf("could not connect: %s", err)
+  }
+  defer conn.Close()
+  conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+  _, err = conn.Read(make([]byte, 1))
+  assert.Equal(t, io.EOF, err)
+}
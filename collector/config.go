@@ -0,0 +1,35 @@
+package main
+
+import (
+  "encoding/json"
+  "os"
+)
+
+// Default seconds for which samples are retained.
+const defaultRetention = 3600
+
+// Collector configuration, read from the JSON file given with -f.
+type Config struct {
+  // Seconds for which samples and rollups are retained.
+  Retention  int               `json:"retention"`
+  // Continuous aggregates across hosts.
+  Rollups    []RollupConfig    `json:"rollups"`
+  // Downstream databases to which received samples are forwarded.
+  Forwarders []ForwarderConfig `json:"forwarders"`
+}
+
+// Load the collector configuration from the given file.
+func loadConfig(path string) (*Config, error) {
+  f, err := os.Open(path)
+  if err != nil {
+    return nil, err
+  }
+  defer f.Close()
+  cfg := &Config{}
+  dec := json.NewDecoder(f)
+  dec.DisallowUnknownFields()
+  if err = dec.Decode(cfg); err != nil {
+    return nil, err
+  }
+  return cfg, nil
+}
@@ -0,0 +1,257 @@
+package main
+
+// The dashboard: a single self-contained page, drawing its charts from the
+// query API on a canvas, so that it needs nothing else to render.
+const dashboardHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>monitor</title>
+<style>
+body { font: 13px sans-serif; margin: 0; color: #222; background: #f4f4f4; }
+header { background: #234; color: #fff; padding: 8px 16px; display: flex;
+         align-items: center; gap: 16px; }
+header a { color: #fff; text-decoration: none; font-weight: bold; }
+header select { margin-left: auto; }
+main { padding: 16px; }
+table { border-collapse: collapse; background: #fff; }
+th, td { padding: 4px 12px; text-align: left; border-bottom: 1px solid #ddd; }
+.up { color: #183; } .stale, .down { color: #b21; }
+.charts { display: grid; grid-template-columns: repeat(auto-fill, minmax(460px, 1fr));
+          gap: 16px; }
+.chart { background: #fff; padding: 8px; border: 1px solid #ddd; }
+.chart h3 { margin: 0 0 4px; font-size: 13px; }
+.chart canvas { width: 100%; height: 200px; }
+.legend span { display: inline-block; margin-right: 10px; }
+.legend i { display: inline-block; width: 10px; height: 10px; margin-right: 3px; }
+</style>
+</head>
+<body>
+<header>
+<a href="#">monitor</a><span id="title"></span>
+<select id="range">
+<option value="15m">last 15 minutes</option>
+<option value="1h" selected>last hour</option>
+<option value="6h">last 6 hours</option>
+<option value="24h">last 24 hours</option>
+</select>
+</header>
+<main id="main"></main>
+<script>
+"use strict";
+var colors = ["#1f77b4", "#ff7f0e", "#2ca02c", "#d62728", "#9467bd",
+              "#8c564b", "#e377c2", "#7f7f7f", "#bcbd22", "#17becf"];
+var main = document.getElementById("main");
+var range = document.getElementById("range");
+
+function get(path) {
+  return fetch(path).then(function(r) {
+    if (!r.ok) { throw new Error(path + ": " + r.status); }
+    return r.json();
+  });
+}
+
+function el(tag, attrs, text) {
+  var e = document.createElement(tag);
+  for (var k in attrs || {}) { e.setAttribute(k, attrs[k]); }
+  if (text !== undefined) { e.textContent = text; }
+  return e;
+}
+
+function since(s) {
+  return get("/api/series?rate=1&since=" + range.value +
+             "&host=" + encodeURIComponent(s.host) + "&name=" + s.name);
+}
+
+// Each chart turns the series fetched for it into lines: a label and a
+// list of [time, value] pairs.
+var charts = [
+  {title: "CPU (%)", name: "cpu", lines: function(series) {
+    var byTime = {};
+    series.forEach(function(s) {
+      s.points.forEach(function(p) {
+        var t = byTime[p.time] = byTime[p.time] || {};
+        for (var f in p.fields) { t[f] = (t[f] || 0) + p.fields[f]; }
+      });
+    });
+    return ["user", "system", "nice", "iowait", "steal"].map(function(f) {
+      return {label: f, points: Object.keys(byTime).sort(function(a, b) {
+        return new Date(a) - new Date(b);
+      }).map(function(t) {
+        var v = byTime[t], total = 0;
+        for (var k in v) { total += v[k]; }
+        return [new Date(t), total ? 100 * (v[f] || 0) / total : 0];
+      })};
+    });
+  }},
+  {title: "Load", name: "load", lines: fields(["load1", "load5", "load15"])},
+  {title: "Memory (MB)", name: "memory", lines: function(series) {
+    var points = series.length ? series[0].points : [];
+    var mb = function(f) {
+      return {label: f.name, points: points.map(function(p) {
+        return [new Date(p.time), f.value(p.fields) / 1024];
+      })};
+    };
+    return [
+      mb({name: "used", value: function(v) {
+        return v.total - v.free - v.buffers - v.cached; }}),
+      mb({name: "cached", value: function(v) { return v.cached; }}),
+      mb({name: "buffers", value: function(v) { return v.buffers; }}),
+      mb({name: "free", value: function(v) { return v.free; }}),
+      mb({name: "swap used", value: function(v) {
+        return v.swap_total - v.swap_free; }})
+    ];
+  }},
+  {title: "Disk (KB/s)", name: "disk", lines: perTag("device", ["read_kb", "write_kb"])},
+  {title: "Filesystems (% used)", name: "fs", lines: function(series) {
+    return series.map(function(s) {
+      return {label: s.tags.mount || s.tags.device, points: s.points.map(function(p) {
+        var v = p.fields;
+        return [new Date(p.time), v.total_kb ? 100 * (1 - v.avail_kb / v.total_kb) : 0];
+      })};
+    });
+  }},
+  {title: "Network (bytes/s)", name: "net", lines: perTag("interface", ["rx_bytes", "tx_bytes"])}
+];
+
+function fields(names) {
+  return function(series) {
+    var points = series.length ? series[0].points : [];
+    return names.map(function(f) {
+      return {label: f, points: points.map(function(p) {
+        return [new Date(p.time), p.fields[f]];
+      })};
+    });
+  };
+}
+
+function perTag(tag, names) {
+  return function(series) {
+    var lines = [];
+    series.forEach(function(s) {
+      names.forEach(function(f) {
+        lines.push({label: s.tags[tag] + " " + f, points: s.points.map(function(p) {
+          return [new Date(p.time), p.fields[f]];
+        })});
+      });
+    });
+    return lines;
+  };
+}
+
+function fmt(v) {
+  var a = Math.abs(v);
+  if (a >= 1e9) { return (v / 1e9).toFixed(1) + "G"; }
+  if (a >= 1e6) { return (v / 1e6).toFixed(1) + "M"; }
+  if (a >= 1e3) { return (v / 1e3).toFixed(1) + "k"; }
+  return a >= 10 || v === 0 ? v.toFixed(0) : v.toFixed(2);
+}
+
+function draw(canvas, lines) {
+  var ratio = window.devicePixelRatio || 1;
+  var w = canvas.clientWidth, h = canvas.clientHeight;
+  canvas.width = w * ratio;
+  canvas.height = h * ratio;
+  var ctx = canvas.getContext("2d");
+  ctx.scale(ratio, ratio);
+  var t0 = Infinity, t1 = -Infinity, max = 0;
+  lines.forEach(function(l) {
+    l.points.forEach(function(p) {
+      t0 = Math.min(t0, p[0]); t1 = Math.max(t1, p[0]);
+      if (isFinite(p[1])) { max = Math.max(max, p[1]); }
+    });
+  });
+  var left = 48, bottom = 18, plotW = w - left - 4, plotH = h - bottom - 4;
+  ctx.font = "11px sans-serif";
+  ctx.fillStyle = "#666";
+  ctx.strokeStyle = "#eee";
+  if (t0 === Infinity) {
+    ctx.fillText("no data", left, plotH / 2);
+    return;
+  }
+  max = max || 1;
+  for (var i = 0; i <= 4; i++) {
+    var y = 4 + plotH - plotH * i / 4;
+    ctx.beginPath(); ctx.moveTo(left, y); ctx.lineTo(w - 4, y); ctx.stroke();
+    ctx.fillText(fmt(max * i / 4), 2, y + 4);
+  }
+  [t0, t1].forEach(function(t, i) {
+    var label = new Date(t).toLocaleTimeString();
+    ctx.fillText(label, i ? w - 4 - ctx.measureText(label).width : left, h - 4);
+  });
+  var x = function(t) { return left + (t1 > t0 ? plotW * (t - t0) / (t1 - t0) : 0); };
+  lines.forEach(function(l, n) {
+    ctx.strokeStyle = colors[n % colors.length];
+    ctx.beginPath();
+    l.points.forEach(function(p, i) {
+      var y = 4 + plotH - plotH * (p[1] || 0) / max;
+      if (i) { ctx.lineTo(x(p[0]), y); } else { ctx.moveTo(x(p[0]), y); }
+    });
+    ctx.stroke();
+  });
+}
+
+function showHosts() {
+  document.getElementById("title").textContent = "";
+  get("/api/hosts").then(function(hosts) {
+    var table = el("table");
+    var head = el("tr");
+    ["host", "status", "last seen", "missed intervals"].forEach(function(h) { head.appendChild(el("th", {}, h)); });
+    table.appendChild(head);
+    hosts.forEach(function(h) {
+      var row = el("tr");
+      var cell = el("td");
+      cell.appendChild(el("a", {href: "#host=" + encodeURIComponent(h.host)}, h.host));
+      row.appendChild(cell);
+      row.appendChild(el("td", {"class": h.status}, h.status));
+      row.appendChild(el("td", {}, new Date(h.last_seen).toLocaleString()));
+      row.appendChild(el("td", {}, String(h.missed)));
+      table.appendChild(row);
+    });
+    main.replaceChildren(hosts.length ? table : el("p", {}, "No hosts have reported yet."));
+  }).catch(showError);
+}
+
+function showHost(host) {
+  document.getElementById("title").textContent = host;
+  var grid = el("div", {"class": "charts"});
+  main.replaceChildren(grid);
+  charts.forEach(function(c) {
+    var box = el("div", {"class": "chart"});
+    var canvas = el("canvas");
+    var legend = el("div", {"class": "legend"});
+    box.appendChild(el("h3", {}, c.title));
+    box.appendChild(canvas);
+    box.appendChild(legend);
+    grid.appendChild(box);
+    since({host: host, name: c.name}).then(function(series) {
+      var lines = c.lines(series);
+      draw(canvas, lines);
+      lines.forEach(function(l, n) {
+        var item = el("span", {}, l.label);
+        var swatch = el("i");
+        swatch.style.background = colors[n % colors.length];
+        item.prepend(swatch);
+        legend.appendChild(item);
+      });
+    }).catch(showError);
+  });
+}
+
+function showError(err) {
+  main.replaceChildren(el("p", {"class": "down"}, String(err)));
+}
+
+function route() {
+  var m = /^#host=(.+)$/.exec(location.hash);
+  if (m) { showHost(decodeURIComponent(m[1])); } else { showHosts(); }
+}
+
+window.addEventListener("hashchange", route);
+range.addEventListener("change", route);
+setInterval(route, 30000);
+route();
+</script>
+</body>
+</html>
+`
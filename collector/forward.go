@@ -0,0 +1,321 @@
+package main
+
+import (
+  "bytes"
+  "encoding/json"
+  "fmt"
+  "math"
+  "net"
+  "net/http"
+  "path"
+  "strconv"
+  "strings"
+  "time"
+  "../util"
+)
+
+// Defaults for forwarder configuration.
+const (
+  defaultForwardBuffer   = 10000
+  defaultForwardBatch    = 1000
+  defaultForwardInterval = 10
+  defaultForwardRetries  = 3
+)
+
+// Longest we wait for a downstream database to accept a batch.
+const forwardTimeout = 30 * time.Second
+
+// Configuration of a downstream time-series database to which received
+// samples are forwarded, e.g.
+//
+//   {"name": "influx", "type": "influxdb",
+//    "address": "http://influx:8086/write?db=fleet",
+//    "metrics": ["cpu", "net", "disk*"]}
+type ForwarderConfig struct {
+  // Name by which the forwarder is logged.
+  Name     string   `json:"name"`
+  // Protocol used: influxdb (line protocol over HTTP), opentsdb (telnet
+  // put), opentsdb-http (JSON put) or otlp (OTLP/HTTP protobuf).
+  Type     string   `json:"type"`
+  // URL to post to, for HTTP protocols, or host:port to connect to.
+  Address  string   `json:"address"`
+  // Glob patterns of the sample names forwarded; every sample when empty.
+  Metrics  []string `json:"metrics"`
+  // Glob patterns of sample names not forwarded, even if they match
+  // metrics.
+  Exclude  []string `json:"exclude"`
+  // Most samples held waiting to be forwarded, beyond which they're
+  // dropped.
+  Buffer   int      `json:"buffer"`
+  // Most samples sent in a single request.
+  Batch    int      `json:"batch"`
+  // Longest a sample is buffered waiting for its batch to fill, in
+  // seconds.
+  Interval int      `json:"interval"`
+  // Times a failed request is retried before its samples are dropped;
+  // negative for none.
+  Retries  int      `json:"retries"`
+  // Send counters to OTLP as the change since their last sample, rather
+  // than their cumulative totals.
+  Delta    bool     `json:"delta"`
+}
+
+// Sends batches of samples to a downstream database. Each batch is encoded
+// once, and the encoding sent as many times as it takes.
+type sender interface {
+  Encode(samples []*util.Sample) []byte
+  Send(body []byte) error
+}
+
+// Forwards received samples to a downstream database. Samples are buffered
+// and sent in the background, so a slow or unreachable database never
+// holds up ingestion; samples received while the buffer is full are
+// dropped, as are batches that can't be sent after retrying.
+type Forwarder struct {
+  cfg     ForwarderConfig
+  sender  sender
+  batcher *util.Batcher
+}
+
+// Create a new forwarder from its configuration, and start it.
+func NewForwarder(cfg ForwarderConfig) (*Forwarder, error) {
+  if cfg.Name == "" {
+    cfg.Name = cfg.Type
+  }
+  if cfg.Address == "" {
+    return nil, fmt.Errorf("forwarder %s: no address", cfg.Name)
+  }
+  for _, pattern := range append(cfg.Metrics, cfg.Exclude...) {
+    if _, err := path.Match(pattern, ""); err != nil {
+      return nil, fmt.Errorf("forwarder %s: bad pattern %q", cfg.Name, pattern)
+    }
+  }
+  if cfg.Buffer <= 0 {
+    cfg.Buffer = defaultForwardBuffer
+  }
+  if cfg.Batch <= 0 {
+    cfg.Batch = defaultForwardBatch
+  }
+  if cfg.Interval <= 0 {
+    cfg.Interval = defaultForwardInterval
+  }
+  if cfg.Retries < 0 {
+    cfg.Retries = 0
+  } else if cfg.Retries == 0 {
+    cfg.Retries = defaultForwardRetries
+  }
+  f := &Forwarder{
+    cfg: cfg,
+    batcher: util.NewBatcher("forwarder " + cfg.Name, cfg.Buffer),
+  }
+  client := &http.Client{Timeout: forwardTimeout}
+  switch cfg.Type {
+  case "influxdb":
+    f.sender = &influxSender{url: cfg.Address, client: client}
+  case "opentsdb":
+    f.sender = &openTSDBSender{addr: cfg.Address}
+  case "opentsdb-http":
+    f.sender = &openTSDBHTTPSender{url: cfg.Address, client: client}
+  case "otlp":
+    encoder := util.NewOTLPEncoder()
+    encoder.Delta = cfg.Delta
+    f.sender = &otlpSender{url: cfg.Address, client: client, encoder: encoder}
+  default:
+    return nil, fmt.Errorf("forwarder %s: unknown type %q", cfg.Name, cfg.Type)
+  }
+  f.batcher.BatchSize = cfg.Batch
+  f.batcher.FlushWindow = time.Duration(cfg.Interval) * time.Second
+  f.batcher.Attempts = cfg.Retries + 1
+  f.batcher.Encode = f.sender.Encode
+  f.batcher.Send = f.sender.Send
+  f.batcher.Start()
+  return f, nil
+}
+
+// Returns whether samples with the given name are forwarded.
+func (f *Forwarder) Matches(name string) bool {
+  for _, pattern := range f.cfg.Exclude {
+    if ok, _ := path.Match(pattern, name); ok {
+      return false
+    }
+  }
+  if len(f.cfg.Metrics) == 0 {
+    return true
+  }
+  for _, pattern := range f.cfg.Metrics {
+    if ok, _ := path.Match(pattern, name); ok {
+      return true
+    }
+  }
+  return false
+}
+
+// Queue the given sample for forwarding, if it's wanted. Never blocks.
+func (f *Forwarder) Forward(s *util.Sample) {
+  if !f.Matches(s.Name) {
+    return
+  }
+  f.batcher.Add(s)
+}
+
+// Stop accepting samples, and wait up to the given time for those already
+// queued to be sent. Any batch still waiting to be retried by then is
+// abandoned too.
+func (f *Forwarder) Close(timeout time.Duration) error {
+  if err := f.batcher.Close(timeout); err != nil {
+    return fmt.Errorf("forwarder %s: %s", f.cfg.Name, err)
+  }
+  return nil
+}
+
+// Sends samples to InfluxDB in line protocol over HTTP.
+type influxSender struct {
+  url    string
+  client *http.Client
+}
+
+// Encode a batch of samples as lines of line protocol.
+func (s *influxSender) Encode(samples []*util.Sample) []byte {
+  var body bytes.Buffer
+  for _, sample := range samples {
+    if line := util.LineProtocol(sample); line != "" {
+      body.WriteString(line)
+      body.WriteByte('\n')
+    }
+  }
+  return body.Bytes()
+}
+
+// Send an encoded batch.
+func (s *influxSender) Send(body []byte) error {
+  return util.Post(s.client, s.url, "text/plain; charset=utf-8", body)
+}
+
+// Data point in OpenTSDB's HTTP put API. Each field of a sample is put as
+// its own metric, named <sample>.<field>.
+type openTSDBPoint struct {
+  Metric    string            `json:"metric"`
+  Timestamp int64             `json:"timestamp"`
+  Value     float64           `json:"value"`
+  Tags      map[string]string `json:"tags"`
+}
+
+// Returns the OpenTSDB data points for a sample. OpenTSDB allows only
+// letters, digits and -_./ in names, so anything else is replaced.
+func openTSDBPoints(s *util.Sample) []openTSDBPoint {
+  tags := make(map[string]string, len(s.Tags) + 1)
+  for k, v := range s.Tags {
+    if v != "" {
+      tags[openTSDBName(k)] = openTSDBName(v)
+    }
+  }
+  if s.Host != "" {
+    tags["host"] = openTSDBName(s.Host)
+  }
+  rv := make([]openTSDBPoint, 0, len(s.Fields))
+  for field, value := range s.Fields {
+    if math.IsNaN(value) || math.IsInf(value, 0) {
+      continue
+    }
+    rv = append(rv, openTSDBPoint{
+      Metric: openTSDBName(s.Name + "." + field),
+      Timestamp: s.Time.Unix(),
+      Value: value,
+      Tags: tags,
+    })
+  }
+  return rv
+}
+
+// Replace the characters OpenTSDB doesn't allow in names with underscores.
+func openTSDBName(name string) string {
+  return strings.Map(func(r rune) rune {
+    if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' ||
+       strings.ContainsRune("-_./", r) {
+      return r
+    }
+    return '_'
+  }, name)
+}
+
+// Sends samples to OpenTSDB with telnet-style put commands, over a
+// connection that's kept open between batches.
+type openTSDBSender struct {
+  addr string
+  conn net.Conn
+}
+
+// Encode a batch of samples as put commands.
+func (s *openTSDBSender) Encode(samples []*util.Sample) []byte {
+  var buf bytes.Buffer
+  for _, sample := range samples {
+    for _, p := range openTSDBPoints(sample) {
+      fmt.Fprintf(&buf, "put %s %d %s", p.Metric, p.Timestamp,
+                  strconv.FormatFloat(p.Value, 'f', -1, 64))
+      for _, k := range util.Tags(p.Tags).Keys() {
+        fmt.Fprintf(&buf, " %s=%s", k, p.Tags[k])
+      }
+      buf.WriteByte('\n')
+    }
+  }
+  return buf.Bytes()
+}
+
+// Send an encoded batch.
+func (s *openTSDBSender) Send(body []byte) error {
+  if len(body) == 0 {
+    return nil
+  }
+  if s.conn == nil {
+    conn, err := net.DialTimeout("tcp", s.addr, forwardTimeout)
+    if err != nil {
+      return err
+    }
+    s.conn = conn
+  }
+  s.conn.SetWriteDeadline(time.Now().Add(forwardTimeout))
+  if _, err := s.conn.Write(body); err != nil {
+    s.conn.Close()
+    s.conn = nil
+    return err
+  }
+  return nil
+}
+
+// Sends samples to OpenTSDB's HTTP put API.
+type openTSDBHTTPSender struct {
+  url    string
+  client *http.Client
+}
+
+// Encode a batch of samples as a JSON list of data points.
+func (s *openTSDBHTTPSender) Encode(samples []*util.Sample) []byte {
+  points := make([]openTSDBPoint, 0, len(samples))
+  for _, sample := range samples {
+    points = append(points, openTSDBPoints(sample)...)
+  }
+  body, _ := json.Marshal(points)
+  return body
+}
+
+// Send an encoded batch.
+func (s *openTSDBHTTPSender) Send(body []byte) error {
+  return util.Post(s.client, s.url, "application/json", body)
+}
+
+// Sends samples to an OTLP/HTTP metrics endpoint.
+type otlpSender struct {
+  url     string
+  client  *http.Client
+  encoder *util.OTLPEncoder
+}
+
+// Encode a batch of samples as an OTLP export request.
+func (s *otlpSender) Encode(samples []*util.Sample) []byte {
+  return s.encoder.Encode(samples)
+}
+
+// Send an encoded batch.
+func (s *otlpSender) Send(body []byte) error {
+  return util.Post(s.client, s.url, "application/x-protobuf", body)
+}
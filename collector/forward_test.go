@@ -0,0 +1,185 @@
+package main
+
+import (
+  "bufio"
+  "encoding/json"
+  "github.com/bmizerany/assert"
+  "io/ioutil"
+  "net"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "testing"
+  "time"
+  "../util"
+)
+
+func forwardedSample(name string, fields map[string]float64) *util.Sample {
+  return &util.Sample{
+    Host: "web1",
+    Time: time.Unix(1500000000, 0),
+    Name: name,
+    Tags: util.Tags{"role": "web"},
+    Fields: fields,
+  }
+}
+
+func Test_Forwarder_should_filter_metrics(t *testing.T) {
+  f, err := NewForwarder(ForwarderConfig{
+    Type: "influxdb",
+    Address: "http://127.0.0.1:1/write",
+    Metrics: []string{"cpu", "disk*"},
+    Exclude: []string{"disk.flush"},
+  })
+  if err != nil {
+    t.Fatalf("NewForwarder() failed: %s", err)
+  }
+  defer f.Close(0)
+  assert.Equal(t, true, f.Matches("cpu"))
+  assert.Equal(t, true, f.Matches("disk.discard"))
+  assert.Equal(t, false, f.Matches("disk.flush"))
+  assert.Equal(t, false, f.Matches("cpu.freq"))
+
+  _, err = NewForwarder(ForwarderConfig{Type: "graphite", Address: "x:1"})
+  assert.NotEqual(t, nil, err)
+  _, err = NewForwarder(ForwarderConfig{Type: "opentsdb", Address: "x:1",
+                                        Metrics: []string{"["}})
+  assert.NotEqual(t, nil, err)
+}
+
+func Test_Forwarder_should_retry_line_protocol_posts(t *testing.T) {
+  bodies := make(chan string, 10)
+  attempts := 0
+  server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+                                                    r *http.Request) {
+    body, _ := ioutil.ReadAll(r.Body)
+    if attempts++; attempts == 1 {
+      http.Error(w, "overloaded", http.StatusServiceUnavailable)
+      return
+    }
+    bodies <- string(body)
+    w.WriteHeader(http.StatusNoContent)
+  }))
+  defer server.Close()
+  f, err := NewForwarder(ForwarderConfig{
+    Type: "influxdb",
+    Address: server.URL + "/write?db=fleet",
+  })
+  if err != nil {
+    t.Fatalf("NewForwarder() failed: %s", err)
+  }
+  f.batcher.Backoff = time.Millisecond
+  f.Forward(forwardedSample("load", map[string]float64{"load1": 0.5}))
+  if err = f.Close(5 * time.Second); err != nil {
+    t.Fatalf("Close() failed: %s", err)
+  }
+  assert.Equal(t, 2, attempts)
+  assert.Equal(t, "load,host=web1,role=web load1=0.5 1500000000000000000\n", <-bodies)
+}
+
+func Test_Forwarder_should_abandon_backoff_on_close(t *testing.T) {
+  server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+                                                    r *http.Request) {
+    http.Error(w, "overloaded", http.StatusServiceUnavailable)
+  }))
+  defer server.Close()
+  f, _ := NewForwarder(ForwarderConfig{
+    Type: "influxdb",
+    Address: server.URL,
+  })
+  f.batcher.Backoff = time.Hour
+  f.Forward(forwardedSample("load", map[string]float64{"load1": 0.5}))
+  start := time.Now()
+  err := f.Close(10 * time.Millisecond)
+  assert.NotEqual(t, nil, err)
+  select {
+  case <-f.batcher.Done():
+  case <-time.After(time.Second):
+    t.Fatalf("forwarder still backing off after Close()")
+  }
+  assert.Equal(t, true, time.Since(start) < time.Second)
+}
+
+func Test_Forwarder_should_put_to_OpenTSDB(t *testing.T) {
+  var points []openTSDBPoint
+  server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+                                                    r *http.Request) {
+    json.NewDecoder(r.Body).Decode(&points)
+    w.WriteHeader(http.StatusNoContent)
+  }))
+  defer server.Close()
+  f, _ := NewForwarder(ForwarderConfig{Type: "opentsdb-http",
+                                       Address: server.URL + "/api/put"})
+  f.Forward(forwardedSample("uptime", map[string]float64{"seconds": 10}))
+  f.Close(5 * time.Second)
+  assert.Equal(t, []openTSDBPoint{{
+    Metric: "uptime.seconds",
+    Timestamp: 1500000000,
+    Value: 10,
+    Tags: map[string]string{"host": "web1", "role": "web"},
+  }}, points)
+
+  l, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatalf("could not listen: %s", err)
+  }
+  defer l.Close()
+  lines := make(chan string, 1)
+  go func() {
+    conn, err := l.Accept()
+    if err != nil {
+      return
+    }
+    defer conn.Close()
+    line, _ := bufio.NewReader(conn).ReadString('\n')
+    lines <- line
+  }()
+  f, _ = NewForwarder(ForwarderConfig{Type: "opentsdb", Address: l.Addr().String()})
+  f.Forward(forwardedSample("app metric", map[string]float64{"n": 1.5}))
+  f.Close(5 * time.Second)
+  assert.Equal(t, "put app_metric.n 1500000000 1.5 host=web1 role=web\n", <-lines)
+}
+
+func Test_Forwarder_should_never_block_ingestion(t *testing.T) {
+  release := make(chan struct{})
+  server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+                                                    r *http.Request) {
+    <-release
+  }))
+  defer server.Close()
+  defer close(release)
+  f, _ := NewForwarder(ForwarderConfig{
+    Type: "influxdb",
+    Address: server.URL,
+    Buffer: 10,
+    Batch: 5,
+  })
+  start := time.Now()
+  for i := 0; i < 100; i++ {
+    f.Forward(forwardedSample("load", map[string]float64{"load1": 0.5}))
+  }
+  assert.Equal(t, true, time.Since(start) < time.Second)
+  err := f.Close(10 * time.Millisecond)
+  assert.NotEqual(t, nil, err)
+  assert.Equal(t, true, strings.Contains(err.Error(), "abandoned"))
+  f.Forward(forwardedSample("load", map[string]float64{"load1": 0.5}))
+}
+
+func Test_Forwarder_should_export_OTLP_and_not_retry_rejections(t *testing.T) {
+  requests := make(chan string, 10)
+  server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+                                                    r *http.Request) {
+    requests <- r.Header.Get("Content-Type")
+    http.Error(w, "bad metrics", http.StatusBadRequest)
+  }))
+  defer server.Close()
+  f, err := NewForwarder(ForwarderConfig{Type: "otlp",
+                                         Address: server.URL + "/v1/metrics"})
+  if err != nil {
+    t.Fatalf("NewForwarder() failed: %s", err)
+  }
+  f.Forward(forwardedSample("uptime", map[string]float64{"seconds": 10}))
+  f.Close(5 * time.Second)
+  assert.Equal(t, 1, len(requests))
+  assert.Equal(t, "application/x-protobuf", <-requests)
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+  "sort"
+  "sync"
+  "time"
+  "../util"
+)
+
+// Defaults for liveness tracking.
+const (
+  defaultInterval   = 10 * time.Second
+  defaultStaleAfter = 2
+  defaultDownAfter  = 5
+  // Number of recent status changes kept.
+  maxHostEvents     = 1000
+)
+
+// Statuses of hosts.
+const (
+  hostUp    = "up"
+  hostStale = "stale"
+  hostDown  = "down"
+  // The host's agent said goodbye as it closed its connections to this
+  // collector, e.g. to fail back to another one, so its silence here isn't
+  // a sign of trouble.
+  hostMoved = "moved"
+)
+
+// Liveness of a host that has reported to the collector.
+type HostStatus struct {
+  Host     string    `json:"host"`
+  Status   string    `json:"status"`
+  // When the host's samples were last received.
+  LastSeen time.Time `json:"last_seen"`
+  // Seconds between the host's samples, as advertised by its agent.
+  Interval float64   `json:"interval"`
+  // Intervals since the host's samples were last received.
+  Missed   int       `json:"missed"`
+  // When the host's status last changed.
+  Since    time.Time `json:"since"`
+  // Number of open connections from the host's agent.
+  conns    int
+  // Whether the host's agent said goodbye on closing its last connection.
+  left     bool
+}
+
+// Change in the status of a host.
+type HostEvent struct {
+  Time     time.Time `json:"time"`
+  Host     string    `json:"host"`
+  // Previous status; empty when a host is first seen.
+  From     string    `json:"from"`
+  To       string    `json:"to"`
+  LastSeen time.Time `json:"last_seen"`
+  Missed   int       `json:"missed"`
+}
+
+// Returns the event as a sample, so that it's stored and forwarded like
+// any other.
+func (e HostEvent) Sample() *util.Sample {
+  return &util.Sample{
+    Host: e.Host,
+    Time: e.Time,
+    Name: "host.status",
+    Tags: util.Tags{"status": e.To},
+    Fields: map[string]float64{"missed": float64(e.Missed)},
+  }
+}
+
+// Tracks when each host last reported, so that hosts whose agents have
+// stopped can be told apart from hosts with nothing to report. A host is
+// stale once it's missed StaleAfter of the intervals its agent says it
+// samples at, and down once it's missed DownAfter of them. Hosts whose
+// agents say goodbye as they disconnect have moved to another collector
+// (or been shut down on purpose) rather than gone down, so they're never
+// marked stale or down unless they come back.
+type Liveness struct {
+  // Intervals missed before a host is stale.
+  StaleAfter      int
+  // Intervals missed before a host is down.
+  DownAfter       int
+  // Interval assumed for agents that don't advertise one.
+  DefaultInterval time.Duration
+  // How long after it was last seen a down or moved host is forgotten;
+  // never if zero.
+  ForgetAfter     time.Duration
+  mu              sync.Mutex
+  hosts           map[string]*HostStatus
+  events          []HostEvent
+  pending         []HostEvent
+}
+
+// Create a new, empty liveness tracker.
+func NewLiveness() *Liveness {
+  return &Liveness{
+    StaleAfter: defaultStaleAfter,
+    DownAfter: defaultDownAfter,
+    DefaultInterval: defaultInterval,
+    hosts: make(map[string]*HostStatus),
+  }
+}
+
+// Record that the given host reported at the given time, with the
+// interval its agent advertised (zero if it didn't).
+func (l *Liveness) Seen(host string, interval time.Duration, t time.Time) {
+  if interval <= 0 {
+    interval = l.DefaultInterval
+  }
+  l.mu.Lock()
+  defer l.mu.Unlock()
+  status := l.host(host)
+  status.Interval = interval.Seconds()
+  if t.After(status.LastSeen) {
+    status.LastSeen = t
+  }
+  status.left = false
+  l.update(status, t)
+}
+
+// Record that an agent has connected for the given host.
+func (l *Liveness) Connected(host string) {
+  l.mu.Lock()
+  defer l.mu.Unlock()
+  l.host(host).conns++
+}
+
+// Record that a connection from the given host's agent ended at the given
+// time, cleanly (with a goodbye) or not. Once the agent has cleanly closed
+// all of its connections, the host has moved. Hosts that have been forgotten meanwhile
+// stay forgotten.
+func (l *Liveness) Disconnected(host string, clean bool, t time.Time) {
+  l.mu.Lock()
+  defer l.mu.Unlock()
+  status, ok := l.hosts[host]
+  if !ok {
+    return
+  }
+  if status.conns > 0 {
+    status.conns--
+  }
+  if status.conns == 0 && clean {
+    status.left = true
+    l.update(status, t)
+  }
+}
+
+// Returns the status of the given host, tracking it if it's new. Must be
+// called with the lock held.
+func (l *Liveness) host(host string) *HostStatus {
+  status, ok := l.hosts[host]
+  if !ok {
+    status = &HostStatus{Host: host}
+    l.hosts[host] = status
+  }
+  return status
+}
+
+// Update the status of every host as of the given time, returning the
+// events for those whose status has changed since the last check.
+func (l *Liveness) Check(now time.Time) []HostEvent {
+  l.mu.Lock()
+  defer l.mu.Unlock()
+  for host, status := range l.hosts {
+    gone := status.Status == hostDown || status.Status == hostMoved
+    if l.ForgetAfter > 0 && gone && now.Sub(status.LastSeen) > l.ForgetAfter {
+      delete(l.hosts, host)
+      continue
+    }
+    l.update(status, now)
+  }
+  rv := l.pending
+  l.pending = nil
+  return rv
+}
+
+// Work out a host's status as of the given time, recording an event if
+// it's changed.
+func (l *Liveness) update(status *HostStatus, now time.Time) {
+  interval := time.Duration(status.Interval * float64(time.Second))
+  if interval <= 0 {
+    interval = l.DefaultInterval
+  }
+  status.Missed = int(now.Sub(status.LastSeen) / interval)
+  next := hostUp
+  if status.left {
+    next = hostMoved
+  } else if status.Missed >= l.DownAfter {
+    next = hostDown
+  } else if status.Missed >= l.StaleAfter {
+    next = hostStale
+  }
+  if next == status.Status {
+    return
+  }
+  event := HostEvent{
+    Time: now,
+    Host: status.Host,
+    From: status.Status,
+    To: next,
+    LastSeen: status.LastSeen,
+    Missed: status.Missed,
+  }
+  l.pending = append(l.pending, event)
+  l.events = append(l.events, event)
+  if len(l.events) > maxHostEvents {
+    l.events = append([]HostEvent{}, l.events[len(l.events) - maxHostEvents:]...)
+  }
+  status.Status, status.Since = next, now
+}
+
+// Returns the status of every host, by name.
+func (l *Liveness) Hosts() []HostStatus {
+  l.mu.Lock()
+  defer l.mu.Unlock()
+  rv := make([]HostStatus, 0, len(l.hosts))
+  for _, status := range l.hosts {
+    rv = append(rv, *status)
+  }
+  sort.Slice(rv, func(i, j int) bool {
+    return rv[i].Host < rv[j].Host
+  })
+  return rv
+}
+
+// Returns the recent events since the given time, oldest first.
+func (l *Liveness) Events(since time.Time) []HostEvent {
+  l.mu.Lock()
+  defer l.mu.Unlock()
+  i := sort.Search(len(l.events), func(i int) bool {
+    return !l.events[i].Time.Before(since)
+  })
+  return append([]HostEvent{}, l.events[i:]...)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+  "bufio"
+  "github.com/bmizerany/assert"
+  "net"
+  "testing"
+  "time"
+  "../util"
+)
+
+func Test_Liveness_should_mark_hosts_stale_then_down_then_up(t *testing.T) {
+  start := time.Unix(1500000000, 0)
+  l := NewLiveness()
+  l.Seen("web1", 30 * time.Second, start)
+  events := l.Check(start)
+  assert.Equal(t, 1, len(events))
+  assert.Equal(t, HostEvent{Time: start, Host: "web1", To: "up", LastSeen: start},
+               events[0])
+
+  assert.Equal(t, 0, len(l.Check(start.Add(59 * time.Second))))
+  events = l.Check(start.Add(60 * time.Second))
+  assert.Equal(t, 1, len(events))
+  assert.Equal(t, "stale", events[0].To)
+  assert.Equal(t, 2, events[0].Missed)
+  assert.Equal(t, "stale", l.Hosts()[0].Status)
+
+  events = l.Check(start.Add(150 * time.Second))
+  assert.Equal(t, 1, len(events))
+  assert.Equal(t, "stale", events[0].From)
+  assert.Equal(t, "down", events[0].To)
+
+  l.Seen("web1", 30 * time.Second, start.Add(160 * time.Second))
+  events = l.Check(start.Add(161 * time.Second))
+  assert.Equal(t, 1, len(events))
+  assert.Equal(t, "down", events[0].From)
+  assert.Equal(t, "up", events[0].To)
+  assert.Equal(t, util.Tags{"status": "up"}, events[0].Sample().Tags)
+  assert.Equal(t, 4, len(l.Events(time.Time{})))
+  assert.Equal(t, 1, len(l.Events(start.Add(155 * time.Second))))
+
+  l.ForgetAfter = time.Hour
+  l.Check(start.Add(2 * time.Hour))
+  assert.Equal(t, 1, len(l.Hosts()))
+  l.Check(start.Add(3 * time.Hour))
+  assert.Equal(t, 0, len(l.Hosts()))
+}
+
+func Test_Liveness_should_not_mark_hosts_that_left_cleanly_down(t *testing.T) {
+  start := time.Unix(1500000000, 0)
+  l := NewLiveness()
+  l.Seen("web1", 10 * time.Second, start)
+  l.Connected("web1")
+  l.Connected("web1")
+  l.Check(start)
+
+  // Still connected, so not yet moved.
+  l.Disconnected("web1", true, start.Add(time.Second))
+  assert.Equal(t, 0, len(l.Check(start.Add(time.Second))))
+  l.Disconnected("web1", true, start.Add(2 * time.Second))
+  events := l.Check(start.Add(2 * time.Second))
+  assert.Equal(t, 1, len(events))
+  assert.Equal(t, "moved", events[0].To)
+  assert.Equal(t, 0, len(l.Check(start.Add(time.Hour))))
+  assert.Equal(t, "moved", l.Hosts()[0].Status)
+
+  l.Seen("web1", 10 * time.Second, start.Add(2 * time.Hour))
+  l.Connected("web1")
+  events = l.Check(start.Add(2 * time.Hour))
+  assert.Equal(t, 1, len(events))
+  assert.Equal(t, "moved", events[0].From)
+  assert.Equal(t, "up", events[0].To)
+
+  // Connections that fail leave the host to go stale and down.
+  l.Disconnected("web1", false, start.Add(2 * time.Hour))
+  events = l.Check(start.Add(3 * time.Hour))
+  assert.Equal(t, 1, len(events))
+  assert.Equal(t, "down", events[0].To)
+}
+
+func Test_Liveness_should_ignore_disconnects_of_forgotten_hosts(t *testing.T) {
+  start := time.Unix(1500000000, 0)
+  l := NewLiveness()
+  l.ForgetAfter = time.Hour
+  l.Seen("web1", 10 * time.Second, start)
+  l.Connected("web1")
+  l.Check(start.Add(time.Hour))
+  l.Check(start.Add(2 * time.Hour))
+  assert.Equal(t, 0, len(l.Hosts()))
+
+  l.Disconnected("web1", true, start.Add(2 * time.Hour))
+  assert.Equal(t, 0, len(l.Check(start.Add(3 * time.Hour))))
+  assert.Equal(t, 0, len(l.Hosts()))
+}
+
+func Test_Collector_should_track_advertised_interval_of_agents(t *testing.T) {
+  store := NewStore(time.Hour)
+  collector := NewCollector(store, nil)
+  l, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatalf("could not listen: %s", err)
+  }
+  defer l.Close()
+  go collector.Serve(l)
+
+  w := util.NewNetSampleWriter(l.Addr().String(), "web1")
+  w.Interval = 5 * time.Second
+  defer w.Close(5 * time.Second)
+  w.Write("uptime", 10)
+  deadline := time.Now().Add(5 * time.Second)
+  for len(collector.Liveness.Hosts()) == 0 {
+    if time.Now().After(deadline) {
+      t.Fatalf("agent never connected")
+    }
+    time.Sleep(10 * time.Millisecond)
+  }
+  host := collector.Liveness.Hosts()[0]
+  assert.Equal(t, 5.0, host.Interval)
+
+  collector.Tick(host.LastSeen.Add(30 * time.Second))
+  statuses := make(map[string]float64)
+  for _, series := range store.Find("web1", "host.status", time.Time{}) {
+    statuses[series.Tags["status"]] = series.Points[0].Fields["missed"]
+  }
+  assert.Equal(t, map[string]float64{"up": 0, "down": 6}, statuses)
+}
+
+func Test_Collector_should_not_report_hosts_down_after_failing_back(t *testing.T) {
+  collectors := make([]*Collector, 0)
+  serve := func(addr string) net.Listener {
+    l, err := net.Listen("tcp", addr)
+    if err != nil {
+      t.Fatalf("could not listen: %s", err)
+    }
+    collector := NewCollector(NewStore(time.Hour), nil)
+    collectors = append(collectors, collector)
+    go collector.Serve(l)
+    return l
+  }
+  secondary := serve("127.0.0.1:0")
+  defer secondary.Close()
+  l, _ := net.Listen("tcp", "127.0.0.1:0")
+  primaryAddr := l.Addr().String()
+  l.Close()
+
+  w := util.NewNetSampleWriter(primaryAddr, "web1")
+  w.Failover = []string{secondary.Addr().String()}
+  w.FlushWindow = 10 * time.Millisecond
+  w.FailbackInterval = 50 * time.Millisecond
+  w.Interval = time.Second
+  defer w.Close(5 * time.Second)
+  status := func(c *Collector) string {
+    for _, host := range c.Liveness.Hosts() {
+      return host.Status
+    }
+    return ""
+  }
+  waitFor := func(c *Collector, want string) {
+    deadline := time.Now().Add(5 * time.Second)
+    for status(c) != want {
+      if time.Now().After(deadline) {
+        t.Fatalf("host never %s, but %q", want, status(c))
+      }
+      w.Write("uptime", 10)
+      time.Sleep(20 * time.Millisecond)
+    }
+  }
+  waitFor(collectors[0], "up")
+
+  primary := serve(primaryAddr)
+  defer primary.Close()
+  waitFor(collectors[1], "up")
+  waitFor(collectors[0], "moved")
+
+  // Long after the agent failed back, the secondary still doesn't think
+  // the host is down.
+  now := time.Now().Add(time.Hour)
+  for _, c := range collectors {
+    c.Tick(now)
+  }
+  assert.Equal(t, "moved", status(collectors[0]))
+  statuses := make(map[string]bool)
+  for _, series := range collectors[0].store.Find("web1", "host.status", time.Time{}) {
+    statuses[series.Tags["status"]] = true
+  }
+  assert.Equal(t, map[string]bool{"up": true, "moved": true}, statuses)
+  assert.Equal(t, "down", status(collectors[1]))
+}
+
+func Test_Collector_should_report_hosts_down_unless_they_say_goodbye(t *testing.T) {
+  collector := NewCollector(NewStore(time.Hour), nil)
+  l, _ := net.Listen("tcp", "127.0.0.1:0")
+  defer l.Close()
+  go collector.Serve(l)
+
+  for _, host := range []string{"web1", "web2"} {
+    conn, err := net.Dial("tcp", l.Addr().String())
+    if err != nil {
+      t.Fatalf("could not connect: %s", err)
+    }
+    hello := &util.Hello{Host: host, Version: util.ProtocolVersion}
+    var welcome util.Welcome
+    util.WriteMessage(conn, hello)
+    if err = util.ReadMessage(bufio.NewReader(conn), &welcome); err != nil {
+      t.Fatalf("no welcome: %s", err)
+    }
+    // Only web1 leaves on purpose; web2's agent might have crashed.
+    if host == "web1" {
+      util.WriteGoodbye(conn)
+    }
+    conn.Close()
+  }
+  deadline := time.Now().Add(5 * time.Second)
+  for {
+    hosts := collector.Liveness.Hosts()
+    if len(hosts) == 2 && hosts[0].conns == 0 && hosts[1].conns == 0 {
+      break
+    }
+    if time.Now().After(deadline) {
+      t.Fatalf("agents never disconnected")
+    }
+    time.Sleep(10 * time.Millisecond)
+  }
+  collector.Tick(time.Now().Add(time.Hour))
+  hosts := collector.Liveness.Hosts()
+  assert.Equal(t, "moved", hosts[0].Status)
+  assert.Equal(t, "down", hosts[1].Status)
+}
@@ -0,0 +1,125 @@
+// Main routines for metric collection service.
+package main
+
+import (
+  "crypto/tls"
+  "flag"
+  "log"
+  "net"
+  "net/http"
+  "os"
+  "os/signal"
+  "syscall"
+  "time"
+  "../util"
+)
+
+// Network address on which to accept agent connections.
+var listenAddr string
+
+// Network address on which to serve the query API and dashboard; not
+// served if empty.
+var httpAddr string
+
+// Number of sampling intervals a host must miss to be stale, and to be
+// down.
+var staleAfter, downAfter int
+
+// Path of the collector configuration file.
+var configPath string
+
+// Certificate, key and CA files for mutual TLS with agents.
+var tlsFiles util.TLSFiles
+
+func init() {
+  flag.StringVar(&listenAddr, "l", ":5150", "address on which to accept agents")
+  flag.StringVar(&httpAddr, "http", "127.0.0.1:5151",
+                 "address on which to serve the unauthenticated query API and " +
+                 "dashboard (empty to disable)")
+  flag.IntVar(&staleAfter, "stale-after", defaultStaleAfter,
+              "sampling intervals a host must miss to be stale")
+  flag.IntVar(&downAfter, "down-after", defaultDownAfter,
+              "sampling intervals a host must miss to be down")
+  flag.StringVar(&configPath, "f", "", "path of collector configuration file")
+  flag.StringVar(&tlsFiles.Cert, "tls-cert", "",
+                 "PEM certificate file for TLS with agents")
+  flag.StringVar(&tlsFiles.Key, "tls-key", "",
+                 "PEM key file for TLS with agents")
+  flag.StringVar(&tlsFiles.CA, "tls-ca", "",
+                 "PEM file of CA certificates agents must be signed by")
+}
+
+func main() {
+  flag.Parse()
+  cfg := &Config{}
+  if configPath != "" {
+    var err error
+    if cfg, err = loadConfig(configPath); err != nil {
+      log.Fatalf("could not load configuration: %s\n", err)
+    }
+  }
+  if cfg.Retention <= 0 {
+    cfg.Retention = defaultRetention
+  }
+  rollups := make([]*Rollup, 0, len(cfg.Rollups))
+  for _, rc := range cfg.Rollups {
+    rollup, err := NewRollup(rc)
+    if err != nil {
+      log.Fatalf("could not configure rollup: %s\n", err)
+    }
+    rollups = append(rollups, rollup)
+  }
+  store := NewStore(time.Duration(cfg.Retention) * time.Second)
+  collector := NewCollector(store, rollups)
+  collector.Liveness.StaleAfter = staleAfter
+  collector.Liveness.DownAfter = downAfter
+  collector.Liveness.ForgetAfter = time.Duration(cfg.Retention) * time.Second
+  for _, fc := range cfg.Forwarders {
+    forwarder, err := NewForwarder(fc)
+    if err != nil {
+      log.Fatalf("could not configure forwarder: %s\n", err)
+    }
+    collector.Forwarders = append(collector.Forwarders, forwarder)
+  }
+
+  l, err := net.Listen("tcp", listenAddr)
+  if err != nil {
+    log.Fatalf("could not listen: %s\n", err)
+  }
+  if tlsFiles != (util.TLSFiles{}) {
+    reloader, err := util.NewTLSReloader(tlsFiles)
+    if err != nil {
+      log.Fatalf("could not load TLS files: %s\n", err)
+    }
+    l = tls.NewListener(l, reloader.ServerConfig())
+  }
+  go func() {
+    log.Fatalf("stopped accepting agents: %s\n", collector.Serve(l))
+  }()
+  log.Printf("collector started: listening on %s\n", l.Addr())
+  if httpAddr != "" {
+    api := NewAPI(store, collector.Liveness)
+    go func() {
+      log.Fatalf("stopped serving HTTP: %s\n", http.ListenAndServe(httpAddr, api))
+    }()
+    log.Printf("serving dashboard on %s\n", httpAddr)
+  }
+
+  signalChan := make(chan os.Signal, 1)
+  signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
+  ticker := time.NewTicker(time.Second)
+  for {
+    select {
+    case t := <-ticker.C:
+      collector.Tick(t)
+    case s := <-signalChan:
+      log.Printf("caught signal %s: shutting down\n", s)
+      for _, forwarder := range collector.Forwarders {
+        if err := forwarder.Close(10 * time.Second); err != nil {
+          log.Printf("%s\n", err)
+        }
+      }
+      return
+    }
+  }
+}
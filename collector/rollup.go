@@ -0,0 +1,254 @@
+package main
+
+import (
+  "fmt"
+  "math"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+  "../util"
+)
+
+// Default seconds between rollup computations.
+const defaultRollupInterval = 10
+
+// Number of intervals after which a host that stopped reporting is
+// forgotten by a rollup.
+const rollupSourceTTL = 3
+
+// Configuration of a continuous aggregate across hosts, e.g. the total
+// network throughput of every web host:
+//
+//   {"name": "web.net", "metric": "net", "where": {"role": "web"},
+//    "fields": ["rx_bytes", "tx_bytes"], "rate": true,
+//    "aggregates": ["sum"]}
+type RollupConfig struct {
+  // Name of the series the rollup is stored as.
+  Name       string    `json:"name"`
+  // Name of the samples aggregated.
+  Metric     string    `json:"metric"`
+  // Fields aggregated; every field when empty.
+  Fields     []string  `json:"fields"`
+  // Tags samples must have to be aggregated.
+  Where      util.Tags `json:"where"`
+  // Tags by which samples are grouped; each group is stored as its own
+  // series, tagged with the group's values. All samples are aggregated
+  // together when empty.
+  GroupBy    []string  `json:"group_by"`
+  // Aggregates computed for each field: sum, avg, min, max, count, or a
+  // percentile such as p95.
+  Aggregates []string  `json:"aggregates"`
+  // Aggregate the per-second rate of change of each field, rather than
+  // its value. Use for counters, such as bytes sent or CPU seconds.
+  Rate       bool      `json:"rate"`
+  // Seconds between computations.
+  Interval   int       `json:"interval"`
+}
+
+// Latest state of a single series feeding a rollup.
+type rollupSource struct {
+  tags     util.Tags
+  fields   map[string]float64
+  seen     time.Time
+  prev     map[string]float64
+  prevSeen time.Time
+  received time.Time
+  fresh    bool
+}
+
+// Continuous aggregate across hosts. Each interval, the latest value (or
+// rate) of every series that reported since the last computation is
+// grouped and aggregated into a sample named after the rollup, with fields
+// named <field>.<aggregate>.
+type Rollup struct {
+  cfg      RollupConfig
+  interval time.Duration
+  next     time.Time
+  sources  map[string]*rollupSource
+}
+
+// Create a new rollup from its configuration.
+func NewRollup(cfg RollupConfig) (*Rollup, error) {
+  if cfg.Name == "" || cfg.Metric == "" {
+    return nil, fmt.Errorf("rollup needs a name and a metric: %+v", cfg)
+  }
+  if len(cfg.Aggregates) == 0 {
+    return nil, fmt.Errorf("rollup %s: no aggregates", cfg.Name)
+  }
+  for _, agg := range cfg.Aggregates {
+    if _, err := aggregate(agg, []float64{0}); err != nil {
+      return nil, fmt.Errorf("rollup %s: %s", cfg.Name, err)
+    }
+  }
+  if cfg.Interval <= 0 {
+    cfg.Interval = defaultRollupInterval
+  }
+  return &Rollup{
+    cfg: cfg,
+    interval: time.Duration(cfg.Interval) * time.Second,
+    sources: make(map[string]*rollupSource),
+  }, nil
+}
+
+// Returns the name of the series this rollup is stored as.
+func (r *Rollup) Name() string {
+  return r.cfg.Name
+}
+
+// Feed a sample received at the given time into this rollup, if it's one
+// of the samples being aggregated. Rates are calculated between the times
+// samples were measured, where known.
+func (r *Rollup) Observe(s *util.Sample, t time.Time) {
+  if s.Name != r.cfg.Metric {
+    return
+  }
+  for k, v := range r.cfg.Where {
+    if s.Tags[k] != v {
+      return
+    }
+  }
+  key := seriesKey(s.Host, s.Name, s.Tags)
+  src, ok := r.sources[key]
+  if !ok {
+    src = &rollupSource{tags: s.Tags}
+    r.sources[key] = src
+  }
+  measured := s.Time
+  if measured.IsZero() {
+    measured = t
+  }
+  src.prev, src.prevSeen = src.fields, src.seen
+  src.fields, src.seen, src.received, src.fresh = s.Fields, measured, t, true
+}
+
+// Returns whether this rollup is due to be computed at the given time.
+func (r *Rollup) Due(now time.Time) bool {
+  return !now.Before(r.next)
+}
+
+// Compute this rollup from the samples observed since it was last
+// computed, returning a sample for each group.
+func (r *Rollup) Compute(now time.Time) []*util.Sample {
+  r.next = now.Truncate(r.interval).Add(r.interval)
+  groups := make(map[string]*util.Sample)
+  values := make(map[string]map[string][]float64)
+  for key, src := range r.sources {
+    if now.Sub(src.received) > rollupSourceTTL * r.interval {
+      delete(r.sources, key)
+      continue
+    }
+    if !src.fresh {
+      continue
+    }
+    src.fresh = false
+    tags := make(util.Tags)
+    for _, tag := range r.cfg.GroupBy {
+      tags[tag] = src.tags[tag]
+    }
+    group := tags.String()
+    if _, ok := groups[group]; !ok {
+      groups[group] = &util.Sample{Name: r.cfg.Name, Tags: tags}
+      values[group] = make(map[string][]float64)
+    }
+    for field, v := range r.sourceValues(src) {
+      values[group][field] = append(values[group][field], v)
+    }
+  }
+  rv := make([]*util.Sample, 0, len(groups))
+  for group, sample := range groups {
+    sample.Fields = make(map[string]float64)
+    for field, vs := range values[group] {
+      for _, agg := range r.cfg.Aggregates {
+        sample.Fields[field + "." + agg], _ = aggregate(agg, vs)
+      }
+    }
+    if len(sample.Fields) > 0 {
+      rv = append(rv, sample)
+    }
+  }
+  sort.Slice(rv, func(i, j int) bool {
+    return rv[i].Tags.String() < rv[j].Tags.String()
+  })
+  return rv
+}
+
+// Returns the values of a source's fields being aggregated, or their rate
+// of change when this is a rate rollup. Rates can't be given until a
+// source has reported twice, and aren't given for counters that reset.
+func (r *Rollup) sourceValues(src *rollupSource) map[string]float64 {
+  rv := make(map[string]float64)
+  elapsed := src.seen.Sub(src.prevSeen).Seconds()
+  for field, v := range src.fields {
+    if len(r.cfg.Fields) > 0 && !contains(r.cfg.Fields, field) {
+      continue
+    }
+    if !r.cfg.Rate {
+      rv[field] = v
+      continue
+    }
+    prev, ok := src.prev[field]
+    if !ok || elapsed <= 0 || v < prev {
+      continue
+    }
+    rv[field] = (v - prev) / elapsed
+  }
+  return rv
+}
+
+// Compute the named aggregate of the given values.
+func aggregate(name string, vs []float64) (float64, error) {
+  switch name {
+  case "sum", "avg":
+    var sum float64
+    for _, v := range vs {
+      sum += v
+    }
+    if name == "avg" {
+      return sum / float64(len(vs)), nil
+    }
+    return sum, nil
+  case "min":
+    min := math.Inf(1)
+    for _, v := range vs {
+      min = math.Min(min, v)
+    }
+    return min, nil
+  case "max":
+    max := math.Inf(-1)
+    for _, v := range vs {
+      max = math.Max(max, v)
+    }
+    return max, nil
+  case "count":
+    return float64(len(vs)), nil
+  }
+  if strings.HasPrefix(name, "p") {
+    p, err := strconv.ParseFloat(name[1:], 64)
+    if err == nil && p > 0 && p <= 100 {
+      return percentile(vs, p), nil
+    }
+  }
+  return 0, fmt.Errorf("unknown aggregate: %s", name)
+}
+
+// Returns the given percentile of the values, by the nearest-rank method.
+func percentile(vs []float64, p float64) float64 {
+  sorted := append([]float64{}, vs...)
+  sort.Float64s(sorted)
+  rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+  if rank < 1 {
+    rank = 1
+  }
+  return sorted[rank - 1]
+}
+
+// Returns whether the list contains the given string.
+func contains(list []string, s string) bool {
+  for _, item := range list {
+    if item == s {
+      return true
+    }
+  }
+  return false
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+  "github.com/bmizerany/assert"
+  "testing"
+  "time"
+  "../util"
+)
+
+func netSample(host, role string, rx float64) *util.Sample {
+  return &util.Sample{
+    Host: host,
+    Name: "net",
+    Tags: util.Tags{"interface": "eth0", "role": role},
+    Fields: map[string]float64{"rx_bytes": rx, "tx_bytes": rx / 2},
+  }
+}
+
+func loadSample(host, role string, load1 float64) *util.Sample {
+  return &util.Sample{
+    Host: host,
+    Name: "load",
+    Tags: util.Tags{"role": role},
+    Fields: map[string]float64{"load1": load1, "procs": 100},
+  }
+}
+
+func Test_Rollup_should_aggregate_values_by_group(t *testing.T) {
+  rollup, err := NewRollup(RollupConfig{
+    Name: "role.load",
+    Metric: "load",
+    Fields: []string{"load1"},
+    GroupBy: []string{"role"},
+    Aggregates: []string{"avg", "max", "p50", "count"},
+  })
+  if err != nil {
+    t.Fatalf("NewRollup() failed: %s", err)
+  }
+  now := time.Unix(1000, 0)
+  rollup.Observe(loadSample("web1", "web", 1), now)
+  rollup.Observe(loadSample("web2", "web", 2), now)
+  rollup.Observe(loadSample("web3", "web", 6), now)
+  rollup.Observe(loadSample("db1", "db", 4), now)
+  rollup.Observe(netSample("db1", "db", 4), now)
+  results := rollup.Compute(now)
+  assert.Equal(t, 2, len(results))
+  assert.Equal(t, "role.load", results[0].Name)
+  assert.Equal(t, util.Tags{"role": "db"}, results[0].Tags)
+  assert.Equal(t, map[string]float64{
+    "load1.avg": 4, "load1.max": 4, "load1.p50": 4, "load1.count": 1,
+  }, results[0].Fields)
+  assert.Equal(t, util.Tags{"role": "web"}, results[1].Tags)
+  assert.Equal(t, map[string]float64{
+    "load1.avg": 3, "load1.max": 6, "load1.p50": 2, "load1.count": 3,
+  }, results[1].Fields)
+}
+
+func Test_Rollup_should_sum_rates_of_filtered_samples(t *testing.T) {
+  rollup, err := NewRollup(RollupConfig{
+    Name: "web.net",
+    Metric: "net",
+    Fields: []string{"rx_bytes"},
+    Where: util.Tags{"role": "web"},
+    Aggregates: []string{"sum"},
+    Rate: true,
+  })
+  if err != nil {
+    t.Fatalf("NewRollup() failed: %s", err)
+  }
+  t0 := time.Unix(1000, 0)
+  t1 := t0.Add(10 * time.Second)
+  rollup.Observe(netSample("web1", "web", 1000), t0)
+  rollup.Observe(netSample("web2", "web", 5000), t0)
+  rollup.Observe(netSample("db1", "db", 0), t0)
+  assert.Equal(t, 0, len(rollup.Compute(t0)))
+
+  rollup.Observe(netSample("web1", "web", 2000), t1)
+  rollup.Observe(netSample("web2", "web", 8000), t1)
+  rollup.Observe(netSample("db1", "db", 99999), t1)
+  results := rollup.Compute(t1)
+  assert.Equal(t, 1, len(results))
+  assert.Equal(t, util.Tags{}, results[0].Tags)
+  assert.Equal(t, map[string]float64{"rx_bytes.sum": 400}, results[0].Fields)
+}
+
+func Test_Rollup_should_skip_hosts_that_stopped_reporting(t *testing.T) {
+  rollup, _ := NewRollup(RollupConfig{
+    Name: "all.load",
+    Metric: "load",
+    Fields: []string{"load1"},
+    Aggregates: []string{"count"},
+  })
+  t0 := time.Unix(1000, 0)
+  rollup.Observe(loadSample("web1", "web", 1), t0)
+  rollup.Observe(loadSample("web2", "web", 1), t0)
+  rollup.Compute(t0)
+  rollup.Observe(loadSample("web1", "web", 1), t0.Add(10 * time.Second))
+  results := rollup.Compute(t0.Add(10 * time.Second))
+  assert.Equal(t, map[string]float64{"load1.count": 1}, results[0].Fields)
+}
+
+func Test_NewRollup_should_reject_unknown_aggregates(t *testing.T) {
+  _, err := NewRollup(RollupConfig{
+    Name: "x", Metric: "load", Aggregates: []string{"median"},
+  })
+  assert.NotEqual(t, nil, err)
+  _, err = NewRollup(RollupConfig{
+    Name: "x", Metric: "load", Aggregates: []string{"p101"},
+  })
+  assert.NotEqual(t, nil, err)
+}
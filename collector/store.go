@@ -0,0 +1,101 @@
+package main
+
+import (
+  "sync"
+  "time"
+  "../util"
+)
+
+// Field values of a series at a point in time.
+type Point struct {
+  Time   time.Time          `json:"time"`
+  Fields map[string]float64 `json:"fields"`
+}
+
+// Sequence of samples with the same host, name and tags. Rollups are
+// stored as series without a host.
+type Series struct {
+  Host   string    `json:"host,omitempty"`
+  Name   string    `json:"name"`
+  Tags   util.Tags `json:"tags,omitempty"`
+  Points []Point   `json:"points"`
+}
+
+// In-memory store of recent samples, keeping each point for the retention
+// period.
+type Store struct {
+  mu        sync.RWMutex
+  retention time.Duration
+  series    map[string]*Series
+}
+
+// Create a new store retaining points for the given duration.
+func NewStore(retention time.Duration) *Store {
+  return &Store{retention: retention, series: make(map[string]*Series)}
+}
+
+// Returns the key identifying the series a sample belongs to.
+func seriesKey(host, name string, tags util.Tags) string {
+  return host + "\x00" + name + "\x00" + tags.String()
+}
+
+// Add a sample taken at the given time. Points are kept in time order, even
+// if they arrive out of order.
+func (st *Store) Add(s *util.Sample, t time.Time) {
+  st.mu.Lock()
+  defer st.mu.Unlock()
+  key := seriesKey(s.Host, s.Name, s.Tags)
+  series, ok := st.series[key]
+  if !ok {
+    series = &Series{Host: s.Host, Name: s.Name, Tags: s.Tags}
+    st.series[key] = series
+  }
+  points := append(series.Points, Point{Time: t, Fields: s.Fields})
+  for i := len(points) - 1; i > 0 && points[i].Time.Before(points[i - 1].Time); i-- {
+    points[i], points[i - 1] = points[i - 1], points[i]
+  }
+  series.Points = trimPoints(points, points[len(points) - 1].Time.Add(-st.retention))
+}
+
+// Returns copies of the series with the given name (and host, unless
+// empty) holding their points since the given time.
+func (st *Store) Find(host, name string, since time.Time) []*Series {
+  st.mu.RLock()
+  defer st.mu.RUnlock()
+  rv := make([]*Series, 0)
+  for _, series := range st.series {
+    if series.Name != name || (host != "" && series.Host != host) {
+      continue
+    }
+    points := trimPoints(series.Points, since)
+    rv = append(rv, &Series{
+      Host: series.Host,
+      Name: series.Name,
+      Tags: series.Tags,
+      Points: append([]Point{}, points...),
+    })
+  }
+  return rv
+}
+
+// Drop every point older than the retention period, along with series
+// left empty.
+func (st *Store) Expire(now time.Time) {
+  st.mu.Lock()
+  defer st.mu.Unlock()
+  for key, series := range st.series {
+    series.Points = trimPoints(series.Points, now.Add(-st.retention))
+    if len(series.Points) == 0 {
+      delete(st.series, key)
+    }
+  }
+}
+
+// Returns the points at or after the given time.
+func trimPoints(points []Point, since time.Time) []Point {
+  i := 0
+  for i < len(points) && points[i].Time.Before(since) {
+    i++
+  }
+  return points[i:]
+}
@@ -0,0 +1,273 @@
+package util
+
+import (
+  "bytes"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "log"
+  "net/http"
+  "strings"
+  "sync"
+  "sync/atomic"
+  "time"
+)
+
+// Attempts made to write each batch before its samples are dropped.
+const batchAttempts = 3
+
+// Error from an HTTP request that wasn't accepted.
+type HTTPError struct {
+  Status  int
+  Message string
+}
+
+func (e *HTTPError) Error() string {
+  return fmt.Sprintf("%d %s: %s", e.Status, http.StatusText(e.Status), e.Message)
+}
+
+// Returns whether the request may succeed if it's tried again, i.e. the
+// server was overloaded or failed, rather than rejecting the request.
+func (e *HTTPError) Temporary() bool {
+  return e.Status == http.StatusTooManyRequests || e.Status / 100 == 5
+}
+
+// Post a request body, returning an *HTTPError unless it's accepted.
+func Post(client *http.Client, url, contentType string, body []byte) error {
+  resp, err := client.Post(url, contentType, bytes.NewReader(body))
+  if err != nil {
+    return err
+  }
+  defer resp.Body.Close()
+  msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+  if resp.StatusCode / 100 != 2 {
+    return &HTTPError{resp.StatusCode, strings.TrimSpace(string(msg))}
+  }
+  return nil
+}
+
+// Queues samples and sends them in batches in the background, so that a
+// slow or unreachable destination never holds up whoever's adding them.
+// Queued samples are sent once a batch is full or its first sample has
+// waited for the flush window. Samples added while the queue is full are
+// dropped, as are batches that can't be sent after retrying.
+type Batcher struct {
+  // Most samples sent in a single batch.
+  BatchSize   int
+  // Longest a sample waits for its batch to fill before being sent.
+  FlushWindow time.Duration
+  // Attempts made to send each batch before its samples are dropped;
+  // unlimited if zero.
+  Attempts    int
+  // Delay before the first retry of a failed batch, doubling each time up
+  // to the maximum.
+  Backoff     time.Duration
+  MaxBackoff  time.Duration
+  // Encodes a batch once, to be sent by Send, retrying as needed. Send may
+  // return an error with a Temporary method, such as an *HTTPError, to say
+  // whether it's worth retrying.
+  Encode      func(batch []*Sample) []byte
+  Send        func(body []byte) error
+  // Called once the batcher has stopped, e.g. to release the destination.
+  OnStop      func()
+  // Name of the destination, for logging.
+  dest        string
+  queue       chan *Sample
+  done        chan struct{}
+  abort       chan struct{}
+  mu          sync.RWMutex
+  closed      bool
+  batched     int64
+  sent        uint64
+  dropped     uint64
+  overflowed  uint64
+  failed      uint64
+  batches     uint64
+  bytes       uint64
+}
+
+// Create a new batcher for the named destination, queueing up to the given
+// number of samples. It's started once its Encode and Send functions are
+// set.
+func NewBatcher(dest string, queueSize int) *Batcher {
+  return &Batcher{
+    BatchSize: 1000,
+    FlushWindow: time.Second,
+    Attempts: batchAttempts,
+    Backoff: time.Second,
+    MaxBackoff: 30 * time.Second,
+    dest: dest,
+    queue: make(chan *Sample, queueSize),
+    done: make(chan struct{}),
+    abort: make(chan struct{}),
+  }
+}
+
+// Start sending queued samples.
+func (b *Batcher) Start() {
+  go b.run()
+}
+
+// Queue the given sample for sending. Never blocks.
+func (b *Batcher) Add(sample *Sample) {
+  b.mu.RLock()
+  defer b.mu.RUnlock()
+  if b.closed {
+    return
+  }
+  select {
+  case b.queue <- sample:
+  default:
+    atomic.AddUint64(&b.overflowed, 1)
+  }
+}
+
+// Count samples dropped before they could be queued.
+func (b *Batcher) Drop(n int) {
+  atomic.AddUint64(&b.dropped, uint64(n))
+}
+
+// Stop accepting samples, and wait up to the given time for those already
+// queued to be sent. Returns an error if any had to be abandoned, including
+// a batch still waiting to be retried.
+func (b *Batcher) Close(timeout time.Duration) error {
+  b.mu.Lock()
+  b.closed = true
+  close(b.queue)
+  b.mu.Unlock()
+  select {
+  case <-b.done:
+    return nil
+  case <-time.After(timeout):
+    abandoned := len(b.queue) + int(atomic.LoadInt64(&b.batched))
+    close(b.abort)
+    return fmt.Errorf("abandoned %d queued samples", abandoned)
+  }
+}
+
+// Returns a channel that's closed once the batcher has stopped.
+func (b *Batcher) Done() <-chan struct{} {
+  return b.done
+}
+
+// Returns statistics on the samples sent so far.
+func (b *Batcher) Stats() SinkStats {
+  bytes := atomic.LoadUint64(&b.bytes)
+  return SinkStats{
+    Queued: len(b.queue) + int(atomic.LoadInt64(&b.batched)),
+    Sent: atomic.LoadUint64(&b.sent),
+    Dropped: atomic.LoadUint64(&b.dropped) + atomic.LoadUint64(&b.overflowed),
+    Failed: atomic.LoadUint64(&b.failed),
+    Batches: atomic.LoadUint64(&b.batches),
+    RawBytes: bytes,
+    WireBytes: bytes,
+  }
+}
+
+// Gather queued samples into batches and send them until the batcher is
+// closed.
+func (b *Batcher) run() {
+  defer close(b.done)
+  if b.OnStop != nil {
+    defer b.OnStop()
+  }
+  var batch []*Sample
+  var flush <-chan time.Time
+  for {
+    select {
+    case sample, ok := <-b.queue:
+      if !ok {
+        if len(batch) > 0 {
+          b.send(batch)
+        }
+        return
+      }
+      batch = append(batch, sample)
+      atomic.StoreInt64(&b.batched, int64(len(batch)))
+      if len(batch) == 1 {
+        flush = time.After(b.FlushWindow)
+      }
+      if len(batch) < b.BatchSize {
+        continue
+      }
+    case <-flush:
+    case <-b.abort:
+      return
+    }
+    if !b.send(batch) {
+      return
+    }
+    batch, flush = nil, nil
+    atomic.StoreInt64(&b.batched, 0)
+  }
+}
+
+// Send a batch of samples, retrying failures with backoff, and dropping
+// them if they still can't be sent. Returns false if the batcher was
+// aborted first.
+func (b *Batcher) send(batch []*Sample) bool {
+  if overflowed := atomic.SwapUint64(&b.overflowed, 0); overflowed > 0 {
+    log.Printf("queue for %s full: dropped %d samples\n", b.dest, overflowed)
+    atomic.AddUint64(&b.dropped, overflowed)
+  }
+  body := b.Encode(batch)
+  delay := b.Backoff
+  for attempt := 1; ; attempt++ {
+    err := b.Send(body)
+    if err == nil {
+      atomic.AddUint64(&b.sent, uint64(len(batch)))
+      atomic.AddUint64(&b.batches, 1)
+      atomic.AddUint64(&b.bytes, uint64(len(body)))
+      return true
+    }
+    atomic.AddUint64(&b.failed, 1)
+    temp, ok := err.(interface{ Temporary() bool })
+    if attempt == b.Attempts || (ok && !temp.Temporary()) {
+      log.Printf("dropping %d samples: could not send to %s: %s\n",
+                 len(batch), b.dest, err)
+      atomic.AddUint64(&b.dropped, uint64(len(batch)))
+      return true
+    }
+    log.Printf("could not send to %s, retrying: %s\n", b.dest, err)
+    timer := time.NewTimer(delay)
+    select {
+    case <-timer.C:
+    case <-b.abort:
+      timer.Stop()
+      return false
+    }
+    if delay *= 2; delay > b.MaxBackoff {
+      delay = b.MaxBackoff
+    }
+  }
+}
+
+// Core of the SampleWriters that queue samples and write them in batches
+// in the background, so a slow destination never holds up sampling.
+type batchingWriter struct {
+  *Batcher
+  // Clock by which samples are stamped with their measurement time; the
+  // system time if nil.
+  Clock Clock
+  host  string
+}
+
+// Set up a writer for samples for the given host. It's started once its
+// Encode and Send functions are set.
+func (w *batchingWriter) init(dest, host string) {
+  w.Batcher = NewBatcher(dest, netQueueSize)
+  w.host = host
+}
+
+// Queue the given sample for writing.
+func (w *batchingWriter) Write(v ...interface{}) {
+  sample, err := NewSample(v...)
+  if err != nil {
+    log.Printf("dropping malformed sample: %s\n", err)
+    w.Drop(1)
+    return
+  }
+  sample.Host = w.host
+  sample.Time = Now(w.Clock)
+  w.Add(sample)
+}
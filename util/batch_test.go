@@ -0,0 +1,83 @@
+package util
+
+import (
+  "errors"
+  "github.com/bmizerany/assert"
+  "net/http"
+  "testing"
+  "time"
+)
+
+func batchedSample(load float64) *Sample {
+  return &Sample{Name: "load", Fields: map[string]float64{"load1": load}}
+}
+
+func Test_Batcher_should_batch_and_drop_when_full(t *testing.T) {
+  sizes := make(chan int, 10)
+  release := make(chan struct{})
+  b := NewBatcher("test", 2)
+  b.BatchSize = 2
+  b.Encode = func(batch []*Sample) []byte {
+    return make([]byte, len(batch))
+  }
+  b.Send = func(body []byte) error {
+    <-release
+    sizes <- len(body)
+    return nil
+  }
+  b.Start()
+  for i := 0; i < 10; i++ {
+    b.Add(batchedSample(float64(i)))
+  }
+  close(release)
+  if err := b.Close(5 * time.Second); err != nil {
+    t.Fatalf("Close() failed: %s", err)
+  }
+  b.Add(batchedSample(0))
+  stats := b.Stats()
+  assert.Equal(t, uint64(10), stats.Sent + stats.Dropped)
+  assert.NotEqual(t, uint64(0), stats.Dropped)
+  assert.Equal(t, 2, <-sizes)
+}
+
+func Test_Batcher_should_retry_only_temporary_failures(t *testing.T) {
+  attempts := 0
+  b := NewBatcher("test", 10)
+  b.Backoff = time.Millisecond
+  b.Encode = EncodeBatch
+  b.Send = func(body []byte) error {
+    if attempts++; attempts == 1 {
+      return errors.New("connection refused")
+    }
+    return &HTTPError{http.StatusBadRequest, "unparseable"}
+  }
+  b.Start()
+  b.Add(batchedSample(0.5))
+  if err := b.Close(5 * time.Second); err != nil {
+    t.Fatalf("Close() failed: %s", err)
+  }
+  assert.Equal(t, 2, attempts)
+  stats := b.Stats()
+  assert.Equal(t, uint64(0), stats.Sent)
+  assert.Equal(t, uint64(1), stats.Dropped)
+  assert.Equal(t, uint64(2), stats.Failed)
+}
+
+func Test_Batcher_should_abandon_backoff_on_close(t *testing.T) {
+  b := NewBatcher("test", 10)
+  b.Attempts = 0
+  b.Backoff = time.Hour
+  b.Encode = EncodeBatch
+  b.Send = func(body []byte) error {
+    return errors.New("connection refused")
+  }
+  b.Start()
+  b.Add(batchedSample(0.5))
+  err := b.Close(10 * time.Millisecond)
+  assert.Equal(t, "abandoned 1 queued samples", err.Error())
+  select {
+  case <-b.Done():
+  case <-time.After(time.Second):
+    t.Fatalf("batcher still backing off after Close()")
+  }
+}
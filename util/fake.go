@@ -0,0 +1,175 @@
+package util
+
+import (
+  "io"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "sort"
+  "strings"
+  "sync"
+  "time"
+)
+
+// FileSystem backed by in-memory file contents keyed by absolute path, for
+// testing samplers against realistic multi-file /proc and /sys layouts.
+// Directories are implied by the paths of the files within them. Errors can
+// be injected per path, and the time it reports as a Clock can be set.
+type FakeFS struct {
+  mu     sync.Mutex
+  files  map[string]string
+  stats  map[string]*FSStats
+  errors map[string]error
+  now    time.Time
+}
+
+// Create a new fake filesystem holding the given path to content map.
+func NewFakeFS(files map[string]string) *FakeFS {
+  f := &FakeFS{
+    files: make(map[string]string),
+    stats: make(map[string]*FSStats),
+    errors: make(map[string]error),
+  }
+  for path, data := range files {
+    f.files[path] = data
+  }
+  return f
+}
+
+// Create a new fake filesystem holding every regular file below the given
+// fixture directory, so that e.g. dir/proc/stat is found at /proc/stat.
+func NewFakeFSFromDir(dir string) (*FakeFS, error) {
+  f := NewFakeFS(nil)
+  err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+    if err != nil || !info.Mode().IsRegular() {
+      return err
+    }
+    rel, err := filepath.Rel(dir, path)
+    if err != nil {
+      return err
+    }
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+      return err
+    }
+    f.files["/" + filepath.ToSlash(rel)] = string(data)
+    return nil
+  })
+  if err != nil {
+    return nil, err
+  }
+  return f, nil
+}
+
+// Set the contents of the file at the given path.
+func (f *FakeFS) SetFile(path, data string) {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+  f.files[path] = data
+}
+
+// Remove the file at the given path.
+func (f *FakeFS) RemoveFile(path string) {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+  delete(f.files, path)
+}
+
+// Make every operation on the given path fail with the given error, or
+// stop failing if the error is nil.
+func (f *FakeFS) SetError(path string, err error) {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+  if err == nil {
+    delete(f.errors, path)
+  } else {
+    f.errors[path] = err
+  }
+}
+
+// Set the usage statistics reported for the filesystem mounted at the
+// given path.
+func (f *FakeFS) SetStatfs(path string, stats *FSStats) {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+  f.stats[path] = stats
+}
+
+// Set the time reported by Now().
+func (f *FakeFS) SetNow(t time.Time) {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+  f.now = t
+}
+
+// Returns the time last given to SetNow(), which is the zero time until
+// it's called.
+func (f *FakeFS) Now() time.Time {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+  return f.now
+}
+
+// Opens the file at the given path.
+func (f *FakeFS) Open(path string) (io.ReadCloser, error) {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+  if err, ok := f.errors[path]; ok {
+    return nil, &os.PathError{Op: "open", Path: path, Err: err}
+  }
+  data, ok := f.files[path]
+  if !ok {
+    return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+  }
+  return ioutil.NopCloser(strings.NewReader(data)), nil
+}
+
+// Lists the files and directories directly below the given path, sorted by
+// name.
+func (f *FakeFS) ReadDir(path string) ([]os.FileInfo, error) {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+  if err, ok := f.errors[path]; ok {
+    return nil, &os.PathError{Op: "readdir", Path: path, Err: err}
+  }
+  prefix := strings.TrimSuffix(path, "/") + "/"
+  dirs := make(map[string]bool)
+  for p := range f.files {
+    if !strings.HasPrefix(p, prefix) {
+      continue
+    }
+    parts := strings.SplitN(p[len(prefix):], "/", 2)
+    dirs[parts[0]] = dirs[parts[0]] || len(parts) == 2
+  }
+  if len(dirs) == 0 {
+    return nil, &os.PathError{Op: "readdir", Path: path, Err: os.ErrNotExist}
+  }
+  names := make([]string, 0, len(dirs))
+  for name := range dirs {
+    names = append(names, name)
+  }
+  sort.Strings(names)
+  entries := make([]os.FileInfo, 0, len(names))
+  for _, name := range names {
+    mode := os.FileMode(0444)
+    if dirs[name] {
+      mode = os.ModeDir | 0555
+    }
+    entries = append(entries, &fileInfo{name: name, mode: mode})
+  }
+  return entries, nil
+}
+
+// Reports the usage statistics set for the given path by SetStatfs().
+func (f *FakeFS) Statfs(path string) (*FSStats, error) {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+  if err, ok := f.errors[path]; ok {
+    return nil, &os.PathError{Op: "statfs", Path: path, Err: err}
+  }
+  stats, ok := f.stats[path]
+  if !ok {
+    return nil, &os.PathError{Op: "statfs", Path: path, Err: os.ErrNotExist}
+  }
+  return stats, nil
+}
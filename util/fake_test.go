@@ -0,0 +1,58 @@
+package util
+
+import (
+  "github.com/bmizerany/assert"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "syscall"
+  "testing"
+)
+
+func Test_FakeFS_should_serve_files_by_path(t *testing.T) {
+  fs := NewFakeFS(map[string]string{
+    "/proc/loadavg": "0.00 0.02 0.05 1/406 16439\n",
+    "/proc/net/dev": "eth0\n",
+  })
+  assert.Equal(t, "0.00 0.02 0.05 1/406 16439\n", readAll(t, fs, "/proc/loadavg"))
+  assert.Equal(t, "eth0\n", readAll(t, fs, "/proc/net/dev"))
+  if _, err := fs.Open("/proc/stat"); !os.IsNotExist(err) {
+    t.Fatalf("expected missing file, got %v", err)
+  }
+  entries, err := fs.ReadDir("/proc")
+  if err != nil {
+    t.Fatalf("ReadDir() failed: %s", err)
+  }
+  assert.Equal(t, 2, len(entries))
+  assert.Equal(t, "loadavg", entries[0].Name())
+  assert.Equal(t, false, entries[0].IsDir())
+  assert.Equal(t, "net", entries[1].Name())
+  assert.Equal(t, true, entries[1].IsDir())
+}
+
+func Test_FakeFS_should_inject_errors_per_path(t *testing.T) {
+  fs := NewFakeFS(map[string]string{"/proc/loadavg": "0.00\n"})
+  fs.SetError("/proc/loadavg", syscall.EACCES)
+  _, err := fs.Open("/proc/loadavg")
+  if pe, ok := err.(*os.PathError); !ok || pe.Err != syscall.EACCES {
+    t.Fatalf("expected EACCES, got %v", err)
+  }
+  fs.SetError("/proc/loadavg", nil)
+  assert.Equal(t, "0.00\n", readAll(t, fs, "/proc/loadavg"))
+}
+
+func Test_FakeFS_should_load_fixture_directory(t *testing.T) {
+  dir := t.TempDir()
+  path := filepath.Join(dir, "sys/class/hwmon/hwmon0/name")
+  if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+    t.Fatal(err)
+  }
+  if err := ioutil.WriteFile(path, []byte("coretemp\n"), 0644); err != nil {
+    t.Fatal(err)
+  }
+  fs, err := NewFakeFSFromDir(dir)
+  if err != nil {
+    t.Fatalf("NewFakeFSFromDir() failed: %s", err)
+  }
+  assert.Equal(t, "coretemp\n", readAll(t, fs, "/sys/class/hwmon/hwmon0/name"))
+}
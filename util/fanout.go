@@ -0,0 +1,67 @@
+package util
+
+import (
+  "fmt"
+  "strings"
+  "sync"
+  "time"
+)
+
+// Writes every sample to each of several sinks, e.g. to send them to
+// several collectors for redundancy.
+type FanoutSampleWriter []SampleWriter
+
+// Write the given sample to every sink.
+func (f FanoutSampleWriter) Write(v ...interface{}) {
+  for _, w := range f {
+    w.Write(v...)
+  }
+}
+
+// Returns the statistics of every sink that reports them, added together.
+func (f FanoutSampleWriter) Stats() (total SinkStats) {
+  for _, w := range f {
+    sw, ok := w.(StatsSampleWriter)
+    if !ok {
+      continue
+    }
+    stats := sw.Stats()
+    total.Queued += stats.Queued
+    total.Sent += stats.Sent
+    total.Dropped += stats.Dropped
+    total.Failed += stats.Failed
+    total.Batches += stats.Batches
+    total.RawBytes += stats.RawBytes
+    total.WireBytes += stats.WireBytes
+  }
+  return
+}
+
+// Close every sink that needs it at once, waiting up to the given time for
+// each to flush. Returns an error if any of them fail to.
+func (f FanoutSampleWriter) Close(timeout time.Duration) error {
+  var wg sync.WaitGroup
+  errs := make([]error, len(f))
+  for i, w := range f {
+    cw, ok := w.(ClosingSampleWriter)
+    if !ok {
+      continue
+    }
+    wg.Add(1)
+    go func(i int, cw ClosingSampleWriter) {
+      defer wg.Done()
+      errs[i] = cw.Close(timeout)
+    }(i, cw)
+  }
+  wg.Wait()
+  msgs := make([]string, 0)
+  for _, err := range errs {
+    if err != nil {
+      msgs = append(msgs, err.Error())
+    }
+  }
+  if len(msgs) > 0 {
+    return fmt.Errorf("%s", strings.Join(msgs, "; "))
+  }
+  return nil
+}
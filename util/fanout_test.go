@@ -0,0 +1,39 @@
+package util
+
+import (
+  "errors"
+  "github.com/bmizerany/assert"
+  "testing"
+  "time"
+)
+
+type countingSink struct {
+  stats SinkStats
+  err   error
+}
+
+func (c *countingSink) Write(v ...interface{}) {
+  c.stats.Sent++
+}
+
+func (c *countingSink) Stats() SinkStats {
+  return c.stats
+}
+
+func (c *countingSink) Close(timeout time.Duration) error {
+  return c.err
+}
+
+func Test_FanoutSampleWriter_should_write_to_every_sink(t *testing.T) {
+  a := &countingSink{stats: SinkStats{Queued: 2, Dropped: 1}}
+  b := &countingSink{err: errors.New("abandoned 3 queued samples")}
+  fanout := FanoutSampleWriter{a, b}
+  fanout.Write("uptime", 10)
+  fanout.Write("uptime", 20)
+  assert.Equal(t, uint64(2), a.stats.Sent)
+  assert.Equal(t, uint64(2), b.stats.Sent)
+  assert.Equal(t, SinkStats{Queued: 2, Sent: 4, Dropped: 1}, fanout.Stats())
+  err := fanout.Close(time.Second)
+  assert.NotEqual(t, nil, err)
+  assert.Equal(t, "abandoned 3 queued samples", err.Error())
+}
@@ -3,7 +3,10 @@ package util
 import (
   "fmt"
   "io"
+  "io/ioutil"
   "os"
+  "syscall"
+  "time"
 )
 
 // Opener that returns opened files.
@@ -18,8 +21,48 @@ func (f *FileOpener) Open(path string) (io.ReadCloser, error) {
   return os.Open(path)
 }
 
+// Lists the entries of the given directory path, sorted by name.
+func (f *FileOpener) ReadDir(path string) ([]os.FileInfo, error) {
+  return ioutil.ReadDir(path)
+}
+
+// Reports usage statistics for the filesystem mounted at the given path.
+func (f *FileOpener) Statfs(path string) (*FSStats, error) {
+  return statfs(path)
+}
+
+// Calls statfs(2) on the given path.
+func statfs(path string) (*FSStats, error) {
+  var buf syscall.Statfs_t
+
+  if err := syscall.Statfs(path, &buf); err != nil {
+    return nil, err
+  }
+  return &FSStats{
+    BlockSize: uint64(buf.Bsize),
+    Blocks: buf.Blocks,
+    BlocksFree: buf.Bfree,
+    BlocksAvail: buf.Bavail,
+    Files: buf.Files,
+    FilesFree: buf.Ffree,
+  }, nil
+}
+
+// Returns the current time according to the given object if it's a Clock,
+// or the system time otherwise.
+func Now(o interface{}) time.Time {
+  if c, ok := o.(Clock); ok {
+    return c.Now()
+  }
+  return time.Now()
+}
+
 // Writes samples out to stdout.
-type ConsoleSampleWriter struct {}
+type ConsoleSampleWriter struct {
+  // Clock by which samples are stamped with their measurement time, as
+  // Unix seconds ahead of the sample; samples aren't stamped if nil.
+  Clock Clock
+}
 
 func NewConsoleSampleWriter() *ConsoleSampleWriter {
   return &ConsoleSampleWriter{}
@@ -27,6 +70,9 @@ func NewConsoleSampleWriter() *ConsoleSampleWriter {
 
 // Write the given sample out to stdout.
 func (c *ConsoleSampleWriter) Write(v ...interface{}) {
+  if c.Clock != nil {
+    v = append([]interface{}{c.Clock.Now().Unix()}, v...)
+  }
   fmt.Println(v...)
 }
 
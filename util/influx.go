@@ -0,0 +1,102 @@
+package util
+
+import (
+  "bytes"
+  "fmt"
+  "net"
+  "net/http"
+  "net/url"
+  "os"
+)
+
+// Largest datagram sent to InfluxDB over UDP; lines are packed into as few
+// datagrams of at most this size as possible.
+const maxInfluxDatagram = 1400
+
+// Writes samples as InfluxDB line protocol, to an HTTP write endpoint, a
+// UDP socket or a file. Samples are queued and written in batches in the
+// background, so a slow destination never holds up sampling.
+type InfluxSampleWriter struct {
+  batchingWriter
+}
+
+// Create a new writer sending samples tagged with the given host to the
+// given destination: an http:// or https:// write URL (e.g.
+// http://influx:8086/write?db=fleet), udp://host:port, or a file path,
+// optionally as a file:// URL, to which lines are appended.
+func NewInfluxSampleWriter(dest, host string) (*InfluxSampleWriter, error) {
+  w := &InfluxSampleWriter{}
+  w.init("InfluxDB", host)
+  u, err := url.Parse(dest)
+  if err != nil {
+    return nil, err
+  }
+  switch u.Scheme {
+  case "http", "https":
+    client := &http.Client{Timeout: netTimeout}
+    w.Send = func(body []byte) error {
+      return Post(client, dest, "text/plain; charset=utf-8", body)
+    }
+  case "udp":
+    conn, err := net.Dial("udp", u.Host)
+    if err != nil {
+      return nil, err
+    }
+    w.Send = func(body []byte) error {
+      return writeDatagrams(conn, body)
+    }
+    w.OnStop = func() {
+      conn.Close()
+    }
+  case "file", "":
+    path := dest
+    if u.Scheme == "file" {
+      path = u.Path
+    }
+    f, err := os.OpenFile(path, os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0644)
+    if err != nil {
+      return nil, err
+    }
+    w.Send = func(body []byte) error {
+      _, err := f.Write(body)
+      return err
+    }
+    w.OnStop = func() {
+      f.Close()
+    }
+  default:
+    return nil, fmt.Errorf("unsupported InfluxDB destination: %s", dest)
+  }
+  w.Encode = func(batch []*Sample) []byte {
+    var body bytes.Buffer
+    for _, sample := range batch {
+      if line := LineProtocol(sample); line != "" {
+        body.WriteString(line)
+        body.WriteByte('\n')
+      }
+    }
+    return body.Bytes()
+  }
+  w.Start()
+  return w, nil
+}
+
+// Write lines of line protocol as datagrams, packing as many whole lines
+// into each as fit.
+func writeDatagrams(conn net.Conn, body []byte) error {
+  for len(body) > 0 {
+    end := len(body)
+    if end > maxInfluxDatagram {
+      end = bytes.LastIndexByte(body[:maxInfluxDatagram], '\n') + 1
+      if end == 0 {
+        // A single line longer than a datagram goes on its own.
+        end = bytes.IndexByte(body, '\n') + 1
+      }
+    }
+    if _, err := conn.Write(body[:end]); err != nil {
+      return err
+    }
+    body = body[end:]
+  }
+  return nil
+}
@@ -0,0 +1,88 @@
+package util
+
+import (
+  "github.com/bmizerany/assert"
+  "io/ioutil"
+  "net"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+  "time"
+)
+
+func Test_InfluxSampleWriter_should_post_batches(t *testing.T) {
+  bodies := make(chan string, 10)
+  server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+                                                    r *http.Request) {
+    body, _ := ioutil.ReadAll(r.Body)
+    bodies <- r.URL.RawQuery + "\n" + string(body)
+    w.WriteHeader(http.StatusNoContent)
+  }))
+  defer server.Close()
+  w, err := NewInfluxSampleWriter(server.URL + "/write?db=fleet", "web1")
+  if err != nil {
+    t.Fatalf("NewInfluxSampleWriter() failed: %s", err)
+  }
+  w.Clock = NewTickClock(time.Unix(1500000000, 0))
+  w.Write("uptime", 10)
+  w.Write("load", 0.5, 0.25, 0.125, 120)
+  if err = w.Close(5 * time.Second); err != nil {
+    t.Fatalf("Close() failed: %s", err)
+  }
+  assert.Equal(t, "db=fleet\n" +
+                  "uptime,host=web1 seconds=10 1500000000000000000\n" +
+                  "load,host=web1 load1=0.5,load15=0.125,load5=0.25,procs=120 " +
+                  "1500000000000000000\n", <-bodies)
+  stats := w.Stats()
+  assert.Equal(t, uint64(2), stats.Sent)
+  assert.Equal(t, uint64(1), stats.Batches)
+}
+
+func Test_InfluxSampleWriter_should_append_to_file(t *testing.T) {
+  dir, _ := ioutil.TempDir("", "influx")
+  defer os.RemoveAll(dir)
+  path := filepath.Join(dir, "samples.lp")
+  for i := 0; i < 2; i++ {
+    w, err := NewInfluxSampleWriter("file://" + path, "web1")
+    if err != nil {
+      t.Fatalf("NewInfluxSampleWriter() failed: %s", err)
+    }
+    w.Clock = NewTickClock(time.Unix(1500000000, 0))
+    w.Write("uptime", 10 + i)
+    w.Close(time.Second)
+  }
+  raw, _ := ioutil.ReadFile(path)
+  assert.Equal(t, "uptime,host=web1 seconds=10 1500000000000000000\n" +
+                  "uptime,host=web1 seconds=11 1500000000000000000\n", string(raw))
+}
+
+func Test_InfluxSampleWriter_should_pack_lines_into_datagrams(t *testing.T) {
+  pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatalf("could not listen: %s", err)
+  }
+  defer pc.Close()
+  w, err := NewInfluxSampleWriter("udp://" + pc.LocalAddr().String(), "web1")
+  if err != nil {
+    t.Fatalf("NewInfluxSampleWriter() failed: %s", err)
+  }
+  for i := 0; i < 100; i++ {
+    w.Write("uptime", i)
+  }
+  w.Close(time.Second)
+  lines := 0
+  buf := make([]byte, 65536)
+  pc.SetReadDeadline(time.Now().Add(time.Second))
+  for lines < 100 {
+    n, _, err := pc.ReadFrom(buf)
+    if err != nil {
+      t.Fatalf("only received %d lines: %s", lines, err)
+    }
+    assert.Equal(t, true, n <= maxInfluxDatagram)
+    assert.Equal(t, byte('\n'), buf[n - 1])
+    lines += strings.Count(string(buf[:n]), "\n")
+  }
+}
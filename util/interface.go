@@ -2,6 +2,8 @@ package util
 
 import (
   "io"
+  "os"
+  "time"
 )
 
 // Interface for objects that can open resources (e.g. files, sockets, etc).
@@ -9,6 +11,36 @@ type Opener interface {
   Open(path string) (io.ReadCloser, error)
 }
 
+// Interface for Openers that can also list the entries of a directory.
+type DirOpener interface {
+  Opener
+  ReadDir(path string) ([]os.FileInfo, error)
+}
+
+// Usage statistics for a mounted filesystem, as reported by statfs(2).
+type FSStats struct {
+  BlockSize   uint64
+  Blocks      uint64
+  BlocksFree  uint64
+  BlocksAvail uint64
+  Files       uint64
+  FilesFree   uint64
+}
+
+// Interface for DirOpeners that can also report usage statistics for the
+// filesystem mounted at a path.
+type FileSystem interface {
+  DirOpener
+  Statfs(path string) (*FSStats, error)
+}
+
+// Interface for objects that can report the current time. Openers that
+// implement it (such as the ReplayFS) dictate the time seen by samplers
+// that calculate rates.
+type Clock interface {
+  Now() time.Time
+}
+
 // Interface for objects that sample metrics from their host system or 
 // applications periodically.
 type Sampler interface {
@@ -22,3 +54,35 @@ type SampleWriter interface {
   Write(v ...interface{})
 }
 
+
+// Statistics on the samples handled by a SampleWriter that sends them on
+// elsewhere.
+type SinkStats struct {
+  // Samples waiting to be sent.
+  Queued    int
+  // Samples sent.
+  Sent      uint64
+  // Samples dropped, because they were malformed or the queue was full.
+  Dropped   uint64
+  // Failed attempts to send samples.
+  Failed    uint64
+  // Batches of samples sent.
+  Batches   uint64
+  // Bytes of samples sent, before compression.
+  RawBytes  uint64
+  // Bytes actually sent, after compression and framing.
+  WireBytes uint64
+}
+
+// Interface for SampleWriters that can report statistics on their sending.
+type StatsSampleWriter interface {
+  SampleWriter
+  Stats() SinkStats
+}
+
+// Interface for SampleWriters that hold on to samples (e.g. queued for
+// sending), which must be closed to flush them out.
+type ClosingSampleWriter interface {
+  SampleWriter
+  Close(timeout time.Duration) error
+}
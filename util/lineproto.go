@@ -0,0 +1,77 @@
+package util
+
+import (
+  "math"
+  "sort"
+  "strconv"
+  "strings"
+)
+
+// Escapes the characters InfluxDB line protocol gives meaning to in
+// measurement names.
+var measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+
+// Escapes the characters InfluxDB line protocol gives meaning to in tag
+// keys, tag values and field keys.
+var keyEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+// Encode a sample as a line of InfluxDB line protocol, without the trailing
+// newline: the sample's name as the measurement, its host and tags as
+// tags, its fields and its time in nanoseconds. Fields are typed by the
+// sample's schema, since InfluxDB rejects writes that change a field's
+// type: those that only hold whole numbers are integers, and everything
+// else (including fractional counters) is a float.
+// Returns an empty string if the sample has no fields that can be encoded.
+func LineProtocol(s *Sample) string {
+  var b strings.Builder
+  b.WriteString(measurementEscaper.Replace(s.Name))
+  tags := s.Tags
+  if s.Host != "" {
+    tags = s.Tags.Merge(Tags{"host": s.Host})
+  }
+  for _, key := range tags.Keys() {
+    if tags[key] == "" {
+      continue
+    }
+    b.WriteByte(',')
+    b.WriteString(keyEscaper.Replace(key))
+    b.WriteByte('=')
+    b.WriteString(keyEscaper.Replace(tags[key]))
+  }
+  names := make([]string, 0, len(s.Fields))
+  for name := range s.Fields {
+    names = append(names, name)
+  }
+  sort.Strings(names)
+  schema := Schemas[s.Name]
+  sep := byte(' ')
+  for _, name := range names {
+    value := s.Fields[name]
+    integer := schema.IsInteger(name)
+    if integer {
+      value = math.Round(value)
+    }
+    if math.IsNaN(value) || math.IsInf(value, 0) ||
+       integer && math.Abs(value) >= 1 << 63 {
+      continue
+    }
+    b.WriteByte(sep)
+    sep = ','
+    b.WriteString(keyEscaper.Replace(name))
+    b.WriteByte('=')
+    if integer {
+      b.WriteString(strconv.FormatInt(int64(value), 10))
+      b.WriteByte('i')
+    } else {
+      b.WriteString(strconv.FormatFloat(value, 'f', -1, 64))
+    }
+  }
+  if sep == ' ' {
+    return ""
+  }
+  if !s.Time.IsZero() {
+    b.WriteByte(' ')
+    b.WriteString(strconv.FormatInt(s.Time.UnixNano(), 10))
+  }
+  return b.String()
+}
@@ -0,0 +1,35 @@
+package util
+
+import (
+  "github.com/bmizerany/assert"
+  "math"
+  "testing"
+  "time"
+)
+
+func Test_LineProtocol_should_encode_typed_fields_and_escape(t *testing.T) {
+  s, _ := NewSample("net", "eth 0", uint64(100), 2, 0, 0, 50, 1, 0, 0,
+                    Tags{"role": "web,db", "host": "bogus"})
+  s.Host = "web1"
+  s.Time = time.Unix(1500000000, 5)
+  assert.Equal(t, `net,host=web1,interface=eth\ 0,role=web\,db ` +
+                  `rx_bytes=100i,rx_drops=0i,rx_errors=0i,rx_packets=2i,` +
+                  `tx_bytes=50i,tx_drops=0i,tx_errors=0i,tx_packets=1i ` +
+                  `1500000000000000005`, LineProtocol(s))
+
+  // Fractional counters stay floats.
+  s, _ = NewSample("agent.runtime", 12, 1024, 4096, 3, 0.25, 1.5, 20480)
+  assert.Equal(t, "agent.runtime cpu_system=1.5,cpu_user=0.25,gc_count=3i," +
+                  "goroutines=12,heap_alloc=1024,heap_sys=4096,max_rss_kb=20480",
+               LineProtocol(s))
+  s, _ = NewSample("log.histogram", "latency", 2, 0.75)
+  assert.Equal(t, "log.histogram,rule=latency count=2i,sum=0.75", LineProtocol(s))
+
+  s, _ = NewSample("load", 0.5, 1.25, 2, 120)
+  assert.Equal(t, "load load1=0.5,load15=2,load5=1.25,procs=120", LineProtocol(s))
+
+  s = &Sample{Name: "app metric", Fields: map[string]float64{"x=y": math.NaN()}}
+  assert.Equal(t, "", LineProtocol(s))
+  s.Fields["ok"] = 1.5
+  assert.Equal(t, `app\ metric ok=1.5`, LineProtocol(s))
+}
@@ -0,0 +1,295 @@
+package util
+
+import (
+  "bufio"
+  "crypto/tls"
+  "errors"
+  "fmt"
+  "hash/fnv"
+  "log"
+  "net"
+  "sync"
+  "sync/atomic"
+  "time"
+)
+
+// Number of samples queued for the collector before new ones are dropped.
+const netQueueSize = 10000
+
+// Delays between attempts to reconnect to the collector.
+const (
+  minRedialDelay = time.Second
+  maxRedialDelay = 30 * time.Second
+)
+
+// Longest we wait for the collector to answer or accept what we send.
+const netTimeout = 10 * time.Second
+
+// Writes samples to a collector over TCP. Samples are queued and sent in
+// the background, so that a slow or unreachable collector never holds up
+// sampling; the connection is re-established whenever it fails. Samples
+// written while the queue is full are dropped. Queued samples are sent in
+// batches, once a batch is full or its first sample has waited for the
+// flush window, and compressed if the collector supports it. If failover
+// collectors are given, samples are sent to the first of them that can be
+// reached whenever the primary can't, until the primary is found healthy
+// again.
+type NetSampleWriter struct {
+  batchingWriter
+  // Source of client certificates for mutual TLS with the collector; the
+  // connection is unencrypted if nil.
+  TLS              *TLSReloader
+  // Compression methods to offer the collector, in order of preference;
+  // batches are sent uncompressed if it supports none of them.
+  Compression      []string
+  // Addresses of collectors to fail over to, in order of preference.
+  Failover         []string
+  // How often to check whether the primary collector is healthy again,
+  // while sending to a failover one.
+  FailbackInterval time.Duration
+  // Interval between samples, advertised to the collector so that it
+  // knows when to expect them.
+  Interval         time.Duration
+  addr             string
+  mu               sync.Mutex
+  conn             net.Conn
+  connAddr         string
+  probed           time.Time
+  probing          bool
+  probes           chan *failbackProbe
+  compression      string
+  wireBytes        uint64
+}
+
+// Create a new writer sending samples for the given host to the collector
+// at the given address.
+func NewNetSampleWriter(addr, host string) *NetSampleWriter {
+  w := &NetSampleWriter{
+    Compression: Compressions(),
+    FailbackInterval: 30 * time.Second,
+    addr: addr,
+    probes: make(chan *failbackProbe),
+  }
+  w.init("collector", host)
+  // Keep trying to reach a collector for as long as it takes.
+  w.Attempts = 0
+  w.Backoff = minRedialDelay
+  w.MaxBackoff = maxRedialDelay
+  w.Encode = EncodeBatch
+  w.Send = w.send
+  w.OnStop = w.leave
+  w.Start()
+  return w
+}
+
+// Stop accepting samples, and wait up to the given time for those already
+// queued to be sent. Returns an error if any had to be abandoned.
+func (w *NetSampleWriter) Close(timeout time.Duration) error {
+  err := w.Batcher.Close(timeout)
+  if err != nil {
+    // Don't wait on a write the collector isn't accepting.
+    w.disconnect()
+  }
+  return err
+}
+
+// Returns statistics on the samples sent to the collector so far.
+func (w *NetSampleWriter) Stats() SinkStats {
+  stats := w.Batcher.Stats()
+  stats.WireBytes = atomic.LoadUint64(&w.wireBytes)
+  return stats
+}
+
+// Send an encoded batch to the collector, connecting first if need be.
+func (w *NetSampleWriter) send(body []byte) error {
+  if len(body) == 0 {
+    // An empty frame would say goodbye.
+    return nil
+  }
+  w.failback()
+  w.mu.Lock()
+  conn := w.conn
+  w.mu.Unlock()
+  if conn == nil {
+    if conn = w.connect(); conn == nil {
+      return errors.New("no collector reachable")
+    }
+  }
+  conn.SetWriteDeadline(time.Now().Add(netTimeout))
+  wire, err := WriteFrame(conn, w.compression, body)
+  if err != nil {
+    w.disconnect()
+    return fmt.Errorf("lost connection to collector at %s: %s", w.connAddr,
+                      err)
+  }
+  atomic.AddUint64(&w.wireBytes, uint64(wire))
+  return nil
+}
+
+// Connect to the first collector that can be reached, in order of
+// preference. Returns nil if none can be.
+func (w *NetSampleWriter) connect() net.Conn {
+  for _, addr := range append([]string{w.addr}, w.Failover...) {
+    conn, compression, err := w.dial(addr)
+    if err != nil {
+      log.Printf("could not connect to collector at %s: %s\n", addr, err)
+      continue
+    }
+    if addr != w.addr {
+      log.Printf("failed over to collector at %s\n", addr)
+    }
+    w.use(conn, addr, compression)
+    return conn
+  }
+  return nil
+}
+
+// Outcome of checking whether the primary collector is healthy again: a
+// connection to it, or nil if it couldn't be reached.
+type failbackProbe struct {
+  conn        net.Conn
+  compression string
+}
+
+// Switch back to the primary collector if we've failed over and it's been
+// found healthy. The primary is probed in the background, no more often
+// than the failback interval, so that batches keep flowing to the failover
+// collector until the primary has answered.
+func (w *NetSampleWriter) failback() {
+  select {
+  case probe := <-w.probes:
+    w.probing = false
+    if probe == nil {
+      break
+    }
+    w.mu.Lock()
+    connected := w.conn != nil
+    w.mu.Unlock()
+    if connected && w.connAddr == w.addr {
+      // Already back on the primary.
+      goodbye(probe.conn)
+      break
+    }
+    log.Printf("primary collector at %s is back\n", w.addr)
+    w.leave()
+    w.use(probe.conn, w.addr, probe.compression)
+    return
+  default:
+  }
+  w.mu.Lock()
+  connected := w.conn != nil
+  w.mu.Unlock()
+  if w.probing || !connected || w.connAddr == w.addr ||
+     time.Since(w.probed) < w.FailbackInterval {
+    return
+  }
+  w.probed, w.probing = time.Now(), true
+  go w.probe()
+}
+
+// Try to connect to the primary collector, handing the outcome over to
+// failback() unless the writer stops first.
+func (w *NetSampleWriter) probe() {
+  var probe *failbackProbe
+  if conn, compression, err := w.dial(w.addr); err == nil {
+    probe = &failbackProbe{conn: conn, compression: compression}
+  }
+  select {
+  case w.probes <- probe:
+  case <-w.Done():
+    if probe != nil {
+      goodbye(probe.conn)
+    }
+  }
+}
+
+// Send further batches over the given connection.
+func (w *NetSampleWriter) use(conn net.Conn, addr, compression string) {
+  w.mu.Lock()
+  defer w.mu.Unlock()
+  w.conn, w.connAddr, w.compression = conn, addr, compression
+  w.probed = time.Now()
+}
+
+// Say goodbye to the collector, if connected, so that it knows we've left
+// on purpose, and close the connection.
+func (w *NetSampleWriter) leave() {
+  w.mu.Lock()
+  defer w.mu.Unlock()
+  if w.conn != nil {
+    goodbye(w.conn)
+    w.conn = nil
+  }
+}
+
+// Say goodbye on the given connection to a collector, and close it.
+func goodbye(conn net.Conn) {
+  conn.SetWriteDeadline(time.Now().Add(netTimeout))
+  WriteGoodbye(conn)
+  conn.Close()
+}
+
+// Close the connection to the collector, if there is one, without saying
+// goodbye.
+func (w *NetSampleWriter) disconnect() {
+  w.mu.Lock()
+  defer w.mu.Unlock()
+  if w.conn != nil {
+    w.conn.Close()
+    w.conn = nil
+  }
+}
+
+// Connect to the collector at the given address, introduce ourselves and
+// agree how batches will be compressed.
+func (w *NetSampleWriter) dial(addr string) (net.Conn, string, error) {
+  dialer := &net.Dialer{Timeout: netTimeout}
+  var conn net.Conn
+  var err error
+  if w.TLS != nil {
+    host, _, _ := net.SplitHostPort(addr)
+    conn, err = tls.DialWithDialer(dialer, "tcp", addr, w.TLS.ClientConfig(host))
+  } else {
+    conn, err = dialer.Dial("tcp", addr)
+  }
+  if err != nil {
+    return nil, "", err
+  }
+  conn.SetDeadline(time.Now().Add(netTimeout))
+  hello := &Hello{
+    Host: w.host,
+    Version: ProtocolVersion,
+    Compression: w.Compression,
+    Interval: w.Interval.Seconds(),
+  }
+  if err = WriteMessage(conn, hello); err != nil {
+    conn.Close()
+    return nil, "", err
+  }
+  var welcome Welcome
+  if err = ReadMessage(bufio.NewReader(conn), &welcome); err != nil {
+    conn.Close()
+    return nil, "", fmt.Errorf("no welcome from collector: %s", err)
+  }
+  if welcome.Compression != "" &&
+     NegotiateCompression([]string{welcome.Compression}) == "" {
+    conn.Close()
+    return nil, "", fmt.Errorf("collector chose unknown compression: %s",
+                               welcome.Compression)
+  }
+  conn.SetDeadline(time.Time{})
+  return conn, welcome.Compression, nil
+}
+
+// Order the given collector addresses so that hosts are spread evenly
+// across them: each host's primary is picked by a hash of its name, and
+// the rest follow in turn as its failover collectors.
+func ShardCollectors(addrs []string, host string) []string {
+  if len(addrs) == 0 {
+    return addrs
+  }
+  h := fnv.New32a()
+  h.Write([]byte(host))
+  first := int(h.Sum32() % uint32(len(addrs)))
+  return append(append([]string{}, addrs[first:]...), addrs[:first]...)
+}
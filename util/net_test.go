@@ -0,0 +1,135 @@
+package util
+
+import (
+  "bufio"
+  "fmt"
+  "github.com/bmizerany/assert"
+  "net"
+  "strings"
+  "testing"
+  "time"
+)
+
+func Test_NetSampleWriter_should_give_up_on_unreachable_collector(t *testing.T) {
+  l, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatalf("could not listen: %s", err)
+  }
+  addr := l.Addr().String()
+  l.Close()
+  w := NewNetSampleWriter(addr, "web1")
+  w.Write("uptime", 10)
+  w.Write("uptime", 20)
+  w.Write("load", 1.0)
+  start := time.Now()
+  err = w.Close(100 * time.Millisecond)
+  if err == nil || !strings.Contains(err.Error(), "abandoned 2 queued samples") {
+    t.Fatalf("expected abandoned samples, got %v", err)
+  }
+  assert.Equal(t, true, time.Since(start) < time.Second)
+  stats := w.Stats()
+  assert.Equal(t, uint64(0), stats.Sent)
+  assert.Equal(t, uint64(1), stats.Dropped)
+  assert.NotEqual(t, uint64(0), stats.Failed)
+}
+
+// Accept connections as a collector would, counting the samples received.
+func serveSamples(l net.Listener, received chan int) {
+  for {
+    conn, err := l.Accept()
+    if err != nil {
+      return
+    }
+    go func() {
+      defer conn.Close()
+      r := bufio.NewReader(conn)
+      var hello Hello
+      if ReadMessage(r, &hello) != nil || WriteMessage(conn, &Welcome{}) != nil {
+        return
+      }
+      for {
+        samples, err := ReadBatch(r, "")
+        if err != nil {
+          return
+        }
+        received <- len(samples)
+      }
+    }()
+  }
+}
+
+func Test_NetSampleWriter_should_keep_sending_while_probing_primary(t *testing.T) {
+  secondary, _ := net.Listen("tcp", "127.0.0.1:0")
+  defer secondary.Close()
+  received := make(chan int, 100)
+  go serveSamples(secondary, received)
+  l, _ := net.Listen("tcp", "127.0.0.1:0")
+  primaryAddr := l.Addr().String()
+  l.Close()
+
+  w := NewNetSampleWriter(primaryAddr, "web1")
+  w.Failover = []string{secondary.Addr().String()}
+  w.FlushWindow = time.Millisecond
+  w.FailbackInterval = time.Millisecond
+  w.Write("uptime", 10)
+  select {
+  case <-received:
+  case <-time.After(5 * time.Second):
+    t.Fatalf("never failed over")
+  }
+
+  // The primary comes back, but hangs before welcoming the agent.
+  primary, err := net.Listen("tcp", primaryAddr)
+  if err != nil {
+    t.Fatalf("could not listen: %s", err)
+  }
+  defer primary.Close()
+  hung := make(chan net.Conn, 10)
+  go func() {
+    for {
+      conn, err := primary.Accept()
+      if err != nil {
+        return
+      }
+      hung <- conn
+    }
+  }()
+  for i := 0; i < 5; i++ {
+    time.Sleep(20 * time.Millisecond)
+    w.Write("uptime", 20)
+    select {
+    case <-received:
+    case <-time.After(time.Second):
+      t.Fatalf("sending was held up by the primary")
+    }
+  }
+  assert.Equal(t, 1, len(hung))
+  (<-hung).Close()
+  w.Close(time.Second)
+}
+
+func Test_ShardCollectors_should_spread_hosts_across_collectors(t *testing.T) {
+  addrs := []string{"c1:5150", "c2:5150", "c3:5150"}
+  primaries := make(map[string]int)
+  for i := 0; i < 30; i++ {
+    host := fmt.Sprintf("web%d", i)
+    order := ShardCollectors(addrs, host)
+    assert.Equal(t, order, ShardCollectors(addrs, host))
+    assert.Equal(t, 3, len(order))
+    for j := range order {
+      assert.Equal(t, addrs[(j + indexOf(addrs, order[0])) % 3], order[j])
+    }
+    primaries[order[0]]++
+  }
+  assert.Equal(t, 3, len(primaries))
+  assert.Equal(t, []string{"c1:5150", "c2:5150", "c3:5150"}, addrs)
+}
+
+func indexOf(values []string, value string) int {
+  for i, v := range values {
+    if v == value {
+      return i
+    }
+  }
+  return -1
+}
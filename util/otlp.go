@@ -0,0 +1,336 @@
+package util
+
+import (
+  "encoding/binary"
+  "math"
+  "net/http"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+// OTLP metrics are protobuf messages (ExportMetricsServiceRequest, from
+// opentelemetry/proto/collector/metrics/v1), which are encoded here by
+// hand. Each field of a sample becomes a metric named <sample>.<field>:
+// a monotonic sum if the sample's schema says it's a counter, and a gauge
+// otherwise. The sample's tags given in its schema (or tag1, tag2, etc for
+// samples without one) describe what was measured and become attributes
+// of its data points, while the rest describe the host (e.g. its region)
+// and become attributes of its resource, along with the host's name.
+
+// Name of the instrumentation scope of exported metrics.
+const otlpScope = "monitor"
+
+// How long the encoder remembers a counter that's no longer reported.
+const otlpSeriesTTL = time.Hour
+
+// Semantic convention names of resource attributes for our own tags.
+var otlpResourceNames = map[string]string{
+  "hostname": "host.name",
+  "cloud": "cloud.provider",
+  "region": "cloud.region",
+  "zone": "cloud.availability_zone",
+  "instance_id": "host.id",
+}
+
+// Aggregation temporalities of OTLP sums.
+const (
+  otlpDelta      = 1
+  otlpCumulative = 2
+)
+
+// Encodes samples as OTLP metrics export requests, remembering enough of
+// each counter between requests to give its sums a start time, or to send
+// them as deltas.
+type OTLPEncoder struct {
+  // Send counters as the change since their last sample, rather than
+  // their cumulative totals.
+  Delta    bool
+  mu       sync.Mutex
+  counters map[string]*otlpCounter
+}
+
+// What's remembered of a counter.
+type otlpCounter struct {
+  start time.Time
+  last  float64
+  seen  time.Time
+}
+
+// A single data point of a metric.
+type otlpPoint struct {
+  attrs Tags
+  start time.Time
+  time  time.Time
+  value float64
+}
+
+// A metric, with its data points from a batch of samples.
+type otlpMetric struct {
+  name   string
+  sum    bool
+  points []otlpPoint
+}
+
+// The metrics of a single resource.
+type otlpResource struct {
+  attrs   Tags
+  metrics map[string]*otlpMetric
+  names   []string
+}
+
+// Create a new encoder.
+func NewOTLPEncoder() *OTLPEncoder {
+  return &OTLPEncoder{counters: make(map[string]*otlpCounter)}
+}
+
+// Encode a batch of samples as an export request.
+func (e *OTLPEncoder) Encode(samples []*Sample) []byte {
+  e.mu.Lock()
+  defer e.mu.Unlock()
+  resources := make(map[string]*otlpResource)
+  keys := make([]string, 0)
+  var newest time.Time
+  for _, s := range samples {
+    if s.Time.After(newest) {
+      newest = s.Time
+    }
+    attrs, resAttrs := splitOTLPTags(s)
+    key := resAttrs.String()
+    res, ok := resources[key]
+    if !ok {
+      res = &otlpResource{attrs: resAttrs, metrics: make(map[string]*otlpMetric)}
+      resources[key] = res
+      keys = append(keys, key)
+    }
+    schema := Schemas[s.Name]
+    for field, value := range s.Fields {
+      if math.IsNaN(value) || math.IsInf(value, 0) {
+        continue
+      }
+      name := s.Name + "." + field
+      point := otlpPoint{attrs: attrs, time: s.Time, value: value}
+      sum := schema.IsCounter(field)
+      if sum && !e.counter(s, field, &point) {
+        continue
+      }
+      metric, ok := res.metrics[name]
+      if !ok {
+        metric = &otlpMetric{name: name, sum: sum}
+        res.metrics[name] = metric
+        res.names = append(res.names, name)
+      }
+      metric.points = append(metric.points, point)
+    }
+  }
+  for key, c := range e.counters {
+    if newest.Sub(c.seen) > otlpSeriesTTL {
+      delete(e.counters, key)
+    }
+  }
+
+  var req protoBuffer
+  sort.Strings(keys)
+  for _, key := range keys {
+    res := resources[key]
+    sort.Strings(res.names)
+    req.message(1, func(rm *protoBuffer) {
+      rm.message(1, func(r *protoBuffer) {
+        for _, k := range res.attrs.Keys() {
+          r.message(1, func(kv *protoBuffer) {
+            otlpKeyValue(kv, k, res.attrs[k])
+          })
+        }
+      })
+      rm.message(2, func(sm *protoBuffer) {
+        sm.message(1, func(scope *protoBuffer) {
+          scope.string(1, otlpScope)
+        })
+        for _, name := range res.names {
+          e.encodeMetric(sm, res.metrics[name])
+        }
+      })
+    })
+  }
+  return req.bytes
+}
+
+// Work out the start time (and for deltas, the value) of a counter's data
+// point from what's remembered of the counter. Returns false if the point
+// shouldn't be sent, because it's the first of a delta.
+func (e *OTLPEncoder) counter(s *Sample, field string, point *otlpPoint) bool {
+  key := otlpCounterKey(s, field)
+  c, ok := e.counters[key]
+  if !ok {
+    e.counters[key] = &otlpCounter{start: s.Time, last: point.value, seen: s.Time}
+    point.start = s.Time
+    return !e.Delta
+  }
+  value := point.value
+  if value < c.last {
+    // The counter was reset, sometime since it was last seen.
+    c.start, c.last = c.seen, 0
+  }
+  if e.Delta {
+    point.start, point.value = c.seen, value - c.last
+  } else {
+    point.start = c.start
+  }
+  c.last, c.seen = value, s.Time
+  return true
+}
+
+// Encode a metric into a ScopeMetrics message.
+func (e *OTLPEncoder) encodeMetric(sm *protoBuffer, metric *otlpMetric) {
+  sm.message(2, func(m *protoBuffer) {
+    m.string(1, metric.name)
+    points := func(data *protoBuffer) {
+      for _, p := range metric.points {
+        data.message(1, func(dp *protoBuffer) {
+          if !p.start.IsZero() {
+            dp.fixed64(2, uint64(p.start.UnixNano()))
+          }
+          dp.fixed64(3, uint64(p.time.UnixNano()))
+          dp.fixed64(4, math.Float64bits(p.value))
+          for _, k := range p.attrs.Keys() {
+            dp.message(7, func(kv *protoBuffer) {
+              otlpKeyValue(kv, k, p.attrs[k])
+            })
+          }
+        })
+      }
+    }
+    if !metric.sum {
+      m.message(5, points)
+      return
+    }
+    m.message(7, func(sum *protoBuffer) {
+      points(sum)
+      if e.Delta {
+        sum.varint(2, otlpDelta)
+      } else {
+        sum.varint(2, otlpCumulative)
+      }
+      sum.varint(3, 1)
+    })
+  })
+}
+
+// Split a sample's tags into those describing what was measured, which
+// become data point attributes, and those describing the host, which
+// become resource attributes.
+func splitOTLPTags(s *Sample) (attrs, resAttrs Tags) {
+  attrs, resAttrs = make(Tags), make(Tags)
+  schema, known := Schemas[s.Name]
+  for k, v := range s.Tags {
+    measured := false
+    if known {
+      for _, tag := range schema.Tags {
+        measured = measured || tag == k
+      }
+    } else if strings.HasPrefix(k, "tag") {
+      _, err := strconv.Atoi(k[3:])
+      measured = err == nil
+    }
+    if measured {
+      attrs[k] = v
+    } else if name, ok := otlpResourceNames[k]; ok {
+      resAttrs[name] = v
+    } else {
+      resAttrs[k] = v
+    }
+  }
+  if s.Host != "" {
+    resAttrs["host.name"] = s.Host
+  }
+  return
+}
+
+// Returns the key identifying a counter: a field of a sample's series.
+func otlpCounterKey(s *Sample, field string) string {
+  return s.Host + "\x00" + s.Name + "\x00" + s.Tags.String() + "\x00" + field
+}
+
+// Encode a KeyValue with a string value.
+func otlpKeyValue(kv *protoBuffer, key, value string) {
+  kv.string(1, key)
+  kv.message(2, func(v *protoBuffer) {
+    v.string(1, value)
+  })
+}
+
+// Protobuf wire types.
+const (
+  protoVarint  = 0
+  protoFixed64 = 1
+  protoBytes   = 2
+)
+
+// Buffer into which a protobuf message is encoded.
+type protoBuffer struct {
+  bytes []byte
+}
+
+// Append a field's key.
+func (b *protoBuffer) key(field, wireType int) {
+  b.bytes = binary.AppendUvarint(b.bytes, uint64(field << 3 | wireType))
+}
+
+// Append a varint field.
+func (b *protoBuffer) varint(field int, v uint64) {
+  b.key(field, protoVarint)
+  b.bytes = binary.AppendUvarint(b.bytes, v)
+}
+
+// Append a fixed64 (or double) field.
+func (b *protoBuffer) fixed64(field int, v uint64) {
+  b.key(field, protoFixed64)
+  b.bytes = binary.LittleEndian.AppendUint64(b.bytes, v)
+}
+
+// Append a string field.
+func (b *protoBuffer) string(field int, s string) {
+  b.key(field, protoBytes)
+  b.bytes = binary.AppendUvarint(b.bytes, uint64(len(s)))
+  b.bytes = append(b.bytes, s...)
+}
+
+// Append an embedded message field, encoded by the given function.
+func (b *protoBuffer) message(field int, encode func(*protoBuffer)) {
+  var m protoBuffer
+  encode(&m)
+  b.key(field, protoBytes)
+  b.bytes = binary.AppendUvarint(b.bytes, uint64(len(m.bytes)))
+  b.bytes = append(b.bytes, m.bytes...)
+}
+
+// Writes samples as OTLP metrics to an OTLP/HTTP endpoint, encoded as
+// protobuf. Samples are queued and written in batches in the background,
+// so a slow endpoint never holds up sampling.
+type OTLPSampleWriter struct {
+  batchingWriter
+  // Send counters as the change since their last sample, rather than
+  // their cumulative totals. Must be set before the first sample's
+  // written.
+  Delta bool
+}
+
+// Create a new writer sending samples for the given host to the given
+// OTLP/HTTP metrics endpoint, e.g. http://otel:4318/v1/metrics.
+func NewOTLPSampleWriter(endpoint, host string) *OTLPSampleWriter {
+  w := &OTLPSampleWriter{}
+  w.init("OTLP endpoint", host)
+  client := &http.Client{Timeout: netTimeout}
+  encoder := NewOTLPEncoder()
+  w.Encode = func(batch []*Sample) []byte {
+    encoder.Delta = w.Delta
+    return encoder.Encode(batch)
+  }
+  w.Send = func(body []byte) error {
+    return Post(client, endpoint, "application/x-protobuf", body)
+  }
+  w.Start()
+  return w
+}
@@ -0,0 +1,163 @@
+package util
+
+import (
+  "encoding/binary"
+  "github.com/bmizerany/assert"
+  "io/ioutil"
+  "math"
+  "net/http"
+  "net/http/httptest"
+  "testing"
+  "time"
+)
+
+// Decoded protobuf message: the values of each field, as uint64s for
+// varints and fixed64s, or []byte for strings and embedded messages.
+type protoMessage map[int][]interface{}
+
+func decodeProto(t *testing.T, b []byte) protoMessage {
+  m := make(protoMessage)
+  for len(b) > 0 {
+    key, n := binary.Uvarint(b)
+    b = b[n:]
+    field := int(key >> 3)
+    switch key & 7 {
+    case protoVarint:
+      v, n := binary.Uvarint(b)
+      m[field] = append(m[field], v)
+      b = b[n:]
+    case protoFixed64:
+      m[field] = append(m[field], binary.LittleEndian.Uint64(b))
+      b = b[8:]
+    case protoBytes:
+      size, n := binary.Uvarint(b)
+      m[field] = append(m[field], b[n:n + int(size)])
+      b = b[n + int(size):]
+    default:
+      t.Fatalf("unexpected wire type in key %d", key)
+    }
+  }
+  return m
+}
+
+func (m protoMessage) message(t *testing.T, field, i int) protoMessage {
+  return decodeProto(t, m[field][i].([]byte))
+}
+
+func (m protoMessage) string(field int) string {
+  return string(m[field][0].([]byte))
+}
+
+// Returns the string attributes in the given field of a message.
+func otlpAttrs(t *testing.T, m protoMessage, field int) Tags {
+  attrs := make(Tags)
+  for i := range m[field] {
+    kv := m.message(t, field, i)
+    attrs[kv.string(1)] = kv.message(t, 2, 0).string(1)
+  }
+  return attrs
+}
+
+// Returns the metrics of the only resource in an export request, by name.
+func otlpMetrics(t *testing.T, req []byte) (Tags, map[string]protoMessage) {
+  rm := decodeProto(t, req)
+  assert.Equal(t, 1, len(rm[1]))
+  res := rm.message(t, 1, 0)
+  sm := res.message(t, 2, 0)
+  assert.Equal(t, otlpScope, sm.message(t, 1, 0).string(1))
+  metrics := make(map[string]protoMessage)
+  for i := range sm[2] {
+    metric := sm.message(t, 2, i)
+    metrics[metric.string(1)] = metric
+  }
+  return otlpAttrs(t, res.message(t, 1, 0), 1), metrics
+}
+
+func otlpTestSamples(rx ...float64) []*Sample {
+  samples := make([]*Sample, 0)
+  for i, bytes := range rx {
+    s, _ := NewSample("net", "eth0", bytes, 1, 0, 0, 2, 1, 0, 0,
+                      Tags{"hostname": "web1", "region": "eu", "role": "web"})
+    s.Host = "web1"
+    s.Time = time.Unix(1500000000 + int64(i) * 10, 0)
+    samples = append(samples, s)
+  }
+  load, _ := NewSample("load", 0.5, 0.25, 0.125, 120, Tags{"hostname": "web1",
+                                                           "region": "eu",
+                                                           "role": "web"})
+  load.Host = "web1"
+  load.Time = time.Unix(1500000000, 0)
+  return append(samples, load)
+}
+
+func Test_OTLPEncoder_should_map_counters_to_cumulative_sums(t *testing.T) {
+  e := NewOTLPEncoder()
+  attrs, metrics := otlpMetrics(t, e.Encode(otlpTestSamples(1000, 3000)))
+  assert.Equal(t, Tags{"host.name": "web1", "cloud.region": "eu", "role": "web"},
+               attrs)
+  assert.Equal(t, 12, len(metrics))
+
+  gauge := metrics["load.load1"].message(t, 5, 0)
+  assert.Equal(t, 1, len(gauge[1]))
+  dp := gauge.message(t, 1, 0)
+  assert.Equal(t, 0.5, math.Float64frombits(dp[4][0].(uint64)))
+  assert.Equal(t, uint64(1500000000e9), dp[3][0])
+  assert.Equal(t, 0, len(dp[2]))
+
+  sum := metrics["net.rx_bytes"].message(t, 7, 0)
+  assert.Equal(t, uint64(otlpCumulative), sum[2][0])
+  assert.Equal(t, uint64(1), sum[3][0])
+  assert.Equal(t, 2, len(sum[1]))
+  dp = sum.message(t, 1, 1)
+  assert.Equal(t, Tags{"interface": "eth0"}, otlpAttrs(t, dp, 7))
+  assert.Equal(t, uint64(1500000000e9), dp[2][0])
+  assert.Equal(t, uint64(1500000010e9), dp[3][0])
+  assert.Equal(t, 3000.0, math.Float64frombits(dp[4][0].(uint64)))
+
+  // Once reset, a counter starts again from when it was last seen.
+  _, metrics = otlpMetrics(t, e.Encode(otlpTestSamples(1000, 3000, 500)[2:3]))
+  dp = metrics["net.rx_bytes"].message(t, 7, 0).message(t, 1, 0)
+  assert.Equal(t, uint64(1500000010e9), dp[2][0])
+  assert.Equal(t, 500.0, math.Float64frombits(dp[4][0].(uint64)))
+}
+
+func Test_OTLPEncoder_should_send_deltas_when_asked(t *testing.T) {
+  e := NewOTLPEncoder()
+  e.Delta = true
+  _, metrics := otlpMetrics(t, e.Encode(otlpTestSamples(1000, 3000)))
+  sum := metrics["net.rx_bytes"].message(t, 7, 0)
+  assert.Equal(t, uint64(otlpDelta), sum[2][0])
+  assert.Equal(t, 1, len(sum[1]))
+  dp := sum.message(t, 1, 0)
+  assert.Equal(t, uint64(1500000000e9), dp[2][0])
+  assert.Equal(t, uint64(1500000010e9), dp[3][0])
+  assert.Equal(t, 2000.0, math.Float64frombits(dp[4][0].(uint64)))
+}
+
+func Test_OTLPSampleWriter_should_retry_the_same_request(t *testing.T) {
+  bodies := make(chan []byte, 10)
+  server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+                                                    r *http.Request) {
+    body, _ := ioutil.ReadAll(r.Body)
+    bodies <- body
+    assert.Equal(t, "application/x-protobuf", r.Header.Get("Content-Type"))
+    if len(bodies) == 1 {
+      w.WriteHeader(http.StatusServiceUnavailable)
+    }
+  }))
+  defer server.Close()
+  w := NewOTLPSampleWriter(server.URL + "/v1/metrics", "web1")
+  w.Delta = true
+  w.Clock = NewTickClock(time.Unix(1500000000, 0))
+  w.Write("uptime", 10)
+  if err := w.Close(5 * time.Second); err != nil {
+    t.Fatalf("Close() failed: %s", err)
+  }
+  assert.Equal(t, 2, len(bodies))
+  first := <-bodies
+  assert.Equal(t, first, <-bodies)
+  attrs, metrics := otlpMetrics(t, first)
+  assert.Equal(t, Tags{"host.name": "web1"}, attrs)
+  assert.Equal(t, 1, len(metrics["uptime.seconds"][5]))
+  assert.Equal(t, uint64(1), w.Stats().Failed)
+}
@@ -0,0 +1,442 @@
+package util
+
+import (
+  "archive/tar"
+  "bytes"
+  "compress/gzip"
+  "errors"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+// Layout of snapshot archive names; sorts lexically in time order.
+const snapshotLayout = "20060102T150405.000000000Z"
+
+// Suffix of snapshot archive names.
+const snapshotSuffix = ".tar.gz"
+
+// Top-level directories within a snapshot archive. Files read through a
+// RecordingFS are stored below files/, directory listings below dirs/,
+// statfs results below statfs/ and errors other than missing files below
+// errors/.
+const (
+  snapshotFiles  = "files"
+  snapshotDirs   = "dirs"
+  snapshotStatfs = "statfs"
+  snapshotErrors = "errors"
+)
+
+// Everything read through a filesystem during one sampling tick.
+type snapshot struct {
+  files  map[string][]byte
+  dirs   map[string][]os.FileInfo
+  stats  map[string]*FSStats
+  errors map[string]string
+}
+
+func newSnapshot() *snapshot {
+  return &snapshot{
+    files: make(map[string][]byte),
+    dirs: make(map[string][]os.FileInfo),
+    stats: make(map[string]*FSStats),
+    errors: make(map[string]string),
+  }
+}
+
+// Record an error returned by the underlying filesystem. Missing files are
+// recorded by their absence.
+func (s *snapshot) setError(path string, err error) {
+  if !os.IsNotExist(err) {
+    s.errors[path] = err.Error()
+  }
+}
+
+// FileSystem that captures everything read through it, so that samplers
+// can later be run against exactly the same inputs by a ReplayFS. Reads are
+// grouped into ticks; each tick is written out as a timestamped tar.gz
+// archive in the recording directory.
+type RecordingFS struct {
+  fs   FileSystem
+  dir  string
+  mu   sync.Mutex
+  tick time.Time
+  snap *snapshot
+}
+
+// Create a new recording filesystem that records reads of the given
+// filesystem into archives in the given directory.
+func NewRecordingFS(fs FileSystem, dir string) *RecordingFS {
+  return &RecordingFS{fs: fs, dir: dir, snap: newSnapshot()}
+}
+
+// Start a new tick at the given time. Until the next call to Tick, Now()
+// reports this time. Any monotonic clock reading is stripped, so that rates
+// calculated live come out exactly as they do when replayed.
+func (r *RecordingFS) Tick(t time.Time) {
+  r.mu.Lock()
+  defer r.mu.Unlock()
+  r.tick = t.Round(0)
+}
+
+// Returns the time of the current tick.
+func (r *RecordingFS) Now() time.Time {
+  r.mu.Lock()
+  defer r.mu.Unlock()
+  if r.tick.IsZero() {
+    return time.Now()
+  }
+  return r.tick
+}
+
+// Opens the given file path, recording its entire contents.
+func (r *RecordingFS) Open(path string) (io.ReadCloser, error) {
+  f, err := r.fs.Open(path)
+  if err != nil {
+    r.mu.Lock()
+    r.snap.setError(path, err)
+    r.mu.Unlock()
+    return nil, err
+  }
+  defer f.Close()
+  data, err := ioutil.ReadAll(f)
+  r.mu.Lock()
+  defer r.mu.Unlock()
+  if err != nil {
+    r.snap.setError(path, err)
+    return nil, err
+  }
+  r.snap.files[path] = data
+  return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// Lists the entries of the given directory path, recording the listing.
+func (r *RecordingFS) ReadDir(path string) ([]os.FileInfo, error) {
+  entries, err := r.fs.ReadDir(path)
+  r.mu.Lock()
+  defer r.mu.Unlock()
+  if err != nil {
+    r.snap.setError(path, err)
+    return nil, err
+  }
+  r.snap.dirs[path] = entries
+  return entries, nil
+}
+
+// Reports usage statistics for the filesystem mounted at the given path,
+// recording the result.
+func (r *RecordingFS) Statfs(path string) (*FSStats, error) {
+  stats, err := r.fs.Statfs(path)
+  r.mu.Lock()
+  defer r.mu.Unlock()
+  if err != nil {
+    r.snap.setError(path, err)
+    return nil, err
+  }
+  r.snap.stats[path] = stats
+  return stats, nil
+}
+
+// Write everything read since the last flush to an archive named after the
+// current tick's time, and start recording afresh.
+func (r *RecordingFS) Flush() (err error) {
+  r.mu.Lock()
+  snap, tick := r.snap, r.tick
+  r.snap = newSnapshot()
+  r.mu.Unlock()
+  if tick.IsZero() {
+    tick = time.Now()
+  }
+  name := filepath.Join(r.dir, tick.UTC().Format(snapshotLayout) + snapshotSuffix)
+  f, err := os.Create(name)
+  if err != nil {
+    return
+  }
+  defer func() {
+    if cerr := f.Close(); err == nil {
+      err = cerr
+    }
+  }()
+  gz := gzip.NewWriter(f)
+  tw := tar.NewWriter(gz)
+  if err = writeSnapshot(tw, snap, tick); err != nil {
+    return
+  }
+  if err = tw.Close(); err != nil {
+    return
+  }
+  return gz.Close()
+}
+
+// Write the contents of a snapshot to the given tar archive.
+func writeSnapshot(tw *tar.Writer, snap *snapshot, tick time.Time) (err error) {
+  for _, path := range snap.paths() {
+    if data, ok := snap.files[path]; ok {
+      if err = writeEntry(tw, snapshotFiles, path, data, tick); err != nil {
+        return
+      }
+    }
+    if err = writeMeta(tw, snap, path, tick); err != nil {
+      return
+    }
+  }
+  return
+}
+
+// Write the directory listing, statfs result and error recorded for a path
+// to the given tar archive.
+func writeMeta(tw *tar.Writer, snap *snapshot, path string, tick time.Time) (err error) {
+  if entries, ok := snap.dirs[path]; ok {
+    var buf bytes.Buffer
+    for _, entry := range entries {
+      fmt.Fprintf(&buf, "%d %s\n", uint32(entry.Mode()), entry.Name())
+    }
+    if err = writeEntry(tw, snapshotDirs, path, buf.Bytes(), tick); err != nil {
+      return
+    }
+  }
+  if s, ok := snap.stats[path]; ok {
+    data := fmt.Sprintf("%d %d %d %d %d %d\n",
+                        s.BlockSize, s.Blocks, s.BlocksFree, s.BlocksAvail,
+                        s.Files, s.FilesFree)
+    if err = writeEntry(tw, snapshotStatfs, path, []byte(data), tick); err != nil {
+      return
+    }
+  }
+  if msg, ok := snap.errors[path]; ok {
+    if err = writeEntry(tw, snapshotErrors, path, []byte(msg), tick); err != nil {
+      return
+    }
+  }
+  return
+}
+
+// Write a single regular file entry to the given tar archive.
+func writeEntry(tw *tar.Writer, kind, path string, data []byte, tick time.Time) (err error) {
+  name := kind + "/" + strings.TrimPrefix(path, "/")
+  if path == "/" {
+    name = kind + "/."
+  }
+  hdr := &tar.Header{
+    Name: name,
+    Mode: 0444,
+    Size: int64(len(data)),
+    ModTime: tick,
+    Typeflag: tar.TypeReg,
+  }
+  if err = tw.WriteHeader(hdr); err != nil {
+    return
+  }
+  _, err = tw.Write(data)
+  return
+}
+
+// Return every path recorded in this snapshot, in sorted order.
+func (s *snapshot) paths() []string {
+  seen := make(map[string]bool)
+  for path := range s.files { seen[path] = true }
+  for path := range s.dirs { seen[path] = true }
+  for path := range s.stats { seen[path] = true }
+  for path := range s.errors { seen[path] = true }
+  paths := make([]string, 0, len(seen))
+  for path := range seen {
+    paths = append(paths, path)
+  }
+  sort.Strings(paths)
+  return paths
+}
+
+// FileSystem that replays archives captured by a RecordingFS, one tick at a
+// time. Its Now() reports the time each tick was recorded at, so rate
+// calculations come out exactly as they would have on the recorded host.
+type ReplayFS struct {
+  archives []string
+  next     int
+  tick     time.Time
+  snap     *snapshot
+}
+
+// Create a new replay filesystem over the archives in the given directory.
+// Call Next() to load the first tick before reading from it.
+func NewReplayFS(dir string) (*ReplayFS, error) {
+  archives, err := filepath.Glob(filepath.Join(dir, "*" + snapshotSuffix))
+  if err != nil {
+    return nil, err
+  }
+  if len(archives) == 0 {
+    return nil, fmt.Errorf("no snapshot archives found in %s", dir)
+  }
+  sort.Strings(archives)
+  return &ReplayFS{archives: archives, snap: newSnapshot()}, nil
+}
+
+// Load the next recorded tick. Returns false once every tick has been
+// replayed.
+func (r *ReplayFS) Next() (bool, error) {
+  if r.next >= len(r.archives) {
+    return false, nil
+  }
+  name := r.archives[r.next]
+  r.next++
+  snap, tick, err := readSnapshot(name)
+  if err != nil {
+    return false, fmt.Errorf("%s: %s", name, err)
+  }
+  r.snap, r.tick = snap, tick
+  return true, nil
+}
+
+// Returns the time the current tick was recorded at.
+func (r *ReplayFS) Now() time.Time {
+  return r.tick
+}
+
+// Opens the given file path as it was recorded in the current tick.
+func (r *ReplayFS) Open(path string) (io.ReadCloser, error) {
+  if err := r.err("open", path); err != nil {
+    return nil, err
+  }
+  data, ok := r.snap.files[path]
+  if !ok {
+    return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+  }
+  return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// Lists the given directory path as it was recorded in the current tick.
+func (r *ReplayFS) ReadDir(path string) ([]os.FileInfo, error) {
+  if err := r.err("readdir", path); err != nil {
+    return nil, err
+  }
+  entries, ok := r.snap.dirs[path]
+  if !ok {
+    return nil, &os.PathError{Op: "readdir", Path: path, Err: os.ErrNotExist}
+  }
+  return entries, nil
+}
+
+// Reports filesystem usage for the given path as it was recorded in the
+// current tick.
+func (r *ReplayFS) Statfs(path string) (*FSStats, error) {
+  if err := r.err("statfs", path); err != nil {
+    return nil, err
+  }
+  stats, ok := r.snap.stats[path]
+  if !ok {
+    return nil, &os.PathError{Op: "statfs", Path: path, Err: os.ErrNotExist}
+  }
+  return stats, nil
+}
+
+// Returns the error recorded for the given path in the current tick, if
+// any.
+func (r *ReplayFS) err(op, path string) error {
+  if msg, ok := r.snap.errors[path]; ok {
+    return &os.PathError{Op: op, Path: path, Err: errors.New(msg)}
+  }
+  return nil
+}
+
+// Read a snapshot archive written by RecordingFS.Flush().
+func readSnapshot(name string) (snap *snapshot, tick time.Time, err error) {
+  f, err := os.Open(name)
+  if err != nil {
+    return
+  }
+  defer f.Close()
+  gz, err := gzip.NewReader(f)
+  if err != nil {
+    return
+  }
+  snap = newSnapshot()
+  base := strings.TrimSuffix(filepath.Base(name), snapshotSuffix)
+  if tick, err = time.Parse(snapshotLayout, base); err != nil {
+    return
+  }
+  tr := tar.NewReader(gz)
+  for {
+    var hdr *tar.Header
+    var data []byte
+
+    hdr, err = tr.Next()
+    if err == io.EOF {
+      err = nil
+      break
+    } else if err != nil {
+      return
+    }
+    if data, err = ioutil.ReadAll(tr); err != nil {
+      return
+    }
+    parts := strings.SplitN(hdr.Name, "/", 2)
+    if len(parts) != 2 {
+      continue
+    }
+    path := "/" + parts[1]
+    if parts[1] == "." {
+      path = "/"
+    }
+    switch parts[0] {
+    case snapshotFiles: snap.files[path] = data
+    case snapshotDirs: snap.dirs[path], err = parseDirListing(data, tick)
+    case snapshotStatfs: snap.stats[path], err = parseStatfs(data)
+    case snapshotErrors: snap.errors[path] = string(data)
+    }
+    if err != nil {
+      return
+    }
+  }
+  return
+}
+
+// Parse a directory listing recorded as "<mode> <name>" lines.
+func parseDirListing(data []byte, tick time.Time) ([]os.FileInfo, error) {
+  entries := make([]os.FileInfo, 0)
+  for _, line := range strings.Split(string(data), "\n") {
+    parts := strings.SplitN(line, " ", 2)
+    if len(parts) != 2 {
+      continue
+    }
+    mode, err := strconv.ParseUint(parts[0], 10, 32)
+    if err != nil {
+      return nil, err
+    }
+    entries = append(entries, &fileInfo{
+      name: parts[1],
+      mode: os.FileMode(mode),
+      modTime: tick,
+    })
+  }
+  return entries, nil
+}
+
+// Parse filesystem usage statistics recorded by writeSnapshot().
+func parseStatfs(data []byte) (*FSStats, error) {
+  s := &FSStats{}
+  _, err := fmt.Sscanf(string(data), "%d %d %d %d %d %d",
+                       &s.BlockSize, &s.Blocks, &s.BlocksFree,
+                       &s.BlocksAvail, &s.Files, &s.FilesFree)
+  return s, err
+}
+
+// Directory entry for a file that exists only in memory, as replayed from a
+// snapshot archive or held by a FakeFS.
+type fileInfo struct {
+  name    string
+  mode    os.FileMode
+  modTime time.Time
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return 0 }
+func (fi *fileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *fileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *fileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *fileInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,101 @@
+package util
+
+import (
+  "github.com/bmizerany/assert"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "testing"
+  "time"
+)
+
+func readAll(t *testing.T, o Opener, path string) string {
+  f, err := o.Open(path)
+  if err != nil {
+    t.Fatalf("Open(%s) failed: %s", path, err)
+  }
+  defer f.Close()
+  data, err := ioutil.ReadAll(f)
+  if err != nil {
+    t.Fatalf("reading %s failed: %s", path, err)
+  }
+  return string(data)
+}
+
+func Test_ReplayFS_should_replay_ticks_recorded_by_RecordingFS(t *testing.T) {
+  host := t.TempDir()
+  archives := t.TempDir()
+  if err := os.MkdirAll(filepath.Join(host, "proc/net"), 0755); err != nil {
+    t.Fatal(err)
+  }
+  loadavg := filepath.Join(host, "proc/loadavg")
+  if err := ioutil.WriteFile(loadavg, []byte("0.00 0.02 0.05 1/406 16439\n"), 0644); err != nil {
+    t.Fatal(err)
+  }
+  rec := NewRecordingFS(NewRootFS(host), archives)
+  tick1 := time.Date(2012, 12, 12, 20, 33, 40, 0, time.UTC)
+  rec.Tick(tick1)
+  assert.Equal(t, tick1, rec.Now())
+  assert.Equal(t, "0.00 0.02 0.05 1/406 16439\n", readAll(t, rec, "/proc/loadavg"))
+  if _, err := rec.Open("/proc/pressure/cpu"); !os.IsNotExist(err) {
+    t.Fatalf("expected missing file, got %v", err)
+  }
+  entries, err := rec.ReadDir("/proc")
+  if err != nil {
+    t.Fatalf("ReadDir() failed: %s", err)
+  }
+  assert.Equal(t, 2, len(entries))
+  stats, err := rec.Statfs("/")
+  if err != nil {
+    t.Fatalf("Statfs() failed: %s", err)
+  }
+  if err := rec.Flush(); err != nil {
+    t.Fatalf("Flush() failed: %s", err)
+  }
+  tick2 := tick1.Add(10 * time.Second)
+  rec.Tick(tick2)
+  if err := ioutil.WriteFile(loadavg, []byte("1.00 0.22 0.07 2/410 16502\n"), 0644); err != nil {
+    t.Fatal(err)
+  }
+  readAll(t, rec, "/proc/loadavg")
+  if err := rec.Flush(); err != nil {
+    t.Fatalf("Flush() failed: %s", err)
+  }
+
+  replay, err := NewReplayFS(archives)
+  if err != nil {
+    t.Fatalf("NewReplayFS() failed: %s", err)
+  }
+  ok, err := replay.Next()
+  assert.Equal(t, true, ok)
+  assert.Equal(t, nil, err)
+  assert.Equal(t, true, replay.Now().Equal(tick1))
+  assert.Equal(t, "0.00 0.02 0.05 1/406 16439\n", readAll(t, replay, "/proc/loadavg"))
+  if _, err := replay.Open("/proc/pressure/cpu"); !os.IsNotExist(err) {
+    t.Fatalf("expected missing file, got %v", err)
+  }
+  replayed, err := replay.ReadDir("/proc")
+  if err != nil {
+    t.Fatalf("ReadDir() failed: %s", err)
+  }
+  assert.Equal(t, 2, len(replayed))
+  assert.Equal(t, "loadavg", replayed[0].Name())
+  assert.Equal(t, false, replayed[0].IsDir())
+  assert.Equal(t, "net", replayed[1].Name())
+  assert.Equal(t, true, replayed[1].IsDir())
+  replayedStats, err := replay.Statfs("/")
+  if err != nil {
+    t.Fatalf("Statfs() failed: %s", err)
+  }
+  assert.Equal(t, stats, replayedStats)
+
+  ok, _ = replay.Next()
+  assert.Equal(t, true, ok)
+  assert.Equal(t, true, replay.Now().Equal(tick2))
+  assert.Equal(t, "1.00 0.22 0.07 2/410 16502\n", readAll(t, replay, "/proc/loadavg"))
+  if _, err := replay.ReadDir("/proc"); !os.IsNotExist(err) {
+    t.Fatalf("expected listing missing from second tick, got %v", err)
+  }
+  ok, _ = replay.Next()
+  assert.Equal(t, false, ok)
+}
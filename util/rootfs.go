@@ -0,0 +1,85 @@
+package util
+
+import (
+  "io"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "sort"
+  "strings"
+)
+
+// A directory standing in for part of the filesystem namespace.
+type rootMount struct {
+  prefix string
+  dir    string
+}
+
+// FileSystem that resolves absolute paths against a directory other than
+// "/". This lets an agent running in a container monitor its host through
+// bind mounts of the host's filesystems, e.g. with the host's / mounted at
+// /host, or just its /proc, /sys and /etc mounted at /host/proc, /host/sys
+// and /host/etc.
+type RootFS struct {
+  // Directory against which mount points are resolved for Statfs(), e.g.
+  // /host/proc/1/root, if not this filesystem's root. Mount points listed
+  // in the host's /proc are in the host's mount namespace, which this
+  // process can reach through the root of the host's init process.
+  MountRoot string
+  root      string
+  mounts    []rootMount
+}
+
+// Create a new filesystem rooted at the given directory.
+func NewRootFS(root string) *RootFS {
+  return &RootFS{root: filepath.Clean(root), mounts: make([]rootMount, 0)}
+}
+
+// Resolve paths at or below the given prefix (e.g. "/proc") against dir
+// (e.g. "/host/proc") rather than against this filesystem's root.
+func (r *RootFS) Mount(prefix, dir string) {
+  r.mounts = append(r.mounts, rootMount{
+    prefix: filepath.Clean(prefix),
+    dir: filepath.Clean(dir),
+  })
+  // Longest prefix wins, so keep more specific mounts first.
+  sort.SliceStable(r.mounts, func(i, j int) bool {
+    return len(r.mounts[i].prefix) > len(r.mounts[j].prefix)
+  })
+}
+
+// Map an absolute path within this filesystem to the path at which it can
+// be found by this process.
+func (r *RootFS) Resolve(path string) string {
+  path = filepath.Clean("/" + path)
+  for _, m := range r.mounts {
+    if path == m.prefix || strings.HasPrefix(path, m.prefix + "/") {
+      return filepath.Join(m.dir, strings.TrimPrefix(path, m.prefix))
+    }
+  }
+  return filepath.Join(r.root, path)
+}
+
+// Map the path of a mount point to the path at which this process can
+// find the filesystem mounted there.
+func (r *RootFS) ResolveMount(path string) string {
+  if r.MountRoot == "" {
+    return r.Resolve(path)
+  }
+  return filepath.Join(r.MountRoot, filepath.Clean("/" + path))
+}
+
+// Opens the given file path.
+func (r *RootFS) Open(path string) (io.ReadCloser, error) {
+  return os.Open(r.Resolve(path))
+}
+
+// Lists the entries of the given directory path, sorted by name.
+func (r *RootFS) ReadDir(path string) ([]os.FileInfo, error) {
+  return ioutil.ReadDir(r.Resolve(path))
+}
+
+// Reports usage statistics for the filesystem mounted at the given path.
+func (r *RootFS) Statfs(path string) (*FSStats, error) {
+  return statfs(r.ResolveMount(path))
+}
@@ -0,0 +1,35 @@
+package util
+
+import (
+  "github.com/bmizerany/assert"
+  "testing"
+)
+
+func Test_RootFS_should_resolve_paths_against_root(t *testing.T) {
+  root := NewRootFS("/host")
+  assert.Equal(t, "/host/proc/stat", root.Resolve("/proc/stat"))
+  assert.Equal(t, "/host", root.Resolve("/"))
+  assert.Equal(t, "/host/etc/mtab", root.Resolve("/../etc/mtab"))
+}
+
+func Test_RootFS_should_prefer_longest_mount_prefix(t *testing.T) {
+  root := NewRootFS("/")
+  root.Mount("/proc", "/host/proc")
+  root.Mount("/proc/net", "/host/proc/1/net")
+  root.Mount("/etc/mtab", "/host/proc/1/mounts")
+  assert.Equal(t, "/host/proc/stat", root.Resolve("/proc/stat"))
+  assert.Equal(t, "/host/proc/1/net/tcp", root.Resolve("/proc/net/tcp"))
+  assert.Equal(t, "/host/proc/1/mounts", root.Resolve("/etc/mtab"))
+  assert.Equal(t, "/proc-other/x", root.Resolve("/proc-other/x"))
+  assert.Equal(t, "/sys/class/hwmon", root.Resolve("/sys/class/hwmon"))
+}
+
+func Test_RootFS_should_resolve_mount_points_against_mount_root(t *testing.T) {
+  root := NewRootFS("/")
+  root.Mount("/proc", "/host/proc")
+  assert.Equal(t, "/data", root.ResolveMount("/data"))
+  root.MountRoot = "/host/proc/1/root"
+  assert.Equal(t, "/host/proc/1/root/data", root.ResolveMount("/data"))
+  assert.Equal(t, "/host/proc/1/root", root.ResolveMount("/"))
+  assert.Equal(t, "/host/proc/stat", root.Resolve("/proc/stat"))
+}
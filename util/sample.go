@@ -0,0 +1,301 @@
+package util
+
+import (
+  "fmt"
+  "time"
+)
+
+// A sample with named tags and fields, as sent from agents to the
+// collector. Samplers write samples positionally (see SampleWriter); the
+// schema registered for a sample's name says which positions are tags and
+// what the rest are called.
+type Sample struct {
+  Host   string             `json:"host,omitempty"`
+  Time   time.Time          `json:"time"`
+  Name   string             `json:"name"`
+  Tags   Tags               `json:"tags,omitempty"`
+  Fields map[string]float64 `json:"fields"`
+}
+
+// Layout of the positional values written for a sample: leading values
+// identifying what was sampled (tags), followed by the measurements
+// (fields).
+type Schema struct {
+  Tags     []string
+  Fields   []string
+  // Fields that only ever increase (e.g. byte counts), as opposed to
+  // gauges that go up and down.
+  Counters []string
+  // Fields that only ever hold whole numbers, so are stored as integers
+  // where a store distinguishes them; all others are floats.
+  Integers []string
+}
+
+// Returns whether the named field only ever increases.
+func (s Schema) IsCounter(field string) bool {
+  return contains(s.Counters, field)
+}
+
+// Returns whether the named field only ever holds whole numbers.
+func (s Schema) IsInteger(field string) bool {
+  return contains(s.Integers, field)
+}
+
+// Returns whether the given names include the given one.
+func contains(names []string, name string) bool {
+  for _, n := range names {
+    if n == name {
+      return true
+    }
+  }
+  return false
+}
+
+// Schemas of the samples written by the agent's samplers, by sample name.
+var Schemas = map[string]Schema{
+  "uptime": {Fields: []string{"seconds"}},
+  "cpu": {
+    Tags: []string{"cpu"},
+    Fields: []string{"user", "system", "nice", "iowait", "steal", "idle"},
+    Counters: []string{"user", "system", "nice", "iowait", "steal", "idle"},
+    Integers: []string{"user", "system", "nice", "iowait", "steal", "idle"},
+  },
+  "cpu.freq": {
+    Tags: []string{"cpu", "package", "core", "thread"},
+    Fields: []string{"cur_mhz", "min_mhz", "max_mhz"},
+  },
+  "cpu.throttle": {
+    Tags: []string{"cpu", "package", "core", "thread"},
+    Fields: []string{"core_throttles", "package_throttles"},
+    Counters: []string{"core_throttles", "package_throttles"},
+    Integers: []string{"core_throttles", "package_throttles"},
+  },
+  "load": {Fields: []string{"load1", "load5", "load15", "procs"}},
+  "memory": {
+    Fields: []string{"total", "free", "buffers", "cached",
+                     "swap_total", "swap_free"},
+  },
+  "disk": {
+    Tags: []string{"device"},
+    Fields: []string{"reads", "read_kb", "writes", "write_kb"},
+    Counters: []string{"reads", "read_kb", "writes", "write_kb"},
+    Integers: []string{"reads", "read_kb", "writes", "write_kb"},
+  },
+  "disk.discard": {
+    Tags: []string{"device"},
+    Fields: []string{"ios", "merges", "kb", "ticks"},
+    Counters: []string{"ios", "merges", "kb", "ticks"},
+    Integers: []string{"ios", "merges", "kb", "ticks"},
+  },
+  "disk.flush": {
+    Tags: []string{"device"},
+    Fields: []string{"ios", "ticks"},
+    Counters: []string{"ios", "ticks"},
+    Integers: []string{"ios", "ticks"},
+  },
+  "fs": {
+    Tags: []string{"device", "mount"},
+    Fields: []string{"total_kb", "free_kb", "avail_kb", "files", "files_free"},
+  },
+  "net": {
+    Tags: []string{"interface"},
+    Fields: []string{"rx_bytes", "rx_packets", "rx_errors", "rx_drops",
+                     "tx_bytes", "tx_packets", "tx_errors", "tx_drops"},
+    Counters: []string{"rx_bytes", "rx_packets", "rx_errors", "rx_drops",
+                       "tx_bytes", "tx_packets", "tx_errors", "tx_drops"},
+    Integers: []string{"rx_bytes", "rx_packets", "rx_errors", "rx_drops",
+                       "tx_bytes", "tx_packets", "tx_errors", "tx_drops"},
+  },
+  "sockets": {Tags: []string{"proto", "state"}, Fields: []string{"count"}},
+  "sockets.listen": {
+    Tags: []string{"proto", "port"},
+    Fields: []string{"rx_queue", "tx_queue"},
+  },
+  "sockets.remote": {Tags: []string{"proto", "port"}, Fields: []string{"count"}},
+  "pressure": {
+    Tags: []string{"resource", "kind"},
+    Fields: []string{"avg10", "avg60", "avg300", "rate"},
+  },
+  "cgroup.cpu": {
+    Tags: []string{"cgroup"},
+    Fields: []string{"usage_usec", "user_usec", "system_usec",
+                     "nr_periods", "nr_throttled", "throttled_usec"},
+    Counters: []string{"usage_usec", "user_usec", "system_usec",
+                       "nr_periods", "nr_throttled", "throttled_usec"},
+    Integers: []string{"usage_usec", "user_usec", "system_usec",
+                       "nr_periods", "nr_throttled", "throttled_usec"},
+  },
+  "cgroup.memory": {
+    Tags: []string{"cgroup"},
+    Fields: []string{"current", "max", "high_events", "max_events",
+                     "oom", "oom_kill"},
+    Counters: []string{"high_events", "max_events", "oom", "oom_kill"},
+    Integers: []string{"high_events", "max_events", "oom", "oom_kill"},
+  },
+  "cgroup.io": {
+    Tags: []string{"cgroup", "device"},
+    Fields: []string{"rbytes", "wbytes", "rios", "wios", "dbytes", "dios"},
+    Counters: []string{"rbytes", "wbytes", "rios", "wios", "dbytes", "dios"},
+    Integers: []string{"rbytes", "wbytes", "rios", "wios", "dbytes", "dios"},
+  },
+  "cgroup.pids": {Tags: []string{"cgroup"}, Fields: []string{"current"}},
+  "sensor.temp": {
+    Tags: []string{"hwmon", "chip", "label"},
+    Fields: []string{"value", "max", "crit"},
+  },
+  "sensor.fan": {
+    Tags: []string{"hwmon", "chip", "label"},
+    Fields: []string{"value", "min", "max"},
+  },
+  "sensor.voltage": {
+    Tags: []string{"hwmon", "chip", "label"},
+    Fields: []string{"value", "min", "max"},
+  },
+  "thermal": {
+    Tags: []string{"zone", "type"},
+    Fields: []string{"temp", "hot", "crit"},
+  },
+  "exec.status": {
+    Tags: []string{"command"},
+    Fields: []string{"exit_code", "duration", "invalid_lines"},
+  },
+  "log.count": {
+    Tags: []string{"rule"},
+    Fields: []string{"count", "rate"},
+    Counters: []string{"count"},
+    Integers: []string{"count"},
+  },
+  "log.histogram": {
+    Tags: []string{"rule"},
+    Fields: []string{"count", "sum"},
+    Counters: []string{"count", "sum"},
+    Integers: []string{"count"},
+  },
+  "log.bucket": {
+    Tags: []string{"rule", "le"},
+    Fields: []string{"count"},
+    Counters: []string{"count"},
+    Integers: []string{"count"},
+  },
+  "agent.sampler": {
+    Tags: []string{"sampler"},
+    Fields: []string{"duration", "samples", "errors"},
+    Counters: []string{"errors"},
+    Integers: []string{"errors"},
+  },
+  "agent.sink": {
+    Fields: []string{"queued", "sent", "dropped", "failed", "batches",
+                     "raw_bytes", "wire_bytes"},
+    Counters: []string{"sent", "dropped", "failed", "batches", "raw_bytes",
+                       "wire_bytes"},
+    Integers: []string{"sent", "dropped", "failed", "batches", "raw_bytes",
+                       "wire_bytes"},
+  },
+  "host.status": {Tags: []string{"status"}, Fields: []string{"missed"}},
+  "agent.ticks": {
+    Fields: []string{"missed"},
+    Counters: []string{"missed"},
+    Integers: []string{"missed"},
+  },
+  "agent.runtime": {
+    Fields: []string{"goroutines", "heap_alloc", "heap_sys", "gc_count",
+                     "cpu_user", "cpu_system", "max_rss_kb"},
+    Counters: []string{"gc_count", "cpu_user", "cpu_system"},
+    Integers: []string{"gc_count"},
+  },
+}
+
+// Convert the positional values given to a SampleWriter into a Sample.
+//
+// Samples with a registered schema are named according to it. Samples
+// without one (such as those from external commands) have their string
+// values become tags named tag1, tag2, etc, and their numeric values become
+// fields named value, or value1, value2, etc when there are several.
+//
+// Any sample may also carry Tags values, which are merged into its tags.
+// Tags given by position take precedence over these, and earlier Tags
+// values over later ones, so that the tags describing what was sampled
+// can't be overridden by those describing the host.
+func NewSample(v ...interface{}) (*Sample, error) {
+  if len(v) == 0 {
+    return nil, fmt.Errorf("empty sample")
+  }
+  name, ok := v[0].(string)
+  if !ok {
+    return nil, fmt.Errorf("sample name is not a string: %v", v[0])
+  }
+  sample := &Sample{Name: name, Tags: make(Tags), Fields: make(map[string]float64)}
+  values := make([]interface{}, 0, len(v) - 1)
+  extra := make([]Tags, 0)
+  for _, value := range v[1:] {
+    if tags, ok := value.(Tags); ok {
+      extra = append(extra, tags)
+    } else {
+      values = append(values, value)
+    }
+  }
+  if schema, ok := Schemas[name]; ok {
+    if len(values) != len(schema.Tags) + len(schema.Fields) {
+      return nil, fmt.Errorf("%s: expected %d values, got %d", name,
+                             len(schema.Tags) + len(schema.Fields), len(values))
+    }
+    for i, tag := range schema.Tags {
+      sample.Tags[tag] = fmt.Sprint(values[i])
+    }
+    for i, field := range schema.Fields {
+      f, ok := toFloat(values[len(schema.Tags) + i])
+      if !ok {
+        return nil, fmt.Errorf("%s: %s is not numeric: %v", name, field,
+                               values[len(schema.Tags) + i])
+      }
+      sample.Fields[field] = f
+    }
+  } else {
+    numeric := make([]float64, 0, len(values))
+    for _, value := range values {
+      if f, ok := toFloat(value); ok {
+        numeric = append(numeric, f)
+      } else {
+        sample.Tags[fmt.Sprintf("tag%d", len(sample.Tags) + 1)] = fmt.Sprint(value)
+      }
+    }
+    if len(numeric) == 1 {
+      sample.Fields["value"] = numeric[0]
+    } else {
+      for i, f := range numeric {
+        sample.Fields[fmt.Sprintf("value%d", i + 1)] = f
+      }
+    }
+  }
+  for _, tags := range extra {
+    for k, v := range tags {
+      if _, ok := sample.Tags[k]; !ok {
+        sample.Tags[k] = v
+      }
+    }
+  }
+  return sample, nil
+}
+
+// Convert a numeric value of any type to a float64.
+func toFloat(v interface{}) (float64, bool) {
+  switch n := v.(type) {
+  case float64:
+    return n, true
+  case float32:
+    return float64(n), true
+  case int:
+    return float64(n), true
+  case int64:
+    return float64(n), true
+  case int32:
+    return float64(n), true
+  case uint:
+    return float64(n), true
+  case uint64:
+    return float64(n), true
+  case uint32:
+    return float64(n), true
+  }
+  return 0, false
+}
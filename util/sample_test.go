@@ -0,0 +1,77 @@
+package util
+
+import (
+  "github.com/bmizerany/assert"
+  "testing"
+)
+
+func Test_NewSample_should_name_values_by_schema(t *testing.T) {
+  sample, err := NewSample("net", "eth0", uint64(100), uint64(2), uint64(0),
+                           uint64(0), uint64(50), uint64(1), uint64(0), uint64(0))
+  if err != nil {
+    t.Fatalf("NewSample() failed: %s", err)
+  }
+  assert.Equal(t, "net", sample.Name)
+  assert.Equal(t, Tags{"interface": "eth0"}, sample.Tags)
+  assert.Equal(t, 8, len(sample.Fields))
+  assert.Equal(t, 100.0, sample.Fields["rx_bytes"])
+  assert.Equal(t, 50.0, sample.Fields["tx_bytes"])
+  assert.Equal(t, true, Schemas["net"].IsCounter("rx_bytes"))
+  assert.Equal(t, false, Schemas["fs"].IsCounter("free_kb"))
+}
+
+func Test_NewSample_should_reject_samples_not_matching_schema(t *testing.T) {
+  _, err := NewSample("load", 0.5, 0.4)
+  assert.NotEqual(t, nil, err)
+  _, err = NewSample("load", 0.5, 0.4, "high", 12)
+  assert.NotEqual(t, nil, err)
+}
+
+func Test_NewSample_should_accept_samples_without_schema(t *testing.T) {
+  sample, err := NewSample("app.queue.depth", Tags{"queue": "mail"}, 42.0)
+  if err != nil {
+    t.Fatalf("NewSample() failed: %s", err)
+  }
+  assert.Equal(t, Tags{"queue": "mail"}, sample.Tags)
+  assert.Equal(t, map[string]float64{"value": 42}, sample.Fields)
+
+  sample, err = NewSample("app.thing", "a", 1, int64(2))
+  if err != nil {
+    t.Fatalf("NewSample() failed: %s", err)
+  }
+  assert.Equal(t, Tags{"tag1": "a"}, sample.Tags)
+  assert.Equal(t, map[string]float64{"value1": 1, "value2": 2}, sample.Fields)
+}
+
+func Test_NewSample_should_merge_extra_tags_below_positional_ones(t *testing.T) {
+  sample, err := NewSample("disk", "sda", 1, 2, 3, 4,
+                           Tags{"env": "prod", "device": "bogus"},
+                           Tags{"env": "dev", "role": "db"})
+  if err != nil {
+    t.Fatalf("NewSample() failed: %s", err)
+  }
+  assert.Equal(t, Tags{"device": "sda", "env": "prod", "role": "db"}, sample.Tags)
+  assert.Equal(t, 4, len(sample.Fields))
+}
+
+func Test_Schemas_should_not_name_fields_after_tags(t *testing.T) {
+  for name, schema := range Schemas {
+    for _, field := range schema.Fields {
+      for _, tag := range schema.Tags {
+        if field == tag {
+          t.Errorf("%s: field %q is also a tag", name, field)
+        }
+      }
+    }
+  }
+}
+
+func Test_Schemas_should_only_type_known_fields(t *testing.T) {
+  for name, schema := range Schemas {
+    for _, field := range append(schema.Counters, schema.Integers...) {
+      if !contains(schema.Fields, field) {
+        t.Errorf("%s: %q is not a field", name, field)
+      }
+    }
+  }
+}
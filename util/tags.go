@@ -0,0 +1,88 @@
+package util
+
+import (
+  "bufio"
+  "fmt"
+  "io"
+  "sort"
+  "strings"
+)
+
+// Set of key/value tags describing a sample, such as the environment or
+// role of the host it was taken on.
+type Tags map[string]string
+
+// Parse tags written as comma-separated key=value pairs, e.g.
+// "env=prod,role=web".
+func ParseTags(raw string) (Tags, error) {
+  tags := make(Tags)
+  if raw == "" {
+    return tags, nil
+  }
+  for _, pair := range strings.Split(raw, ",") {
+    kv := strings.SplitN(pair, "=", 2)
+    if len(kv) != 2 || kv[0] == "" {
+      return nil, fmt.Errorf("malformed tag: %q", pair)
+    }
+    tags[kv[0]] = kv[1]
+  }
+  return tags, nil
+}
+
+// Read tags from an environment file of KEY=VALUE lines, as commonly left
+// behind by provisioning tools. Blank lines, comments and "export" prefixes
+// are skipped, quotes around values are removed, and keys are lowercased.
+func ReadTags(r io.Reader) (Tags, error) {
+  tags := make(Tags)
+  scanner := bufio.NewScanner(r)
+  for scanner.Scan() {
+    line := strings.TrimSpace(scanner.Text())
+    if line == "" || strings.HasPrefix(line, "#") {
+      continue
+    }
+    line = strings.TrimSpace(strings.TrimPrefix(line, "export "))
+    kv := strings.SplitN(line, "=", 2)
+    if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+      return nil, fmt.Errorf("malformed tag: %q", line)
+    }
+    value := strings.TrimSpace(kv[1])
+    if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') &&
+       value[len(value) - 1] == value[0] {
+      value = value[1:len(value) - 1]
+    }
+    tags[strings.ToLower(strings.TrimSpace(kv[0]))] = value
+  }
+  return tags, scanner.Err()
+}
+
+// Returns a copy of these tags with the given tags merged in, overriding
+// any of these with the same key.
+func (t Tags) Merge(other Tags) Tags {
+  rv := make(Tags, len(t) + len(other))
+  for k, v := range t {
+    rv[k] = v
+  }
+  for k, v := range other {
+    rv[k] = v
+  }
+  return rv
+}
+
+// Returns the keys of these tags in sorted order.
+func (t Tags) Keys() []string {
+  keys := make([]string, 0, len(t))
+  for k := range t {
+    keys = append(keys, k)
+  }
+  sort.Strings(keys)
+  return keys
+}
+
+// Formats these tags as comma-separated key=value pairs, sorted by key.
+func (t Tags) String() string {
+  pairs := make([]string, 0, len(t))
+  for _, k := range t.Keys() {
+    pairs = append(pairs, k + "=" + t[k])
+  }
+  return strings.Join(pairs, ",")
+}
@@ -0,0 +1,45 @@
+package util
+
+import (
+  "github.com/bmizerany/assert"
+  "strings"
+  "testing"
+)
+
+func Test_ParseTags_should_round_trip_sorted_pairs(t *testing.T) {
+  tags, err := ParseTags("role=web,env=prod")
+  if err != nil {
+    t.Fatalf("ParseTags() failed: %s", err)
+  }
+  assert.Equal(t, Tags{"env": "prod", "role": "web"}, tags)
+  assert.Equal(t, "env=prod,role=web", tags.String())
+}
+
+func Test_ParseTags_should_reject_malformed_pairs(t *testing.T) {
+  if _, err := ParseTags("env=prod,web"); err == nil {
+    t.Fatalf("expected ParseTags() to fail")
+  }
+}
+
+func Test_ReadTags_should_parse_env_files(t *testing.T) {
+  tags, err := ReadTags(strings.NewReader(`
+# written by provisioning
+export ENV=prod
+ROLE="web"
+team = 'payments'
+`))
+  if err != nil {
+    t.Fatalf("ReadTags() failed: %s", err)
+  }
+  assert.Equal(t, Tags{"env": "prod", "role": "web", "team": "payments"}, tags)
+  if _, err = ReadTags(strings.NewReader("ENV\n")); err == nil {
+    t.Fatalf("expected ReadTags() to fail")
+  }
+}
+
+func Test_Tags_Merge_should_override_without_modifying(t *testing.T) {
+  base := Tags{"env": "prod", "role": "web"}
+  merged := base.Merge(Tags{"role": "db"})
+  assert.Equal(t, Tags{"env": "prod", "role": "db"}, merged)
+  assert.Equal(t, "web", base["role"])
+}
@@ -0,0 +1,101 @@
+// Throwaway certificates for tests of mutual TLS. Only tests import this
+// package, so that none of it ends up in the agent or collector.
+package testpki
+
+import (
+  "crypto/ecdsa"
+  "crypto/elliptic"
+  "crypto/rand"
+  "crypto/x509"
+  "crypto/x509/pkix"
+  "encoding/pem"
+  "math/big"
+  "net"
+  "os"
+  "path/filepath"
+  "time"
+)
+
+// Certificate, key and CA files for one name; convertible to util.TLSFiles.
+type Files struct {
+  Cert string
+  Key  string
+  CA   string
+}
+
+// Write a throwaway PKI: a CA certificate as ca.pem in the given directory,
+// along with a certificate and key signed by it for each of the given
+// common names, as <name>.pem and <name>-key.pem. Each certificate is valid
+// for 127.0.0.1 as both a server and a client. Returns the files for each
+// name.
+func Write(dir string, names ...string) (map[string]Files, error) {
+  caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+  if err != nil {
+    return nil, err
+  }
+  caTmpl := &x509.Certificate{
+    SerialNumber: big.NewInt(1),
+    Subject: pkix.Name{CommonName: "test CA"},
+    NotBefore: time.Now().Add(-time.Hour),
+    NotAfter: time.Now().Add(time.Hour),
+    IsCA: true,
+    BasicConstraintsValid: true,
+    KeyUsage: x509.KeyUsageCertSign,
+  }
+  caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+  if err != nil {
+    return nil, err
+  }
+  ca, err := x509.ParseCertificate(caDER)
+  if err != nil {
+    return nil, err
+  }
+  caFile := filepath.Join(dir, "ca.pem")
+  if err = writePEM(caFile, "CERTIFICATE", caDER); err != nil {
+    return nil, err
+  }
+  rv := make(map[string]Files)
+  for i, name := range names {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+      return nil, err
+    }
+    tmpl := &x509.Certificate{
+      SerialNumber: big.NewInt(int64(i + 2)),
+      Subject: pkix.Name{CommonName: name},
+      DNSNames: []string{name},
+      IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+      NotBefore: time.Now().Add(-time.Hour),
+      NotAfter: time.Now().Add(time.Hour),
+      ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth,
+                                      x509.ExtKeyUsageClientAuth},
+    }
+    der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+    if err != nil {
+      return nil, err
+    }
+    keyDER, err := x509.MarshalECPrivateKey(key)
+    if err != nil {
+      return nil, err
+    }
+    files := Files{
+      Cert: filepath.Join(dir, name + ".pem"),
+      Key: filepath.Join(dir, name + "-key.pem"),
+      CA: caFile,
+    }
+    if err = writePEM(files.Cert, "CERTIFICATE", der); err != nil {
+      return nil, err
+    }
+    if err = writePEM(files.Key, "EC PRIVATE KEY", keyDER); err != nil {
+      return nil, err
+    }
+    rv[name] = files
+  }
+  return rv, nil
+}
+
+// Write a single PEM block of the given kind to a new file.
+func writePEM(path, kind string, der []byte) error {
+  data := pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der})
+  return os.WriteFile(path, data, 0600)
+}
@@ -0,0 +1,111 @@
+package util
+
+import (
+  "math/rand"
+  "sync"
+  "time"
+)
+
+// A sampling tick.
+type Tick struct {
+  // Interval boundary this tick belongs to.
+  Time   time.Time
+  // Number of ticks skipped since the previous one, e.g. because the host
+  // was suspended or the agent stalled.
+  Missed int
+}
+
+// Delivers ticks aligned to wall-clock multiples of an interval (e.g. :00,
+// :10, :20 for a 10 second interval), so that samples taken on different
+// hosts line up. Unlike a time.Ticker, ticks that can't be delivered on
+// time are counted rather than silently coalesced.
+type Ticker struct {
+  C        <-chan Tick
+  c        chan Tick
+  interval time.Duration
+  offset   time.Duration
+  stop     chan struct{}
+}
+
+// Create a new ticker for the given interval. Each tick is delivered at a
+// random but fixed offset of up to the given jitter after its boundary, to
+// spread the load of many agents on a collector; its time is still the
+// boundary itself.
+func NewTicker(interval, jitter time.Duration) *Ticker {
+  c := make(chan Tick)
+  t := &Ticker{C: c, c: c, interval: interval, stop: make(chan struct{})}
+  if jitter > 0 {
+    t.offset = time.Duration(rand.Int63n(int64(jitter)))
+  }
+  go t.run()
+  return t
+}
+
+// Stop delivering ticks.
+func (t *Ticker) Stop() {
+  close(t.stop)
+}
+
+// Deliver ticks until stopped. A tick not yet taken when the next one is
+// due is replaced by it, and counted as missed.
+func (t *Ticker) run() {
+  next := time.Now().Truncate(t.interval).Add(t.interval)
+  var pending *Tick
+  for {
+    timer := time.NewTimer(time.Until(next.Add(t.offset)))
+    var out chan Tick
+    var tick Tick
+    if pending != nil {
+      out, tick = t.c, *pending
+    }
+    select {
+    case out <- tick:
+      pending = nil
+      timer.Stop()
+      continue
+    case <-timer.C:
+    case <-t.stop:
+      timer.Stop()
+      return
+    }
+    // Compare against the wall clock, which keeps running while the host
+    // is suspended, unlike the monotonic clock timers use.
+    tick = Tick{}
+    if late := time.Now().Round(0).Sub(next.Add(t.offset)); late >= t.interval {
+      tick.Missed = int(late / t.interval)
+      next = next.Add(time.Duration(tick.Missed) * t.interval)
+    }
+    if pending != nil {
+      tick.Missed += pending.Missed + 1
+    }
+    tick.Time = next
+    pending = &tick
+    next = next.Add(t.interval)
+  }
+}
+
+// Clock reporting the time of the current tick, so that every sample taken
+// during a tick is stamped with the same time.
+type TickClock struct {
+  mu sync.Mutex
+  t  time.Time
+}
+
+// Create a new clock at the given time.
+func NewTickClock(t time.Time) *TickClock {
+  return &TickClock{t: t}
+}
+
+// Move the clock on to the given tick time.
+func (c *TickClock) Set(t time.Time) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  c.t = t
+}
+
+// Returns the time of the current tick.
+func (c *TickClock) Now() time.Time {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  return c.t
+}
@@ -0,0 +1,41 @@
+package util
+
+import (
+  "github.com/bmizerany/assert"
+  "testing"
+  "time"
+)
+
+func Test_Ticker_should_tick_on_interval_boundaries(t *testing.T) {
+  interval := 50 * time.Millisecond
+  ticker := NewTicker(interval, 0)
+  defer ticker.Stop()
+  prev := (<-ticker.C).Time
+  for i := 0; i < 3; i++ {
+    tick := <-ticker.C
+    assert.Equal(t, time.Duration(0), tick.Time.Sub(tick.Time.Truncate(interval)))
+    assert.Equal(t, interval, tick.Time.Sub(prev))
+    assert.Equal(t, 0, tick.Missed)
+    prev = tick.Time
+  }
+}
+
+func Test_Ticker_should_count_missed_ticks(t *testing.T) {
+  interval := 50 * time.Millisecond
+  ticker := NewTicker(interval, 20 * time.Millisecond)
+  defer ticker.Stop()
+  prev := (<-ticker.C).Time
+  <-ticker.C
+  time.Sleep(4 * interval)
+  tick := <-ticker.C
+  assert.Equal(t, true, tick.Missed >= 2)
+  assert.Equal(t, time.Duration(tick.Missed + 2) * interval, tick.Time.Sub(prev))
+}
+
+func Test_TickClock_should_report_tick_time(t *testing.T) {
+  t0 := time.Unix(1000, 0)
+  clock := NewTickClock(t0)
+  assert.Equal(t, t0, Now(clock))
+  clock.Set(t0.Add(time.Second))
+  assert.Equal(t, t0.Add(time.Second), clock.Now())
+}
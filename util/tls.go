@@ -0,0 +1,128 @@
+package util
+
+import (
+  "crypto/tls"
+  "crypto/x509"
+  "fmt"
+  "io/ioutil"
+  "log"
+  "os"
+  "sync"
+  "time"
+)
+
+// Paths of the PEM files used for mutual TLS between agents and the
+// collector: our own certificate and key, and the CA certificates that the
+// other end's certificate must be signed by.
+type TLSFiles struct {
+  Cert string
+  Key  string
+  CA   string
+}
+
+// Provides TLS configurations from certificate, key and CA files, reloading
+// them whenever the files change so that certificates can be rotated
+// without restarting. If changed files can't be loaded (e.g. because only
+// one of the certificate and key has been replaced so far), the previous
+// ones carry on being used.
+type TLSReloader struct {
+  files   TLSFiles
+  mu      sync.Mutex
+  stamp   string
+  cert    *tls.Certificate
+  pool    *x509.CertPool
+}
+
+// Create a new reloader for the given files, loading them immediately.
+func NewTLSReloader(files TLSFiles) (*TLSReloader, error) {
+  r := &TLSReloader{files: files}
+  if err := r.load(); err != nil {
+    return nil, err
+  }
+  return r, nil
+}
+
+// Load the files, if they've changed since they were last loaded.
+func (r *TLSReloader) load() error {
+  var stamp string
+  for _, path := range []string{r.files.Cert, r.files.Key, r.files.CA} {
+    fi, err := os.Stat(path)
+    if err != nil {
+      return err
+    }
+    stamp += fmt.Sprintf("%d.%d ", fi.ModTime().UnixNano(), fi.Size())
+  }
+  if stamp == r.stamp {
+    return nil
+  }
+  cert, err := tls.LoadX509KeyPair(r.files.Cert, r.files.Key)
+  if err != nil {
+    return err
+  }
+  raw, err := ioutil.ReadFile(r.files.CA)
+  if err != nil {
+    return err
+  }
+  pool := x509.NewCertPool()
+  if !pool.AppendCertsFromPEM(raw) {
+    return fmt.Errorf("%s: no CA certificates found", r.files.CA)
+  }
+  r.stamp, r.cert, r.pool = stamp, &cert, pool
+  return nil
+}
+
+// Returns the current certificate and CA pool, reloading them if their
+// files have changed.
+func (r *TLSReloader) current() (*tls.Certificate, *x509.CertPool) {
+  r.mu.Lock()
+  defer r.mu.Unlock()
+  if err := r.load(); err != nil {
+    log.Printf("could not reload TLS files, keeping previous: %s\n", err)
+  }
+  return r.cert, r.pool
+}
+
+// Returns a configuration for the collector, which requires agents to
+// present a certificate signed by the CA.
+func (r *TLSReloader) ServerConfig() *tls.Config {
+  return &tls.Config{
+    MinVersion: tls.VersionTLS12,
+    GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+      cert, pool := r.current()
+      return &tls.Config{
+        MinVersion: tls.VersionTLS12,
+        Certificates: []tls.Certificate{*cert},
+        ClientCAs: pool,
+        ClientAuth: tls.RequireAndVerifyClientCert,
+      }, nil
+    },
+  }
+}
+
+// Returns a configuration for an agent connecting to the named collector,
+// which must present a certificate signed by the CA.
+func (r *TLSReloader) ClientConfig(serverName string) *tls.Config {
+  cert, pool := r.current()
+  return &tls.Config{
+    MinVersion: tls.VersionTLS12,
+    ServerName: serverName,
+    Certificates: []tls.Certificate{*cert},
+    RootCAs: pool,
+  }
+}
+
+// Returns the identity given by the common name of the certificate that
+// the other end of a TLS connection presented, completing the handshake if
+// it hasn't been already.
+func PeerName(conn *tls.Conn, timeout time.Duration) (string, error) {
+  conn.SetDeadline(time.Now().Add(timeout))
+  defer conn.SetDeadline(time.Time{})
+  if err := conn.Handshake(); err != nil {
+    return "", err
+  }
+  certs := conn.ConnectionState().PeerCertificates
+  if len(certs) == 0 || certs[0].Subject.CommonName == "" {
+    return "", fmt.Errorf("no certificate common name")
+  }
+  return certs[0].Subject.CommonName, nil
+}
@@ -0,0 +1,102 @@
+package util
+
+import (
+  "crypto/tls"
+  "github.com/bmizerany/assert"
+  "net"
+  "os"
+  "path/filepath"
+  "testing"
+  "time"
+  "./testpki"
+)
+
+// Accept a single TLS connection and return the peer's name.
+func acceptPeerName(l net.Listener, names chan string) {
+  conn, err := l.Accept()
+  if err != nil {
+    names <- err.Error()
+    return
+  }
+  defer conn.Close()
+  name, err := PeerName(conn.(*tls.Conn), time.Second)
+  if err != nil {
+    name = "error"
+  }
+  names <- name
+}
+
+func Test_TLSReloader_should_pick_up_rotated_certificates(t *testing.T) {
+  dir := t.TempDir()
+  pki, err := testpki.Write(dir, "collector", "web1")
+  if err != nil {
+    t.Fatalf("could not write test PKI: %s", err)
+  }
+  server, err := NewTLSReloader(TLSFiles(pki["collector"]))
+  if err != nil {
+    t.Fatalf("NewTLSReloader() failed: %s", err)
+  }
+  client, err := NewTLSReloader(TLSFiles(pki["web1"]))
+  if err != nil {
+    t.Fatalf("NewTLSReloader() failed: %s", err)
+  }
+  l, _ := net.Listen("tcp", "127.0.0.1:0")
+  l = tls.NewListener(l, server.ServerConfig())
+  defer l.Close()
+  names := make(chan string, 1)
+
+  go acceptPeerName(l, names)
+  conn, err := tls.Dial("tcp", l.Addr().String(), client.ClientConfig("127.0.0.1"))
+  if err != nil {
+    t.Fatalf("could not connect: %s", err)
+  }
+  conn.Close()
+  assert.Equal(t, "web1", <-names)
+
+  // Rotate in a certificate from a new CA, with the same file names.
+  rotated := t.TempDir()
+  if _, err = testpki.Write(rotated, "collector", "web1-renamed"); err != nil {
+    t.Fatalf("could not write test PKI: %s", err)
+  }
+  for _, pair := range [][]string{
+    {"ca.pem", "ca.pem"}, {"collector.pem", "collector.pem"},
+    {"collector-key.pem", "collector-key.pem"},
+    {"web1-renamed.pem", "web1.pem"}, {"web1-renamed-key.pem", "web1-key.pem"},
+  } {
+    if err = os.Rename(filepath.Join(rotated, pair[0]), filepath.Join(dir, pair[1])); err != nil {
+      t.Fatal(err)
+    }
+  }
+  go acceptPeerName(l, names)
+  conn, err = tls.Dial("tcp", l.Addr().String(), client.ClientConfig("127.0.0.1"))
+  if err != nil {
+    t.Fatalf("could not connect after rotation: %s", err)
+  }
+  conn.Close()
+  assert.Equal(t, "web1-renamed", <-names)
+}
+
+func Test_TLSReloader_should_reject_clients_without_certificates(t *testing.T) {
+  dir := t.TempDir()
+  pki, err := testpki.Write(dir, "collector")
+  if err != nil {
+    t.Fatalf("could not write test PKI: %s", err)
+  }
+  server, err := NewTLSReloader(TLSFiles(pki["collector"]))
+  if err != nil {
+    t.Fatalf("NewTLSReloader() failed: %s", err)
+  }
+  l, _ := net.Listen("tcp", "127.0.0.1:0")
+  l = tls.NewListener(l, server.ServerConfig())
+  defer l.Close()
+  names := make(chan string, 1)
+  go acceptPeerName(l, names)
+  config := server.ClientConfig("127.0.0.1")
+  config.Certificates = nil
+  if conn, err := tls.Dial("tcp", l.Addr().String(), config); err == nil {
+    // TLS 1.3 clients only learn of the rejection on their first read.
+    conn.Read(make([]byte, 1))
+    conn.Close()
+  }
+  assert.Equal(t, "error", <-names)
+}
@@ -0,0 +1,203 @@
+package util
+
+import (
+  "bufio"
+  "bytes"
+  "compress/gzip"
+  "encoding/binary"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "sort"
+)
+
+// The agent-to-collector transport. On connecting, an agent sends a Hello
+// as a line of JSON, and the collector answers with a Welcome. The agent
+// then sends batches of samples, each framed as a 4-byte big-endian length
+// followed by the batch: a line of JSON per sample, compressed as agreed.
+// An agent closing the connection on purpose, rather than because it's
+// failed, first says goodbye with an empty frame.
+
+// Version of the transport spoken by this agent, sent in its Hello.
+// Collectors refuse agents that speak a version they don't know.
+const ProtocolVersion = 1
+
+// Largest batch the collector accepts, in bytes, both on the wire and once
+// decompressed.
+const MaxBatchBytes = 64 * 1024 * 1024
+
+// First message sent by an agent on each connection to the collector,
+// identifying the host it reports for.
+type Hello struct {
+  Host        string   `json:"host"`
+  // Version of the transport the agent speaks.
+  Version     int      `json:"version"`
+  // Compression methods the agent can use, in order of preference.
+  Compression []string `json:"compression,omitempty"`
+  // Seconds between the agent's samples, so the collector knows when to
+  // expect them; unknown if zero.
+  Interval    float64  `json:"interval,omitempty"`
+}
+
+// Collector's answer to a Hello.
+type Welcome struct {
+  // Compression method to use for batches; none if empty.
+  Compression string `json:"compression,omitempty"`
+}
+
+// Returned by ReadBatch when the agent has said goodbye.
+var ErrGoodbye = errors.New("agent said goodbye")
+
+// Supported compression methods, by name.
+var compressors = map[string]struct {
+  compress   func(io.Writer) io.WriteCloser
+  decompress func(io.Reader) (io.ReadCloser, error)
+}{
+  "gzip": {
+    func(w io.Writer) io.WriteCloser {
+      return gzip.NewWriter(w)
+    },
+    func(r io.Reader) (io.ReadCloser, error) {
+      return gzip.NewReader(r)
+    },
+  },
+}
+
+// Returns the names of the supported compression methods.
+func Compressions() []string {
+  rv := make([]string, 0, len(compressors))
+  for name := range compressors {
+    rv = append(rv, name)
+  }
+  sort.Strings(rv)
+  return rv
+}
+
+// Pick the first of the offered compression methods that's supported, or
+// none if none are.
+func NegotiateCompression(offered []string) string {
+  for _, name := range offered {
+    if _, ok := compressors[name]; ok {
+      return name
+    }
+  }
+  return ""
+}
+
+// Write a message as a line of JSON.
+func WriteMessage(w io.Writer, v interface{}) error {
+  return json.NewEncoder(w).Encode(v)
+}
+
+// Read a message written as a line of JSON. Reads no further than the end
+// of the line, so that whatever follows can be read from r.
+func ReadMessage(r *bufio.Reader, v interface{}) error {
+  line, err := r.ReadBytes('\n')
+  if err != nil {
+    return err
+  }
+  return json.Unmarshal(line, v)
+}
+
+// Write a batch of samples compressed with the given method, returning
+// its size before and after compression.
+func WriteBatch(w io.Writer, compression string, samples []*Sample) (raw, wire int, err error) {
+  payload := EncodeBatch(samples)
+  raw = len(payload)
+  wire, err = WriteFrame(w, compression, payload)
+  return
+}
+
+// Encode a batch of samples, uncompressed, as the payload of a frame.
+// Samples that can't be encoded, e.g. with NaN fields, are left out.
+func EncodeBatch(samples []*Sample) []byte {
+  var plain bytes.Buffer
+  enc := json.NewEncoder(&plain)
+  for _, sample := range samples {
+    enc.Encode(sample)
+  }
+  return plain.Bytes()
+}
+
+// Write an encoded batch as a frame compressed with the given method,
+// returning the frame's size.
+func WriteFrame(w io.Writer, compression string, payload []byte) (wire int, err error) {
+  if compression != "" {
+    c, ok := compressors[compression]
+    if !ok {
+      err = fmt.Errorf("unknown compression: %s", compression)
+      return
+    }
+    var packed bytes.Buffer
+    cw := c.compress(&packed)
+    if _, err = cw.Write(payload); err != nil {
+      return
+    }
+    if err = cw.Close(); err != nil {
+      return
+    }
+    payload = packed.Bytes()
+  }
+  frame := make([]byte, 4 + len(payload))
+  binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+  copy(frame[4:], payload)
+  if _, err = w.Write(frame); err != nil {
+    return
+  }
+  wire = len(frame)
+  return
+}
+
+// Say goodbye before closing a connection on purpose.
+func WriteGoodbye(w io.Writer) error {
+  _, err := w.Write(make([]byte, 4))
+  return err
+}
+
+// Read a batch of samples compressed with the given method. Returns
+// ErrGoodbye if the agent has said goodbye instead.
+func ReadBatch(r io.Reader, compression string) ([]*Sample, error) {
+  var size uint32
+  if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+    return nil, err
+  }
+  if size == 0 {
+    return nil, ErrGoodbye
+  }
+  if size > MaxBatchBytes {
+    return nil, fmt.Errorf("batch of %d bytes is too large", size)
+  }
+  var payload io.Reader = io.LimitReader(r, int64(size))
+  if compression != "" {
+    c, ok := compressors[compression]
+    if !ok {
+      return nil, fmt.Errorf("unknown compression: %s", compression)
+    }
+    cr, err := c.decompress(payload)
+    if err != nil {
+      return nil, err
+    }
+    defer cr.Close()
+    // Don't let a small batch expand without bound.
+    payload = io.LimitReader(cr, MaxBatchBytes + 1)
+  }
+  raw, err := ioutil.ReadAll(payload)
+  if err != nil {
+    return nil, err
+  }
+  if len(raw) > MaxBatchBytes {
+    return nil, fmt.Errorf("batch is too large once decompressed")
+  }
+  samples := make([]*Sample, 0)
+  dec := json.NewDecoder(bytes.NewReader(raw))
+  for dec.More() {
+    sample := &Sample{}
+    if err = dec.Decode(sample); err != nil {
+      return nil, err
+    }
+    samples = append(samples, sample)
+  }
+  return samples, nil
+}
@@ -0,0 +1,76 @@
+package util
+
+import (
+  "bytes"
+  "compress/gzip"
+  "encoding/binary"
+  "github.com/bmizerany/assert"
+  "io"
+  "strings"
+  "testing"
+  "time"
+)
+
+func Test_WriteBatch_should_round_trip_compressed_samples(t *testing.T) {
+  samples := make([]*Sample, 0)
+  for i := 0; i < 100; i++ {
+    sample, _ := NewSample("load", 1.5, 1.0, 0.5, i, Tags{"env": "prod"})
+    sample.Host = "web1"
+    sample.Time = time.Unix(1500000000, 0).UTC()
+    samples = append(samples, sample)
+  }
+  for _, compression := range []string{"", "gzip"} {
+    var buf bytes.Buffer
+    raw, wire, err := WriteBatch(&buf, compression, samples)
+    if err != nil {
+      t.Fatalf("WriteBatch(%q) failed: %s", compression, err)
+    }
+    assert.Equal(t, wire, buf.Len())
+    if compression == "" {
+      assert.Equal(t, raw + 4, wire)
+    } else {
+      assert.Equal(t, true, wire * 5 < raw)
+    }
+    got, err := ReadBatch(&buf, compression)
+    if err != nil {
+      t.Fatalf("ReadBatch(%q) failed: %s", compression, err)
+    }
+    assert.Equal(t, samples, got)
+  }
+}
+
+func Test_ReadBatch_should_tell_goodbyes_from_disconnects(t *testing.T) {
+  var buf bytes.Buffer
+  WriteBatch(&buf, "gzip", []*Sample{})
+  WriteGoodbye(&buf)
+  got, err := ReadBatch(&buf, "gzip")
+  assert.Equal(t, nil, err)
+  assert.Equal(t, 0, len(got))
+  _, err = ReadBatch(&buf, "gzip")
+  assert.Equal(t, ErrGoodbye, err)
+  _, err = ReadBatch(&buf, "gzip")
+  assert.Equal(t, io.EOF, err)
+}
+
+func Test_NegotiateCompression_should_pick_first_supported_method(t *testing.T) {
+  assert.Equal(t, "gzip", NegotiateCompression([]string{"zstd", "gzip"}))
+  assert.Equal(t, "", NegotiateCompression([]string{"zstd"}))
+  assert.Equal(t, "", NegotiateCompression(nil))
+}
+
+func Test_ReadBatch_should_reject_batches_too_large_once_decompressed(t *testing.T) {
+  var packed bytes.Buffer
+  gz := gzip.NewWriter(&packed)
+  line := []byte(strings.Repeat(" ", 1023) + "\n")
+  for n := 0; n <= MaxBatchBytes; n += len(line) {
+    gz.Write(line)
+  }
+  gz.Close()
+  var frame bytes.Buffer
+  binary.Write(&frame, binary.BigEndian, uint32(packed.Len()))
+  frame.Write(packed.Bytes())
+  _, err := ReadBatch(&frame, "gzip")
+  if err == nil || !strings.Contains(err.Error(), "too large") {
+    t.Fatalf("expected oversized batch to be rejected, got %v", err)
+  }
+}